@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/teejays/clog"
@@ -14,22 +15,97 @@ import (
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
 
 type AlertType struct {
-	Duration  time.Duration
-	Threshold int
+	Kind       AlertKind
+	Duration   time.Duration
+	Resolution time.Duration // of the rolling count
+	Threshold  int
+	Clock      StatsClock // with the processing clock, anomaly alerts are also checked as the wall clock moves on
 	baseLogConsumer
 
-	CurrentMovingCount int
-	LatestLogNode      *AlertLogNode
-	OldestLogNode      *AlertLogNode
-	AlertOngoing       bool
-	Alerts             []Alert
+	RecoveryThreshold int           // threshold alerts resolve once the rolling count is below this
+	For               time.Duration // how long the condition needs to hold before the alert fires
+	MinFiring         time.Duration // how long an alert fires at least, even if it recovers sooner
+
+	Severity      AlertSeverity
+	Labels        map[string]string             // of every alert, on top of the group by values
+	Annotations   map[string]*template.Template // rendered with the alert, at every transition
+	eventHandlers []AlertEventHandler
+
+	GroupBy       []*ValueExpr           // if set, each group of logs has its own rolling count and alerts
+	MaxGroups     int                    // the most groups that are kept track of at once
+	GroupIdle     time.Duration          // groups without logs for this long are no longer kept track of
+	Groups        map[string]*AlertGroup // only set if there is a group by
+	EvictedGroups int
+
+	AlertGroup                           // the rolling count and alerts, if there is no group by
+	groupConfig   config.ConfigAlertType // to set up new groups
+	latestLogTime time.Time              // of all the groups
+	latestArrival time.Time              // wall-clock time at which the log of latestLogTime was read
 }
 
+// AlertKind determines what condition of the rolling count an alert type alerts on.
+type AlertKind string
+
+const (
+	// AlertKindThreshold alerts when the rolling count reaches the Threshold.
+	AlertKindThreshold AlertKind = "threshold"
+	// AlertKindAnomaly alerts when the rolling count deviates from its usual value (see AnomalyDetector).
+	AlertKindAnomaly AlertKind = "anomaly"
+	// AlertKindRatio alerts when the share of the rolling count that matches a filter reaches a threshold (see AlertRatio).
+	AlertKindRatio AlertKind = "ratio"
+	// AlertKindAbsence alerts when no log has been read for the Duration, in wall-clock time (see AlertAbsence).
+	AlertKindAbsence AlertKind = "absence"
+)
+
 func NewAlertTypeFromConfig(req config.ConfigAlertType) (*AlertType, error) {
 	var c = AlertType{
-		Duration:  time.Duration(req.DurationSeconds * int64(time.Second)),
-		Threshold: req.Threshold,
+		Kind:       AlertKindThreshold,
+		Duration:   time.Duration(req.DurationSeconds * int64(time.Second)),
+		Resolution: DefaultAlertResolution,
+		Threshold:  req.Threshold,
+		Clock:      StatsClockAuto,
+	}
+	if req.ResolutionSeconds < 0 {
+		return nil, fmt.Errorf("alert type '%s': resolution cannot be negative", req.Name)
+	}
+	if req.ResolutionSeconds > 0 {
+		c.Resolution = time.Duration(req.ResolutionSeconds * int64(time.Second))
+	}
+	switch AlertKind(req.Kind) {
+	case "", AlertKindThreshold:
+	case AlertKindAnomaly, AlertKindRatio:
+		c.Kind = AlertKind(req.Kind)
+	case AlertKindAbsence:
+		c.Kind = AlertKindAbsence
+		if c.Duration <= 0 {
+			return nil, fmt.Errorf("alert type '%s': absence alerts need a duration", req.Name)
+		}
+	default:
+		return nil, fmt.Errorf("alert type '%s': kind '%s' not recognized", req.Name, req.Kind)
+	}
+	switch StatsClock(req.Clock) {
+	case "":
+	case StatsClockAuto, StatsClockEvent, StatsClockProcessing:
+		c.Clock = StatsClock(req.Clock)
+	default:
+		return nil, fmt.Errorf("alert type '%s': clock '%s' not recognized", req.Name, req.Clock)
+	}
+	if err := c.setStateFromConfig(req); err != nil {
+		return nil, fmt.Errorf("alert type '%s': %w", req.Name, err)
+	}
+	if err := c.setGroupsFromConfig(req); err != nil {
+		return nil, fmt.Errorf("alert type '%s': %w", req.Name, err)
+	}
+	if err := c.setEventsFromConfig(req); err != nil {
+		return nil, fmt.Errorf("alert type '%s': %w", req.Name, err)
 	}
+	// The group for an alert type without a group by is set up right away, which also checks the config of its kind
+	c.groupConfig = req
+	g, err := c.newGroup(nil)
+	if err != nil {
+		return nil, fmt.Errorf("alert type '%s': %w", req.Name, err)
+	}
+	c.AlertGroup = *g
 	c.baseLogConsumer.Name = req.Name
 	c.baseLogConsumer.Lock = &sync.RWMutex{}
 	c.baseLogConsumer.InQueue = make(chan LogMessageStructured, 8)
@@ -41,9 +117,9 @@ func NewAlertTypeFromConfig(req config.ConfigAlertType) (*AlertType, error) {
 			return nil, fmt.Errorf("multiple stats source settings for log source found")
 		}
 
-		settings, err := NewAlertTypeSourceSettings(cfgSettings.Key, cfgSettings.ValueMutateFuncName, cfgSettings.Values)
+		settings, err := NewAlertTypeSourceSettings(cfgSettings.Key, cfgSettings.ValueMutateFuncName, cfgSettings.Values, cfgSettings.Filter)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("alert type '%s', source '%s': %w", req.Name, cfgSettings.Name, err)
 		}
 
 		sourceSettingsMap[cfgSettings.Name] = settings
@@ -55,7 +131,43 @@ func NewAlertTypeFromConfig(req config.ConfigAlertType) (*AlertType, error) {
 }
 
 func (c *AlertType) PrepareForConsumption(currentTime time.Time) error {
-	// Nothing needs to be done...
+	// The sources are all registered by now
+	if c.Clock == StatsClockAuto {
+		c.Clock = c.detectClock()
+		clog.Debugf("[%s] Using the %s clock", c.Name, c.Clock)
+	}
+	return nil
+}
+
+// Flush evaluates absence alerts against the wall clock. With the processing clock, it also evaluates anomaly alerts
+// against the rolling count at the current time, so a drop in traffic alerts even once the logs stop coming in. Other
+// alerts are only evaluated when logs come in.
+func (c *AlertType) Flush(now time.Time) error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	// Drop the monotonic clock reading, which would otherwise show up in the notifications
+	now = now.Round(0)
+	if c.Kind == AlertKindAbsence {
+		for _, g := range c.groups() {
+			c.evaluate(g, now)
+		}
+	}
+	if c.Kind == AlertKindAnomaly && c.Clock == StatsClockProcessing && !c.latestLogTime.IsZero() && now.After(c.latestArrival) {
+		// The time of the logs, had they kept coming in since the latest one
+		current := c.latestLogTime.Add(now.Sub(c.latestArrival))
+		for _, g := range c.groups() {
+			if g.Counter.Latest.IsZero() {
+				continue
+			}
+			g.Counter.AdvanceTo(current)
+			g.CurrentMovingCount = g.Counter.Count
+			c.evaluate(g, current)
+		}
+	}
+	if c.Groups != nil {
+		c.evictIdleGroups(now)
+	}
 	return nil
 }
 
@@ -81,156 +193,226 @@ func (c *AlertType) ConsumeLog(msg LogMessageStructured) error {
 
 	clog.Debugf("[%s] [%d] [%s] Including log in the alert...", msg.SourceName, msg.Id, c.Name)
 
-	// Inject the  new log into the chain
-	err = c.addToChain(msg)
+	// Which group is the log counted in?
+	g, err := c.getGroup(msg)
 	if err != nil {
 		return err
 	}
-	clog.Debugf("[%s] [%d] [%s] LogNode inserted.\nLatestNode: %+v\nOldestNode: %+v", msg.SourceName, msg.Id, c.Name, c.LatestLogNode, c.OldestLogNode)
+	if g == nil {
+		clog.Debugf("[%s] [%d] [%s] No room for the group of the log, as all %d groups are active", msg.SourceName, msg.Id, c.Name, len(c.Groups))
+		return nil
+	}
 
-	// Tree shake the cache to: start loop from the very bottom and reach a point at which we can cut off the tail
-	numRemoved, err := c.dropOldLogMessages()
-	if err != nil {
-		return err
+	// Absence alerts only need to know that the log came in, which resolves them
+	if g.Absence != nil {
+		receivedAt := msg.ReceivedAt.Round(0)
+		if receivedAt.IsZero() {
+			receivedAt = time.Now().Round(0)
+		}
+		g.Absence.Seen(receivedAt)
+		c.evaluate(g, receivedAt)
+		return nil
 	}
-	clog.Debugf("[%s] [%d] [%s] Tree shaking complete: %d nodes removed", msg.SourceName, msg.Id, c.Name, numRemoved)
 
-	// Update the count?
-	c.CurrentMovingCount = c.CurrentMovingCount + 1 - numRemoved // + 1 for the new node which was added
-	clog.Debugf("[%s] [%d] [%s] Chain Count: %d", msg.SourceName, msg.Id, c.Name, c.CurrentMovingCount)
+	// For ratio alerts, see if the log is also in the numerator
+	var inNumerator bool
+	if g.Ratio != nil {
+		inNumerator, err = g.Ratio.Numerator.Match(msg.KV)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Does the count signal a state of alert?
-	var alertMode bool
-	if c.CurrentMovingCount >= c.Threshold {
-		alertMode = true
+	// Count the log, which also drops the logs that are no longer within the duration
+	g.Counter.Add(msg.T, inNumerator)
+	if g.Ratio != nil {
+		g.Ratio.NumeratorCount = g.Counter.NumeratorCount
+	}
+	if g.Anomaly != nil {
+		g.Anomaly.Add(msg.T)
 	}
 
-	// If we should alert, and there is an ongoing alert already... don't do much
-	latestTimestamp := c.LatestLogNode.T
-	// If we should alert, but no ongoing alert
-	if alertMode {
-		c.triggerAlert(latestTimestamp)
+	g.CurrentMovingCount = g.Counter.Count
+	clog.Debugf("[%s] [%d] [%s] Rolling Count: %d", msg.SourceName, msg.Id, c.Name, g.CurrentMovingCount)
+	if g.Counter.Latest.After(c.latestLogTime) {
+		c.latestLogTime = g.Counter.Latest
+		c.latestArrival = msg.ReceivedAt.Round(0)
+		if c.latestArrival.IsZero() {
+			c.latestArrival = time.Now().Round(0)
+		}
 	}
 
-	// If we should not alert, but an ongoing alert, then close it down
-	if !alertMode {
-		c.closeAlert(latestTimestamp)
+	// Does the count signal a state of alert, or a recovery from one?
+	c.evaluate(g, g.Counter.Latest)
+
+	return nil
+
+}
+
+// FinishConsumption resolves the ongoing alerts, if any, since there will be no more logs to recover them.
+func (c *AlertType) FinishConsumption() error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	for _, g := range c.groups() {
+		end := time.Now().Round(0)
+		if g.Counter != nil && !g.Counter.Latest.IsZero() {
+			end = g.Counter.Latest
+		}
+		c.resolveGroup(g, end, "as there are no more logs")
 	}
 
 	return nil
+}
+
+// isAlertCondition tells if the rolling count (or for absence alerts, the time) signals a state of alert.
+func (c *AlertType) isAlertCondition(g *AlertGroup, t time.Time) bool {
+	switch c.Kind {
+	case AlertKindAnomaly:
+		return g.Anomaly.IsAnomaly(g.CurrentMovingCount)
+	case AlertKindRatio:
+		return g.Ratio.IsAlert(g.CurrentMovingCount)
+	case AlertKindAbsence:
+		return g.Absence.IsAlert(t)
+	default:
+		return g.CurrentMovingCount >= c.Threshold
+	}
+}
 
+// isRecoveredCondition tells if the rolling count (or for absence alerts, the time) signals that an ongoing alert
+// has recovered. It's not just the opposite of isAlertCondition, as each kind can recover at a lower threshold.
+func (c *AlertType) isRecoveredCondition(g *AlertGroup, t time.Time) bool {
+	switch c.Kind {
+	case AlertKindAnomaly:
+		return g.Anomaly.IsRecovered(g.CurrentMovingCount)
+	case AlertKindRatio:
+		return g.Ratio.IsRecovered(g.CurrentMovingCount)
+	case AlertKindAbsence:
+		return !g.Absence.IsAlert(t)
+	default:
+		return g.CurrentMovingCount < c.RecoveryThreshold
+	}
 }
 
-func (c *AlertType) triggerAlert(start time.Time) {
-	if c.AlertOngoing {
+func (c *AlertType) triggerAlert(g *AlertGroup, start time.Time) {
+	if g.AlertOngoing {
 		return
 	}
 
-	alert := Alert{
-		Start: start,
+	if g.Current == nil {
+		g.Current = c.newAlert(g, start)
+	}
+	alert := g.Current
+	alert.State = AlertStateFiring
+	alert.Start = start
+	alert.TriggerValue = c.value(g, start)
+	g.Alerts = append(g.Alerts, alert)
+	g.AlertOngoing = true
+	g.State = AlertStateFiring
+	name := c.groupName(g)
+	flapping := c.isFlapping(g, start)
+	previous := AlertStatePending
+	if c.For == 0 {
+		previous = AlertStateInactive // the alert was not pending for long enough to be emitted
+	}
+	c.emit(g, previous, start)
+	if flapping {
+		clog.Debugf("%s fired at %s, but is flapping", name, start)
+		return
 	}
-	c.Alerts = append(c.Alerts, alert)
-	c.AlertOngoing = true
 
 	// Do something!
-	clog.Noticef("%s generated an alert - hits = %d, triggered at %s", c.Name, c.CurrentMovingCount, start)
+	if g.Anomaly != nil {
+		clog.Noticef("%s generated an alert - hits = %d (usually %.1f ± %.1f, z-score %.1f), triggered at %s", name, g.CurrentMovingCount, g.Anomaly.Baseline.Center(), g.Anomaly.Baseline.Deviation(), g.Anomaly.Score, start)
+		return
+	}
+	if g.Absence != nil {
+		clog.Noticef("%s generated an alert - no logs since %s, triggered at %s", name, g.Absence.LastSeen, start)
+		return
+	}
+	if g.Ratio != nil {
+		clog.Noticef("%s generated an alert - hits = %d of %d (%.1f%%), triggered at %s", name, g.Ratio.NumeratorCount, g.CurrentMovingCount, g.Ratio.Get(g.CurrentMovingCount)*100, start)
+		return
+	}
+	clog.Noticef("%s generated an alert - hits = %d, triggered at %s", name, g.CurrentMovingCount, start)
 
 }
-func (c *AlertType) closeAlert(end time.Time) {
-	if !c.AlertOngoing {
+func (c *AlertType) closeAlert(g *AlertGroup, end time.Time) {
+	if !g.AlertOngoing {
+		return
+	}
+	g.AlertOngoing = false
+	g.State = AlertStateInactive
+	flapping := c.isFlapping(g, end)
+	c.endAlert(g, AlertStateFiring, end)
+	if flapping {
+		clog.Debugf("%s recovered at %s, but is flapping", c.groupName(g), end)
 		return
 	}
-	c.Alerts[len(c.Alerts)-1].End = end
-	c.AlertOngoing = false
 
-	clog.Noticef("High traffic alert recovered at %s", end)
+	clog.Noticef("%s alert recovered at %s", c.groupName(g), end)
 
 }
 
-func (s *AlertType) addToChain(msg LogMessageStructured) error {
-
-	// Inject the  new log into the chain
-	var currentNode = s.LatestLogNode
-
-	// Loop and find the log node before which we should place this log.
-	for {
-		if currentNode != nil && msg.T.Before(currentNode.T) {
-			currentNode = currentNode.Previous
-			continue
-		}
-
-		var newLogNode AlertLogNode
-		newLogNode.LogMessageStructured = msg
-		newLogNode.Previous = currentNode
-
-		if currentNode != nil {
-			newLogNode.Next = currentNode.Next
-			currentNode.Next = &newLogNode
-		}
-
-		// if we're adding as last node
-		if newLogNode.Next == nil {
-			s.LatestLogNode = &newLogNode
-		}
+// resolveGroup resolves the ongoing alert of the group, if any, without it having recovered e.g. as there are no more
+// logs. A pending alert is dropped.
+func (c *AlertType) resolveGroup(g *AlertGroup, end time.Time, reason string) {
+	previous := g.State
+	g.State = AlertStateInactive
+	if previous == AlertStatePending {
+		c.endAlert(g, AlertStatePending, end)
+	}
+	if !g.AlertOngoing {
+		return
+	}
+	g.AlertOngoing = false
+	c.endAlert(g, AlertStateFiring, end)
 
-		// if we're placing it at first node
-		if newLogNode.Previous == nil {
-			s.OldestLogNode = &newLogNode
-		}
+	clog.Noticef("%s alert resolved at %s, %s", c.groupName(g), end, reason)
+}
 
-		break
+// endAlert resolves the current alert of the group, which was in the previous state.
+func (c *AlertType) endAlert(g *AlertGroup, previous AlertState, end time.Time) {
+	if g.Current == nil {
+		return
 	}
-	return nil
+	g.Current.State = AlertStateResolved
+	g.Current.End = end
+	c.emit(g, previous, end)
+	g.Current = nil
 }
 
-func (s *AlertType) dropOldLogMessages() (int, error) {
-
-	// Tree shake the cache to: start loop from the very bottom and reach a point at which we can cut off the tail
-	latestTimestamp := s.LatestLogNode.T
-	currentNode := s.OldestLogNode
-	var numNodesRemoved int
-
-	for {
-		if latestTimestamp.Sub(currentNode.T) > s.Duration {
-			currentNode = currentNode.Next
-			numNodesRemoved++
-			continue
-		}
-		if currentNode == nil { // means we should shake off everything
-			s.OldestLogNode = nil
-			s.LatestLogNode = nil
-			break
-		}
-
-		// If we reach a point where the current node is within 2 mins of latest node, cut of everything below it
-		if currentNode.Previous != nil { // remove the next reference from the previous node
-			currentNode.Previous.Next = nil
-		}
-
-		currentNode.Previous = nil // remove the previous reference from the current node
-
-		// this should break the chain
-		s.OldestLogNode = currentNode
-		break
+// isFlapping records that the alert fired or resolved, and tells if notifying about it should be skipped as the alert
+// is flapping.
+func (c *AlertType) isFlapping(g *AlertGroup, t time.Time) bool {
+	if g.Flap == nil {
+		return false
 	}
-
-	return numNodesRemoved, nil
-
+	g.Flap.Add(t)
+	c.updateFlapping(g, t)
+	return g.Flap.Flapping
 }
 
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
 *  L O G  C O N S U M E R  - A L E R T S  -  S U B O B J E C T S
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
 
-type AlertLogNode struct {
-	LogMessageStructured
-	Previous *AlertLogNode
-	Next     *AlertLogNode
-}
-
+// Alert is an alert of an alert type, from when it's pending to when it's resolved.
 type Alert struct {
-	Start time.Time
-	End   time.Time
+	ID          string // the same through all the states of the alert
+	Name        string // of the alert type
+	State       AlertState
+	Severity    AlertSeverity
+	Labels      map[string]string // the static labels, the group by values, and the alertname
+	Annotations map[string]string // as of the latest transition
+	Flapping    bool
+
+	ActiveAt     time.Time // when it became pending
+	Start        time.Time // when it fired
+	End          time.Time // when it was resolved
+	Value        float64   // the rolling count, the ratio, or the seconds without logs for absence alerts
+	PeakValue    float64   // the highest value (the lowest, for anomaly alerts on drops) since it became pending
+	TriggerValue float64   // the value when it fired
 }
 
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
@@ -241,12 +423,19 @@ type AlertTypeSourceSettings struct {
 	Key             string                         // what key should we look at to include in the alert count?
 	ValueMutateFunc func(v string) (string, error) // logic to determine if the value should count
 	Values          []string                       // if value after mutation matches these, we include it in the count
+	Filter          *FilterExpr                    // if set, only logs that match this expression are included in the count
 }
 
-func NewAlertTypeSourceSettings(key string, valueMutateFuncName string, values []string) (AlertTypeSourceSettings, error) {
+func NewAlertTypeSourceSettings(key string, valueMutateFuncName string, values []string, filter string) (AlertTypeSourceSettings, error) {
 	var s AlertTypeSourceSettings
 	s.Key = key
 
+	var err error
+	s.Filter, err = CompileFilter(filter)
+	if err != nil {
+		return s, err
+	}
+
 	// Populate right Mutator Func Field
 	switch valueMutateFuncName {
 	case "":
@@ -287,6 +476,12 @@ func (s AlertTypeSourceSettings) GetCleanedKV(msg LogMessageStructured) (map[str
 }
 
 func (s AlertTypeSourceSettings) IsMatch(msg LogMessageStructured) (bool, error) {
+	// The filter expression, if any, needs to pass before we look at the key/values
+	ok, err := s.Filter.Match(msg.KV)
+	if err != nil || !ok {
+		return false, err
+	}
+
 	// If key is empty here, this means that we don't care about the key and want to count everything
 	if s.GetKey() == "" {
 		return true, nil
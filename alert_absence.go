@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  A B S E N C E
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertAbsence is the condition of absence (heartbeat) alerts: no matching log has been read for Timeout of wall-clock
+// time, e.g. because a source went silent. It's evaluated when the alert type is flushed, as no logs come in to do it.
+type AlertAbsence struct {
+	Timeout  time.Duration
+	LastSeen time.Time // processing time of the latest matching log, or when we started waiting for the first one
+}
+
+// Seen records that a matching log was read at the given time.
+func (a *AlertAbsence) Seen(t time.Time) {
+	if a.LastSeen.Before(t) {
+		a.LastSeen = t
+	}
+}
+
+// IsAlert tells if no matching log has been read for Timeout by the given time. The wait for the first log starts the
+// first time it's called.
+func (a *AlertAbsence) IsAlert(now time.Time) bool {
+	if a.LastSeen.IsZero() {
+		a.LastSeen = now
+	}
+	return now.Sub(a.LastSeen) >= a.Timeout
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  A N O M A L Y
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AnomalyDirection determines which deviations from the baseline are anomalies.
+type AnomalyDirection string
+
+const (
+	// AnomalyUp only alerts on counts that are higher than usual e.g. traffic spikes.
+	AnomalyUp AnomalyDirection = "up"
+	// AnomalyDown only alerts on counts that are lower than usual e.g. traffic drops.
+	AnomalyDown AnomalyDirection = "down"
+	// AnomalyBoth alerts on counts that are either higher or lower than usual.
+	AnomalyBoth AnomalyDirection = "both"
+)
+
+// DefaultAnomalySensitivity is the number of standard deviations from the baseline at which a count is an anomaly,
+// when none is configured.
+const DefaultAnomalySensitivity = 3
+
+// minAnomalyDeviation is the smallest deviation used for the score. Counts are whole numbers, so a baseline that has
+// never moved should not turn a single extra log into an anomaly.
+const minAnomalyDeviation = 1
+
+// maxAnomalyGapIntervals bounds the number of empty intervals that are learned after a gap in the logs. By then, the
+// baseline has long forgotten what came before.
+const maxAnomalyGapIntervals = 1000
+
+// ParseAnomalyDirection parses the direction from the config. Empty means both.
+func ParseAnomalyDirection(str string) (AnomalyDirection, error) {
+	switch AnomalyDirection(str) {
+	case "", AnomalyBoth:
+		return AnomalyBoth, nil
+	case AnomalyUp, AnomalyDown:
+		return AnomalyDirection(str), nil
+	}
+	return "", fmt.Errorf("direction '%s' not recognized", str)
+}
+
+// AnomalyDetector learns the usual rolling count of an alert type, and tells when the current one deviates from it by
+// more than Sensitivity standard deviations (its z-score).
+//
+// The baseline learns the count of each consecutive Interval (the duration of the alert type, so the counts are
+// comparable with the rolling count), including the intervals without any logs. Nothing is an anomaly until the
+// baseline has learned WarmupIntervals counts.
+type AnomalyDetector struct {
+	Interval            time.Duration
+	Sensitivity         float64
+	RecoverySensitivity float64 // the z-score below which an anomaly is over, defaults to the Sensitivity
+	Direction           AnomalyDirection
+	WarmupIntervals     int
+	MinCount            int // counts (or baselines, for drops) below this are never anomalies, so low traffic does not alert
+	Baseline            Baseline
+
+	intervalStart time.Time // start of the interval that is being counted
+	intervalCount int
+	Score         float64 // z-score of the latest count that was checked
+}
+
+func NewAnomalyDetectorFromConfig(req config.ConfigAlertType) (*AnomalyDetector, error) {
+	var d = AnomalyDetector{
+		Interval:        time.Duration(req.DurationSeconds * int64(time.Second)),
+		Sensitivity:     DefaultAnomalySensitivity,
+		WarmupIntervals: req.WarmupWindows,
+		MinCount:        req.MinCount,
+	}
+	if d.Interval <= 0 {
+		return nil, fmt.Errorf("anomaly alerts need a duration")
+	}
+	if req.Sensitivity < 0 {
+		return nil, fmt.Errorf("sensitivity cannot be negative")
+	}
+	if req.Sensitivity > 0 {
+		d.Sensitivity = float64(req.Sensitivity)
+	}
+	d.RecoverySensitivity = d.Sensitivity
+	if req.RecoverySensitivity != 0 {
+		if req.RecoverySensitivity < 0 || float64(req.RecoverySensitivity) > d.Sensitivity {
+			return nil, fmt.Errorf("recovery sensitivity should be more than 0, and at most the sensitivity")
+		}
+		d.RecoverySensitivity = float64(req.RecoverySensitivity)
+	}
+	var err error
+	d.Direction, err = ParseAnomalyDirection(req.Direction)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := ParseBaselineKind(req.Baseline)
+	if err != nil {
+		return nil, err
+	}
+	baselineWindows := req.BaselineWindows
+	if baselineWindows < 1 {
+		baselineWindows = DefaultBaselineWindows
+	}
+	d.Baseline = NewBaseline(kind, baselineWindows)
+	if d.WarmupIntervals < 1 {
+		d.WarmupIntervals = baselineWindows
+	}
+	return &d, nil
+}
+
+// Add counts a log in its interval. Once the logs move past the interval, its count, and the count of any empty
+// intervals after it, is learned by the baseline.
+func (d *AnomalyDetector) Add(t time.Time) {
+	if d.intervalStart.IsZero() {
+		d.intervalStart = t
+	}
+	if elapsed := t.Sub(d.intervalStart); elapsed >= d.Interval {
+		n := int(elapsed / d.Interval)
+		d.Baseline.Add(float64(d.intervalCount))
+		for i := 1; i < n && i < maxAnomalyGapIntervals; i++ {
+			d.Baseline.Add(0)
+		}
+		d.intervalStart = d.intervalStart.Add(time.Duration(n) * d.Interval)
+		d.intervalCount = 0
+	}
+	// Logs from before the interval, which are a little out of order, are counted in it
+	d.intervalCount++
+}
+
+// IsAnomaly tells if the count deviates from the baseline by more than Sensitivity standard deviations.
+func (d *AnomalyDetector) IsAnomaly(count int) bool {
+	if d.Baseline.Count() < d.WarmupIntervals || d.Baseline.Count() < 1 {
+		return false
+	}
+	return d.deviates(count, d.Sensitivity)
+}
+
+// IsRecovered tells if the count is back within RecoverySensitivity standard deviations of the baseline.
+func (d *AnomalyDetector) IsRecovered(count int) bool {
+	if d.Baseline.Count() < 1 {
+		return true
+	}
+	return !d.deviates(count, d.RecoverySensitivity)
+}
+
+func (d *AnomalyDetector) deviates(count int, sensitivity float64) bool {
+	center := d.Baseline.Center()
+	d.Score = (float64(count) - center) / math.Max(d.Baseline.Deviation(), minAnomalyDeviation)
+
+	switch {
+	case d.Score >= sensitivity && d.Direction != AnomalyDown:
+		return count >= d.MinCount
+	case d.Score <= -sensitivity && d.Direction != AnomalyUp:
+		return center >= float64(d.MinCount)
+	}
+	return false
+}
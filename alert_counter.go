@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  R O L L I N G  C O U N T
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultAlertResolution is the width of the buckets of the rolling count, when none is configured.
+const DefaultAlertResolution = time.Second
+
+// RollingCounter is the rolling count of an alert type: the number of logs whose timestamp is at most Duration before
+// the latest one. Logs are counted in a ring of buckets, each Resolution wide, so it takes the same memory and time
+// however many logs come in. Timestamps are rounded down to the Resolution, so the count is exact as long as the
+// Resolution is no finer than the timestamps e.g. a second for unix timestamps.
+type RollingCounter struct {
+	Duration       time.Duration
+	Resolution     time.Duration
+	Count          int       // logs within the duration
+	NumeratorCount int       // logs within the duration that match the numerator of a ratio alert
+	Latest         time.Time // timestamp of the latest log
+
+	buckets     []rollingCounterBucket // ring, with the bucket of each index at index modulo its length
+	latestIndex int64                  // index of the bucket of the latest log
+}
+
+type rollingCounterBucket struct {
+	Count          int
+	NumeratorCount int
+}
+
+// NewRollingCounter creates a rolling count over the duration, which should be a multiple of the resolution.
+func NewRollingCounter(duration, resolution time.Duration) (*RollingCounter, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("resolution should be more than 0")
+	}
+	if duration < 0 || duration%resolution != 0 {
+		return nil, fmt.Errorf("duration should be a multiple of the resolution (%s)", resolution)
+	}
+	return &RollingCounter{
+		Duration:   duration,
+		Resolution: resolution,
+		buckets:    make([]rollingCounterBucket, duration/resolution+1),
+	}, nil
+}
+
+// Add counts a log with the given timestamp, and drops the logs that are no longer within the duration of the latest
+// one. A log that is already out of the duration is not counted.
+func (r *RollingCounter) Add(t time.Time, inNumerator bool) {
+	i := r.index(t)
+	if r.Latest.IsZero() {
+		r.Latest = t
+		r.latestIndex = i
+	}
+	if t.After(r.Latest) {
+		r.advance(i)
+		r.Latest = t
+	}
+	if i <= r.latestIndex-int64(len(r.buckets)) {
+		return
+	}
+
+	b := &r.buckets[r.slot(i)]
+	b.Count++
+	r.Count++
+	if inNumerator {
+		b.NumeratorCount++
+		r.NumeratorCount++
+	}
+}
+
+// AdvanceTo drops the logs that are no longer within the duration of the given time, as if a log had come in at that
+// time without being counted, e.g. when the logs stop coming in. Latest is still the timestamp of the latest log.
+func (r *RollingCounter) AdvanceTo(t time.Time) {
+	if r.Latest.IsZero() || !t.After(r.Latest) {
+		return
+	}
+	r.advance(r.index(t))
+}
+
+// advance moves the latest bucket forward to the given index, emptying the buckets in between, which held logs that
+// are no longer within the duration.
+func (r *RollingCounter) advance(i int64) {
+	from := r.latestIndex + 1
+	if n := int64(len(r.buckets)); i-from >= n {
+		from = i - n + 1
+	}
+	for j := from; j <= i; j++ {
+		b := &r.buckets[r.slot(j)]
+		r.Count -= b.Count
+		r.NumeratorCount -= b.NumeratorCount
+		*b = rollingCounterBucket{}
+	}
+	if i > r.latestIndex {
+		r.latestIndex = i
+	}
+}
+
+// index returns the index of the bucket of the timestamp, counted in resolutions since the epoch.
+func (r *RollingCounter) index(t time.Time) int64 {
+	ns := t.UnixNano()
+	i := ns / int64(r.Resolution)
+	if ns%int64(r.Resolution) < 0 {
+		i-- // round down, before the epoch
+	}
+	return i
+}
+
+func (r *RollingCounter) slot(i int64) int {
+	n := int64(len(r.buckets))
+	return int(((i % n) + n) % n)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  D I S P A T C H
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertDispatcher is between the alert types and the notifiers. The alerts that each notifier is sent are grouped by
+// their GroupBy labels, so alerts that fire together e.g. as a backend died are sent in one notification: a new group
+// waits GroupWait for more alerts before it's sent, and GroupInterval between its next notifications. Only the alerts
+// that changed since they were last sent are sent again, and the ones still firing every RepeatInterval. Alerts that
+// an inhibit rule matches are not sent, while they are muted.
+type AlertDispatcher struct {
+	GroupBy        []string
+	GroupWait      time.Duration
+	GroupInterval  time.Duration
+	RepeatInterval time.Duration
+	InhibitRules   []AlertInhibitRule
+
+	firing map[string]Alert               // the firing alerts of all the alert types by ID, for the inhibit rules
+	groups map[string]*alertDispatchGroup // by notifier and group key
+	closed bool
+	lock   sync.Mutex
+}
+
+// alertDispatchGroup is a group of the alerts that a notifier is sent.
+type alertDispatchGroup struct {
+	Key    string
+	Labels map[string]string
+	Queue  *NotifierQueue
+
+	alerts   map[string]AlertEvent // the latest event of each alert by ID
+	sent     map[string]AlertState // the state each alert was last sent in
+	created  time.Time
+	flushed  time.Time // when it was last flushed, zero until the first time
+	notified time.Time // when it was last sent
+	timer    *time.Timer
+	flushAt  time.Time
+}
+
+func NewAlertDispatcherFromConfig(req config.ConfigAlertRouting) (*AlertDispatcher, error) {
+	if req.GroupWaitSeconds < 0 || req.GroupIntervalSeconds < 0 || req.RepeatIntervalSeconds < 0 {
+		return nil, fmt.Errorf("group wait, group interval and repeat interval cannot be negative")
+	}
+	var d = AlertDispatcher{
+		GroupBy:        req.GroupBy,
+		GroupWait:      time.Duration(req.GroupWaitSeconds * int64(time.Second)),
+		GroupInterval:  time.Duration(req.GroupIntervalSeconds * int64(time.Second)),
+		RepeatInterval: time.Duration(req.RepeatIntervalSeconds * int64(time.Second)),
+		firing:         make(map[string]Alert),
+		groups:         make(map[string]*alertDispatchGroup),
+	}
+	for i, r := range req.InhibitRules {
+		rule, err := NewAlertInhibitRuleFromConfig(r)
+		if err != nil {
+			return nil, fmt.Errorf("inhibit rule %d: %w", i+1, err)
+		}
+		d.InhibitRules = append(d.InhibitRules, rule)
+	}
+	return &d, nil
+}
+
+// Track keeps track of the firing alerts, for the inhibit rules. It's an AlertEventHandler, for every alert type whether
+// it has notifiers or not, so any alert can mute the others.
+func (d *AlertDispatcher) Track(e AlertEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return
+	}
+
+	_, wasFiring := d.firing[e.Alert.ID]
+	if e.Alert.State == AlertStateFiring {
+		d.firing[e.Alert.ID] = e.Alert
+		return
+	}
+	delete(d.firing, e.Alert.ID)
+	if wasFiring && d.isInhibiting(e.Alert) {
+		// The alerts it muted may be sent now
+		now := time.Now()
+		for _, g := range d.groups {
+			if g.hasUnsentFiring() {
+				d.schedule(g, d.nextFlush(g, now), now)
+			}
+		}
+	}
+}
+
+// Handler returns the AlertEventHandler that sends the events of an alert type to the notifier.
+func (d *AlertDispatcher) Handler(q *NotifierQueue) AlertEventHandler {
+	return func(e AlertEvent) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.closed {
+			return
+		}
+		now := time.Now()
+		g := d.getGroup(q, e.Alert, now)
+		g.alerts[e.Alert.ID] = e
+		d.schedule(g, d.nextFlush(g, now), now)
+	}
+}
+
+// Close sends the alerts of every group that are waiting to be sent. No events should be handled after that.
+func (d *AlertDispatcher) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closed = true
+	now := time.Now()
+	for _, g := range d.sortedGroups() {
+		if g.timer != nil {
+			g.timer.Stop()
+			g.timer = nil
+		}
+		d.flush(g, now)
+	}
+}
+
+// getGroupKey returns the key of the group of the alert, and its group labels. Without group by labels, each alert is
+// a group of its own.
+func (d *AlertDispatcher) getGroupKey(a Alert) (string, map[string]string) {
+	if len(d.GroupBy) == 0 {
+		return a.ID, a.Labels
+	}
+	var labels = make(map[string]string, len(d.GroupBy))
+	var pairs []string
+	for _, l := range d.GroupBy {
+		labels[l] = a.Labels[l]
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l, a.Labels[l]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}", labels
+}
+
+func (d *AlertDispatcher) getGroup(q *NotifierQueue, a Alert, now time.Time) *alertDispatchGroup {
+	key, labels := d.getGroupKey(a)
+	id := q.Name + statsGroupSeparator + key
+	g, exists := d.groups[id]
+	if !exists {
+		g = &alertDispatchGroup{
+			Key:     key,
+			Labels:  labels,
+			Queue:   q,
+			alerts:  make(map[string]AlertEvent),
+			sent:    make(map[string]AlertState),
+			created: now,
+		}
+		d.groups[id] = g
+	}
+	return g
+}
+
+func (d *AlertDispatcher) sortedGroups() []*alertDispatchGroup {
+	var ids []string
+	for id := range d.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var groups = make([]*alertDispatchGroup, len(ids))
+	for i, id := range ids {
+		groups[i] = d.groups[id]
+	}
+	return groups
+}
+
+// nextFlush is when the group should be flushed next, for the alerts that changed: after the group wait for a new
+// group, and after the group interval since it was last flushed for the others.
+func (d *AlertDispatcher) nextFlush(g *alertDispatchGroup, now time.Time) time.Time {
+	at := g.created.Add(d.GroupWait)
+	if !g.flushed.IsZero() {
+		at = g.flushed.Add(d.GroupInterval)
+	}
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// schedule has the group flushed at the given time, unless it's already going to be flushed before that. It's flushed
+// right away if that's now.
+func (d *AlertDispatcher) schedule(g *alertDispatchGroup, at, now time.Time) {
+	if d.closed {
+		return
+	}
+	if g.timer != nil {
+		if !g.flushAt.After(at) {
+			return
+		}
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if !at.After(now) {
+		d.flush(g, now)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(at.Sub(now), func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.closed || g.timer != timer {
+			return // stopped, or replaced
+		}
+		g.timer = nil
+		d.flush(g, time.Now())
+	})
+	g.timer, g.flushAt = timer, at
+}
+
+// flush sends the alerts of the group that should be sent, and forgets the ones that are over.
+func (d *AlertDispatcher) flush(g *alertDispatchGroup, now time.Time) {
+	g.flushed = now
+	repeat := d.RepeatInterval > 0 && !g.notified.IsZero() && now.Sub(g.notified) >= d.RepeatInterval
+
+	var ids []string
+	for id := range g.alerts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := g.alerts[ids[i]].Alert, g.alerts[ids[j]].Alert
+		if !a.ActiveAt.Equal(b.ActiveAt) {
+			return a.ActiveAt.Before(b.ActiveAt)
+		}
+		return a.ID < b.ID
+	})
+
+	var events []AlertEvent
+	for _, id := range ids {
+		e := g.alerts[id]
+		sent := g.sent[id]
+		send := g.Queue.ShouldNotify(e)
+		if e.Alert.State == AlertStateResolved {
+			send = send && sent != "" // there is nothing to resolve for alerts that were never sent
+		} else {
+			send = send && (sent != e.Alert.State || (repeat && e.Alert.State == AlertStateFiring))
+			if send && d.isInhibited(e.Alert) {
+				clog.Debugf("[Dispatch] %s alert '%s' (%s) is inhibited", e.Alert.State, e.Alert.Name, e.Alert.ID)
+				send = false
+			}
+		}
+		if send {
+			events = append(events, e)
+			g.sent[id] = e.Alert.State
+		}
+		// Resolved alerts are over, unless they are flapping: they are sent again once they stop
+		if e.Alert.State == AlertStateResolved && !e.Alert.Flapping {
+			delete(g.alerts, id)
+			delete(g.sent, id)
+		}
+	}
+
+	if len(events) > 0 {
+		clog.Debugf("[Dispatch] Sending %d alerts of group %s to notifier %s", len(events), g.Key, g.Queue.Name)
+		g.Queue.Handle(Notification{Notifier: g.Queue.Name, GroupKey: g.Key, GroupLabels: g.Labels, Events: events})
+		g.notified = now
+	}
+
+	if len(g.alerts) == 0 {
+		for id, group := range d.groups {
+			if group == g {
+				delete(d.groups, id)
+			}
+		}
+		return
+	}
+	if d.RepeatInterval > 0 && g.hasSentFiring() {
+		at := g.notified.Add(d.RepeatInterval)
+		if !at.After(now) {
+			at = now.Add(d.RepeatInterval) // nothing was sent e.g. as the alerts are inhibited
+		}
+		d.schedule(g, at, now)
+	}
+}
+
+// hasSentFiring tells if the group has firing alerts that were sent, which are sent again every repeat interval.
+func (g *alertDispatchGroup) hasSentFiring() bool {
+	for id, e := range g.alerts {
+		if e.Alert.State == AlertStateFiring && g.sent[id] == AlertStateFiring {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUnsentFiring tells if the group has firing alerts that were not sent, e.g. as they were inhibited.
+func (g *alertDispatchGroup) hasUnsentFiring() bool {
+	for id, e := range g.alerts {
+		if e.Alert.State == AlertStateFiring && g.sent[id] != AlertStateFiring {
+			return true
+		}
+	}
+	return false
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  D I S P A T C H  -  I N H I B I T I O N
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertInhibitRule mutes the alerts that match TargetMatch while an alert that matches SourceMatch is firing, if both
+// have the same values for the Equal labels e.g. "Source silent" mutes "Traffic low" for the same source.
+type AlertInhibitRule struct {
+	SourceMatch map[string]string
+	TargetMatch map[string]string
+	Equal       []string
+}
+
+func NewAlertInhibitRuleFromConfig(req config.ConfigInhibitRule) (AlertInhibitRule, error) {
+	if len(req.SourceMatch) == 0 || len(req.TargetMatch) == 0 {
+		return AlertInhibitRule{}, fmt.Errorf("inhibit rules need a source match and a target match")
+	}
+	return AlertInhibitRule{SourceMatch: req.SourceMatch, TargetMatch: req.TargetMatch, Equal: req.Equal}, nil
+}
+
+// Inhibits tells if the source alert mutes the target alert, when it's firing.
+func (r AlertInhibitRule) Inhibits(source, target Alert) bool {
+	if source.ID == target.ID {
+		return false
+	}
+	if !matchAlertLabels(source.Labels, r.SourceMatch) || !matchAlertLabels(target.Labels, r.TargetMatch) {
+		return false
+	}
+	for _, l := range r.Equal {
+		if source.Labels[l] != target.Labels[l] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAlertLabels(labels, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isInhibited tells if a firing alert mutes the alert.
+func (d *AlertDispatcher) isInhibited(a Alert) bool {
+	for _, r := range d.InhibitRules {
+		for _, source := range d.firing {
+			if r.Inhibits(source, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isInhibiting tells if the alert can mute others, when it's firing.
+func (d *AlertDispatcher) isInhibiting(a Alert) bool {
+	for _, r := range d.InhibitRules {
+		if matchAlertLabels(a.Labels, r.SourceMatch) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"text/template"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  E V E N T S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertSeverity tells how urgent the alerts of an alert type are.
+type AlertSeverity string
+
+const (
+	AlertSeverityInfo     AlertSeverity = "info"
+	AlertSeverityWarning  AlertSeverity = "warning"
+	AlertSeverityCritical AlertSeverity = "critical"
+)
+
+// AlertNameLabel is the label that every alert has, with the name of its alert type.
+const AlertNameLabel = "alertname"
+
+// ParseAlertSeverity parses the severity from the config. Empty means warning.
+func ParseAlertSeverity(str string) (AlertSeverity, error) {
+	switch AlertSeverity(str) {
+	case "", AlertSeverityWarning:
+		return AlertSeverityWarning, nil
+	case AlertSeverityInfo, AlertSeverityCritical:
+		return AlertSeverity(str), nil
+	}
+	return "", fmt.Errorf("severity '%s' not recognized", str)
+}
+
+// AlertEvent is a transition of an alert from one state to another, for notifiers.
+type AlertEvent struct {
+	Alert    Alert // as of the transition
+	Previous AlertState
+	Time     time.Time
+}
+
+// AlertEventHandler handles the events of an alert type. It's called while the alert type is locked, so it should
+// not block e.g. by queueing the event.
+type AlertEventHandler func(e AlertEvent)
+
+// AddEventHandler has the events of the alert type sent to the handler, from now on.
+func (c *AlertType) AddEventHandler(h AlertEventHandler) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.eventHandlers = append(c.eventHandlers, h)
+}
+
+// setEventsFromConfig sets up what the alerts of the alert type carry: their severity, labels and annotations.
+func (c *AlertType) setEventsFromConfig(req config.ConfigAlertType) error {
+	var err error
+	c.Severity, err = ParseAlertSeverity(req.Severity)
+	if err != nil {
+		return err
+	}
+
+	c.Labels = map[string]string{AlertNameLabel: req.Name}
+	for k, v := range req.Labels {
+		if k == AlertNameLabel {
+			return fmt.Errorf("label '%s' is set from the name", k)
+		}
+		c.Labels[k] = v
+	}
+	for _, e := range c.GroupBy {
+		if _, exists := c.Labels[e.String()]; exists {
+			return fmt.Errorf("label '%s' is also a group by", e.String())
+		}
+	}
+
+	c.Annotations = make(map[string]*template.Template)
+	for k, str := range req.Annotations {
+		tmpl, err := template.New(k).Option("missingkey=zero").Parse(str)
+		if err != nil {
+			return fmt.Errorf("annotation '%s': %w", k, err)
+		}
+		c.Annotations[k] = tmpl
+	}
+	return nil
+}
+
+// newAlert starts an alert for the group, which is pending from the given time.
+func (c *AlertType) newAlert(g *AlertGroup, t time.Time) *Alert {
+	var labels = make(map[string]string, len(c.Labels)+len(g.Values))
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	for i, v := range g.Values {
+		labels[c.GroupBy[i].String()] = v
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s%s%s%s%d", c.Name, statsGroupSeparator, g.Key, statsGroupSeparator, t.UnixNano())
+
+	a := Alert{
+		ID:       fmt.Sprintf("%016x", h.Sum64()),
+		Name:     c.Name,
+		State:    AlertStatePending,
+		Severity: c.Severity,
+		Labels:   labels,
+		ActiveAt: t,
+	}
+	value := c.value(g, t)
+	a.Value, a.PeakValue = value, value
+	return &a
+}
+
+// value is what the condition of the alert type looks at: the rolling count, the ratio, or for absence alerts, the
+// seconds since the latest log.
+func (c *AlertType) value(g *AlertGroup, t time.Time) float64 {
+	switch c.Kind {
+	case AlertKindRatio:
+		return g.Ratio.Get(g.CurrentMovingCount)
+	case AlertKindAbsence:
+		return t.Sub(g.Absence.LastSeen).Seconds()
+	}
+	return float64(g.CurrentMovingCount)
+}
+
+// observeValue updates the value of the current alert of the group, and its peak: the highest value, or the lowest
+// for anomaly alerts on drops.
+func (c *AlertType) observeValue(g *AlertGroup, t time.Time) {
+	a := g.Current
+	a.Value = c.value(g, t)
+	if c.Kind == AlertKindAnomaly && g.Anomaly.Direction == AnomalyDown {
+		if a.Value < a.PeakValue {
+			a.PeakValue = a.Value
+		}
+		return
+	}
+	if a.Value > a.PeakValue {
+		a.PeakValue = a.Value
+	}
+}
+
+// emit renders the annotations of the current alert of the group, and sends its transition to the event handlers.
+func (c *AlertType) emit(g *AlertGroup, previous AlertState, t time.Time) {
+	c.emitAlert(g, g.Current, previous, t)
+}
+
+// emitAlert is emit for any alert of the group, e.g. one that is already resolved.
+func (c *AlertType) emitAlert(g *AlertGroup, a *Alert, previous AlertState, t time.Time) {
+	a.Flapping = g.Flap != nil && g.Flap.Flapping
+
+	var annotations = make(map[string]string, len(c.Annotations))
+	for k, tmpl := range c.Annotations {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, a); err != nil {
+			clog.Warnf("[%s] Could not render annotation '%s': %s", c.Name, k, err)
+			continue
+		}
+		annotations[k] = buf.String()
+	}
+	a.Annotations = annotations
+
+	e := AlertEvent{Alert: *a, Previous: previous, Time: t}
+	for _, h := range c.eventHandlers {
+		h(e)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  G R O U P  B Y
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultAlertMaxGroups is the most groups an alert type with a group by keeps track of, when none is configured.
+const DefaultAlertMaxGroups = 10000
+
+// defaultAlertGroupIdleDurations is how many durations of the alert type a group can go without logs, before it's no
+// longer kept track of, when no idle time is configured.
+const defaultAlertGroupIdleDurations = 10
+
+// AlertGroup is the rolling count and state of the alerts of an alert type, for one group of its logs e.g. the logs of
+// one remotehost. An alert type without a group by has a single group, for all its logs.
+type AlertGroup struct {
+	Key     string
+	Values  []string         // the values of the group by expressions, nil for the single group
+	Anomaly *AnomalyDetector // only set for AlertKindAnomaly
+	Ratio   *AlertRatio      // only set for AlertKindRatio
+	Absence *AlertAbsence    // only set for AlertKindAbsence
+	Flap    *AlertFlapDetector
+	Counter *RollingCounter // not set for AlertKindAbsence
+
+	CurrentMovingCount int
+	AlertOngoing       bool
+	Alerts             []*Alert // that fired
+	Current            *Alert   // the pending or firing alert, if any
+	State              AlertState
+	PendingSince       time.Time
+}
+
+// setGroupsFromConfig sets up the group by of the alert type, if any.
+func (c *AlertType) setGroupsFromConfig(req config.ConfigAlertType) error {
+	if len(req.GroupBy) == 0 {
+		if req.MaxGroups != 0 || req.GroupIdleSeconds != 0 {
+			return fmt.Errorf("max groups and group idle time need a group by")
+		}
+		return nil
+	}
+	var err error
+	c.GroupBy, err = ParseStatsGroupBy(req.GroupBy)
+	if err != nil {
+		return err
+	}
+	if req.MaxGroups < 0 || req.GroupIdleSeconds < 0 {
+		return fmt.Errorf("max groups and group idle time cannot be negative")
+	}
+	c.MaxGroups = DefaultAlertMaxGroups
+	if req.MaxGroups > 0 {
+		c.MaxGroups = req.MaxGroups
+	}
+	c.GroupIdle = defaultAlertGroupIdleDurations * c.Duration
+	if req.GroupIdleSeconds > 0 {
+		c.GroupIdle = time.Duration(req.GroupIdleSeconds * int64(time.Second))
+	}
+	c.Groups = make(map[string]*AlertGroup)
+	return nil
+}
+
+// newGroup sets up the rolling count and state for a group with the given values.
+func (c *AlertType) newGroup(values []string) (*AlertGroup, error) {
+	var g = AlertGroup{
+		Key:    strings.Join(values, statsGroupSeparator),
+		Values: values,
+		State:  AlertStateInactive,
+	}
+	var err error
+	switch c.Kind {
+	case AlertKindAnomaly:
+		g.Anomaly, err = NewAnomalyDetectorFromConfig(c.groupConfig)
+	case AlertKindRatio:
+		g.Ratio, err = NewAlertRatioFromConfig(c.groupConfig)
+	case AlertKindAbsence:
+		g.Absence = &AlertAbsence{Timeout: c.Duration}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.Absence == nil {
+		g.Counter, err = NewRollingCounter(c.Duration, c.Resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.Flap, err = NewAlertFlapDetectorFromConfig(c.groupConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// getGroup returns the group that the log is counted in, and sets it up if it's new. If all MaxGroups groups are
+// pending or firing, there is no room for a new one, and nil is returned.
+func (c *AlertType) getGroup(msg LogMessageStructured) (*AlertGroup, error) {
+	if c.Groups == nil {
+		return &c.AlertGroup, nil
+	}
+	values, err := getGroupValues(c.GroupBy, msg)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.Join(values, statsGroupSeparator)
+	if g, exists := c.Groups[key]; exists {
+		return g, nil
+	}
+	if len(c.Groups) >= c.MaxGroups && !c.evictLeastRecentGroup() {
+		return nil, nil
+	}
+	g, err := c.newGroup(values)
+	if err != nil {
+		return nil, err
+	}
+	c.Groups[key] = g
+	return g, nil
+}
+
+// groups returns all the groups of the alert type, ordered by key.
+func (c *AlertType) groups() []*AlertGroup {
+	if c.Groups == nil {
+		return []*AlertGroup{&c.AlertGroup}
+	}
+	var keys = make([]string, 0, len(c.Groups))
+	for k := range c.Groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var groups = make([]*AlertGroup, len(keys))
+	for i, k := range keys {
+		groups[i] = c.Groups[k]
+	}
+	return groups
+}
+
+// groupName is how the group is called in notifications e.g. 'High traffic (remotehost=10.0.0.1)'.
+func (c *AlertType) groupName(g *AlertGroup) string {
+	if len(g.Values) == 0 {
+		return c.Name
+	}
+	var labels = make([]string, len(g.Values))
+	for i, v := range g.Values {
+		labels[i] = c.GroupBy[i].String() + "=" + v
+	}
+	return fmt.Sprintf("%s (%s)", c.Name, strings.Join(labels, ", "))
+}
+
+// lastSeen returns when the latest log of the group was read: its timestamp, or for absence alerts, when it came in.
+func (g *AlertGroup) lastSeen() time.Time {
+	if g.Absence != nil {
+		return g.Absence.LastSeen
+	}
+	return g.Counter.Latest
+}
+
+// evictLeastRecentGroup makes room for a new group, by no longer keeping track of the inactive group that has gone
+// the longest without logs. It returns false if all the groups are pending or firing.
+func (c *AlertType) evictLeastRecentGroup() bool {
+	var oldest *AlertGroup
+	for _, g := range c.Groups {
+		if g.State != AlertStateInactive {
+			continue
+		}
+		if oldest == nil || g.lastSeen().Before(oldest.lastSeen()) || (g.lastSeen().Equal(oldest.lastSeen()) && g.Key < oldest.Key) {
+			oldest = g
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	clog.Debugf("[%s] Evicting group '%s' to make room for a new one", c.Name, c.groupName(oldest))
+	delete(c.Groups, oldest.Key)
+	c.EvictedGroups++
+	return true
+}
+
+// evictIdleGroups stops keeping track of the groups without logs for GroupIdle, resolving their ongoing alerts. Idle
+// time is in wall-clock time for absence alerts, and in the time of the latest log for the others.
+func (c *AlertType) evictIdleGroups(now time.Time) {
+	if c.Kind != AlertKindAbsence {
+		now = c.latestLogTime
+	}
+	for _, g := range c.groups() {
+		if now.Sub(g.lastSeen()) <= c.GroupIdle {
+			continue
+		}
+		c.resolveGroup(g, now, "as its group is idle")
+		delete(c.Groups, g.Key)
+		c.EvictedGroups++
+	}
+}
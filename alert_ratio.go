@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  R A T I O
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertRatio is the condition of ratio alerts e.g. the error rate: the share of the logs in the rolling count (the
+// denominator) that also match the Numerator filter.
+type AlertRatio struct {
+	Numerator         *FilterExpr
+	Threshold         float64 // the alert fires once the ratio reaches this e.g. 0.05 for 5%
+	RecoveryThreshold float64 // the alert resolves once the ratio is below this, defaults to the Threshold
+	MinDenominator    int     // ratios over fewer logs than this never alert, so low traffic does not cause false alarms
+
+	NumeratorCount int // logs in the rolling count that match the numerator
+}
+
+func NewAlertRatioFromConfig(req config.ConfigAlertType) (*AlertRatio, error) {
+	var r = AlertRatio{
+		Threshold:      float64(req.RatioThreshold),
+		MinDenominator: req.MinCount,
+	}
+	var err error
+	r.Numerator, err = CompileFilter(req.Numerator)
+	if err != nil {
+		return nil, fmt.Errorf("numerator: %w", err)
+	}
+	if r.Numerator == nil {
+		return nil, fmt.Errorf("ratio alerts need a numerator")
+	}
+	if r.Threshold <= 0 || r.Threshold > 1 {
+		return nil, fmt.Errorf("ratio threshold should be more than 0, and at most 1")
+	}
+	r.RecoveryThreshold = r.Threshold
+	if recovery := float64(req.RecoveryRatio); recovery != 0 {
+		if recovery < 0 || recovery > r.Threshold {
+			return nil, fmt.Errorf("recovery ratio should be more than 0, and at most the ratio threshold")
+		}
+		r.RecoveryThreshold = recovery
+	}
+	return &r, nil
+}
+
+// Get returns the ratio for the given denominator.
+func (r *AlertRatio) Get(denominator int) float64 {
+	if denominator < 1 {
+		return 0
+	}
+	return float64(r.NumeratorCount) / float64(denominator)
+}
+
+// IsAlert tells if the ratio for the given denominator signals a state of alert.
+func (r *AlertRatio) IsAlert(denominator int) bool {
+	return r.exceeds(denominator, r.Threshold)
+}
+
+// IsRecovered tells if the ratio for the given denominator is back below the RecoveryThreshold, or is over too few
+// logs to tell.
+func (r *AlertRatio) IsRecovered(denominator int) bool {
+	return !r.exceeds(denominator, r.RecoveryThreshold)
+}
+
+func (r *AlertRatio) exceeds(denominator int, threshold float64) bool {
+	return denominator >= r.MinDenominator && denominator > 0 && r.Get(denominator) >= threshold
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  A L E R T  -  S T A T E
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// AlertState is where an alert type is between its condition and its notifications.
+type AlertState string
+
+const (
+	// AlertStateInactive means the condition does not hold.
+	AlertStateInactive AlertState = "inactive"
+	// AlertStatePending means the condition holds, but not yet for long enough (AlertType.For) to fire.
+	AlertStatePending AlertState = "pending"
+	// AlertStateFiring means an alert was triggered, and has not recovered yet.
+	AlertStateFiring AlertState = "firing"
+	// AlertStateResolved is the state of an alert that is over, whether it fired or not. Alert types go back to
+	// inactive.
+	AlertStateResolved AlertState = "resolved"
+)
+
+// DefaultFlapThreshold is the number of times an alert can fire or resolve within the flap window before it's flapping,
+// when none is configured.
+const DefaultFlapThreshold = 6
+
+// setStateFromConfig sets up how the alert type moves between states: how long the condition needs to hold before it
+// fires, and how long it fires at least. The recovery thresholds of the other kinds are set up by each kind, and flap
+// detection by each group.
+func (c *AlertType) setStateFromConfig(req config.ConfigAlertType) error {
+	c.RecoveryThreshold = c.Threshold
+	if req.RecoveryThreshold != 0 {
+		if c.Kind != AlertKindThreshold {
+			return fmt.Errorf("recovery_threshold is only for threshold alerts")
+		}
+		if req.RecoveryThreshold < 0 || req.RecoveryThreshold > c.Threshold {
+			return fmt.Errorf("recovery threshold should be more than 0, and at most the threshold")
+		}
+		c.RecoveryThreshold = req.RecoveryThreshold
+	}
+
+	if req.ForSeconds < 0 || req.MinFiringSeconds < 0 || req.FlapWindowSeconds < 0 {
+		return fmt.Errorf("for, min firing and flap window durations cannot be negative")
+	}
+	c.For = time.Duration(req.ForSeconds * int64(time.Second))
+	c.MinFiring = time.Duration(req.MinFiringSeconds * int64(time.Second))
+	return nil
+}
+
+// evaluate moves the alert type between states, based on its condition at the given time. An inactive alert type
+// becomes pending when its condition holds, and fires once it has held for For. A firing alert type resolves once its
+// recovery condition holds, but not before it has fired for MinFiring.
+func (c *AlertType) evaluate(g *AlertGroup, t time.Time) {
+	switch g.State {
+	case AlertStateFiring:
+		c.observeValue(g, t)
+		if c.isRecoveredCondition(g, t) && t.Sub(g.Current.Start) >= c.MinFiring {
+			c.closeAlert(g, t)
+		}
+	default:
+		if !c.isAlertCondition(g, t) {
+			if g.State == AlertStatePending {
+				clog.Infof("%s alert is no longer pending at %s", c.groupName(g), t)
+				c.endAlert(g, AlertStatePending, t)
+			}
+			g.State = AlertStateInactive
+			break
+		}
+		if g.State == AlertStateInactive {
+			g.State = AlertStatePending
+			g.PendingSince = t
+			g.Current = c.newAlert(g, t)
+			if c.For > 0 {
+				clog.Infof("%s alert is pending at %s, and fires if it still is in %s", c.groupName(g), t, c.For)
+				c.emit(g, AlertStateInactive, t)
+			}
+		}
+		c.observeValue(g, t)
+		if t.Sub(g.PendingSince) >= c.For {
+			c.triggerAlert(g, t)
+		}
+	}
+	c.updateFlapping(g, t)
+}
+
+// updateFlapping lets the flap detector know about the time, and notifies when the alert starts or stops flapping. As
+// notifiers skip the events of flapping alerts, the latest alert is emitted again once it stops, so they catch up.
+func (c *AlertType) updateFlapping(g *AlertGroup, t time.Time) {
+	if g.Flap == nil || !g.Flap.Update(t) {
+		return
+	}
+	if g.Flap.Flapping {
+		clog.Noticef("%s alert is flapping - fired or resolved %d times within %s, notifications are paused at %s", c.groupName(g), len(g.Flap.transitions), g.Flap.Window, t)
+		return
+	}
+	clog.Noticef("%s alert stopped flapping, and is %s at %s", c.groupName(g), g.State, t)
+	if g.Current != nil {
+		c.emitAlert(g, g.Current, g.Current.State, t)
+	} else if len(g.Alerts) > 0 {
+		latest := g.Alerts[len(g.Alerts)-1]
+		c.emitAlert(g, latest, latest.State, t)
+	}
+}
+
+// AlertFlapDetector tells when an alert fires and resolves too often for each of them to be worth a notification: it's
+// flapping once it has fired or resolved Threshold times within the latest Window, and stops when that's down to half.
+type AlertFlapDetector struct {
+	Window    time.Duration
+	Threshold int
+	Flapping  bool
+
+	transitions []time.Time // when the alert fired or resolved, oldest first
+}
+
+func NewAlertFlapDetectorFromConfig(req config.ConfigAlertType) (*AlertFlapDetector, error) {
+	if req.FlapWindowSeconds == 0 {
+		if req.FlapThreshold != 0 {
+			return nil, fmt.Errorf("flap threshold needs a flap window")
+		}
+		return nil, nil
+	}
+	var f = AlertFlapDetector{
+		Window:    time.Duration(req.FlapWindowSeconds * int64(time.Second)),
+		Threshold: DefaultFlapThreshold,
+	}
+	if req.FlapThreshold != 0 {
+		if req.FlapThreshold < 2 {
+			return nil, fmt.Errorf("flap threshold should be at least 2")
+		}
+		f.Threshold = req.FlapThreshold
+	}
+	return &f, nil
+}
+
+// Add records that the alert fired or resolved at the given time.
+func (f *AlertFlapDetector) Add(t time.Time) {
+	f.transitions = append(f.transitions, t)
+}
+
+// Update forgets the transitions that are no longer within the window, and tells if the alert started or stopped
+// flapping.
+func (f *AlertFlapDetector) Update(now time.Time) bool {
+	var i int
+	for i < len(f.transitions) && now.Sub(f.transitions[i]) > f.Window {
+		i++
+	}
+	f.transitions = f.transitions[i:]
+
+	flapping := f.Flapping
+	if !flapping && len(f.transitions) >= f.Threshold {
+		flapping = true
+	}
+	if flapping && len(f.transitions) < (f.Threshold+1)/2 {
+		flapping = false
+	}
+	changed := flapping != f.Flapping
+	f.Flapping = flapping
+	return changed
+}
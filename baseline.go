@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  B A S E L I N E
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// BaselineKind determines how the normal value of a series is learned.
+type BaselineKind string
+
+const (
+	// BaselineEWMA learns an exponentially weighted moving mean and variance. It's cheap, and follows trends quickly.
+	BaselineEWMA BaselineKind = "ewma"
+	// BaselineMAD uses the median and the median absolute deviation of the latest values. It's not thrown off by
+	// the occasional outlier, at the cost of keeping the values.
+	BaselineMAD BaselineKind = "mad"
+)
+
+// DefaultBaselineWindows is the number of values a baseline mostly learns from when none is configured.
+const DefaultBaselineWindows = 20
+
+// madToStdDev scales the median absolute deviation to the standard deviation of normally distributed values.
+const madToStdDev = 1.4826
+
+// ParseBaselineKind parses the baseline from the config. Empty means EWMA.
+func ParseBaselineKind(str string) (BaselineKind, error) {
+	switch BaselineKind(str) {
+	case "", BaselineEWMA:
+		return BaselineEWMA, nil
+	case BaselineMAD:
+		return BaselineMAD, nil
+	}
+	return "", fmt.Errorf("baseline '%s' not recognized", str)
+}
+
+// Baseline learns the normal value of a series, and how much it usually deviates from it.
+type Baseline interface {
+	// Add learns a new value of the series.
+	Add(v float64)
+	// Center returns the normal value.
+	Center() float64
+	// Deviation returns how much the values usually deviate from the normal value, as a standard deviation.
+	Deviation() float64
+	// Count returns the number of values learned.
+	Count() int
+}
+
+// NewBaseline creates a baseline that mostly learns from the latest n values.
+func NewBaseline(kind BaselineKind, n int) Baseline {
+	if n < 1 {
+		n = DefaultBaselineWindows
+	}
+	if kind == BaselineMAD {
+		return &MADBaseline{Size: n}
+	}
+	return &EWMABaseline{Alpha: 2 / (float64(n) + 1)}
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  B A S E L I N E  -  E W M A
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// EWMABaseline is an exponentially weighted moving mean and variance: each value has Alpha times the weight of all the
+// values before it (https://fanf2.user.srcf.net/hermes/doc/antiforgery/stats.pdf).
+type EWMABaseline struct {
+	Alpha    float64
+	Mean     float64
+	Variance float64
+	N        int
+}
+
+func (b *EWMABaseline) Add(v float64) {
+	b.N++
+	if b.N == 1 {
+		b.Mean = v
+		return
+	}
+	diff := v - b.Mean
+	incr := b.Alpha * diff
+	b.Mean += incr
+	b.Variance = (1 - b.Alpha) * (b.Variance + diff*incr)
+}
+
+func (b *EWMABaseline) Center() float64 {
+	return b.Mean
+}
+
+func (b *EWMABaseline) Deviation() float64 {
+	return math.Sqrt(b.Variance)
+}
+
+func (b *EWMABaseline) Count() int {
+	return b.N
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  B A S E L I N E  -  M E D I A N  /  M A D
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// MADBaseline keeps the latest Size values, and uses their median as the normal value, and their median absolute
+// deviation (scaled to a standard deviation) as the usual deviation.
+type MADBaseline struct {
+	Size   int
+	values []float64 // ring of the latest values
+	next   int       // where the next value goes in the ring
+	N      int
+}
+
+func (b *MADBaseline) Add(v float64) {
+	b.N++
+	if len(b.values) < b.Size {
+		b.values = append(b.values, v)
+		return
+	}
+	b.values[b.next] = v
+	b.next = (b.next + 1) % b.Size
+}
+
+func (b *MADBaseline) Center() float64 {
+	return median(b.values)
+}
+
+func (b *MADBaseline) Deviation() float64 {
+	m := median(b.values)
+	var deviations = make([]float64, len(b.values))
+	for i, v := range b.values {
+		deviations[i] = math.Abs(v - m)
+	}
+	return median(deviations) * madToStdDev
+}
+
+func (b *MADBaseline) Count() int {
+	return b.N
+}
+
+// median returns the median of the values, without changing their order.
+func median(values []float64) float64 {
+	if len(values) < 1 {
+		return 0
+	}
+	var sorted = make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
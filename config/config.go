@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/teejays/clog"
@@ -10,15 +11,31 @@ import (
 
 // Config defines the structure of the configuration file for the application.
 type Config struct {
-	InQueueBufferSize     int               `toml:"queue_buffer_size"`
-	AppLogSupressionLevel int               `toml:"debug_level_not"`
-	LogSources            []ConfigLogSource `toml:"log_sources"`
-	Stats                 struct {
+	InQueueBufferSize      int               `toml:"queue_buffer_size"`
+	AppLogSupressionLevel  int               `toml:"debug_level_not"`
+	ShutdownTimeoutSeconds int64             `toml:"shutdown_timeout_seconds"`
+	LogSources             []ConfigLogSource `toml:"log_sources"`
+	Stats                  struct {
 		Types []ConfigStatsType
 	}
 	Alert struct {
 		Types []ConfigAlertType
 	}
+	Routing      ConfigRouting
+	DeadLetter   ConfigDeadLetter   `toml:"dead_letter"`
+	Notifiers    []ConfigNotifier   `toml:"notifiers"`
+	AlertRouting ConfigAlertRouting `toml:"alert_routing"`
+}
+
+// DefaultShutdownTimeout is used when the config does not specify how long we can take to shut down.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// GetShutdownTimeout returns how long the application may take to drain everything when shutting down.
+func (cfg Config) GetShutdownTimeout() time.Duration {
+	if cfg.ShutdownTimeoutSeconds <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
 }
 
 // ConfigLogSource is information from the config file regarding LogSources that the application need to use.
@@ -39,10 +56,37 @@ type ConfigLogSourceSettings struct {
 }
 
 type ConfigStatsType struct {
-	Name            string
-	DurationSeconds int64 `toml:"duration_seconds"`
-	Disabled        bool
-	SourceSettings  []ConfigStatsTypeSourceSetting `toml:"source_settings"`
+	Name                   string
+	DurationSeconds        int64 `toml:"duration_seconds"`
+	Disabled               bool
+	Window                 string // "tumbling" (default), "hopping" or "sliding"
+	AdvanceSeconds         int64  `toml:"advance_seconds"` // how often hopping and sliding windows are reported
+	AlignWindows           bool   `toml:"align_windows"`   // align windows to multiples of the advance since the epoch
+	Timezone               string // used to align windows, defaults to UTC
+	AllowedLatenessSeconds *int64 `toml:"allowed_lateness_seconds"` // defaults to 2 if not set
+	LatePolicy             string `toml:"late_policy"`
+	Clock                  string // what moves the windows along when no logs come in: "auto" (default), "event" or "processing"
+	Aggregations           []string
+	GroupBy                []string                       `toml:"group_by"`        // expressions whose combination of values logs are counted by, instead of the key
+	ReportFormat           string                         `toml:"report_format"`   // how groups are shown: "table" (default) or "tree"
+	TopN                   int                            `toml:"top_n"`           // defaults to 5, a negative value shows all values
+	BreakdownTopN          map[string]int                 `toml:"breakdown_top_n"` // per other key, defaults to top_n, a negative value shows all values
+	Counter                string                         // "exact" (default) or "space_saving"
+	CounterCapacity        int                            `toml:"counter_capacity"`  // values kept per counter, for space_saving
+	RetentionWindows       int                            `toml:"retention_windows"` // windows kept in memory, defaults to 100, a negative value keeps all
+	RetentionSeconds       int64                          `toml:"retention_seconds"` // how long windows are kept in memory, 0 for no limit
+	ArchivePath            string                         `toml:"archive_path"`      // file the evicted windows are appended to, as newline delimited JSON
+	Rollups                []ConfigStatsRollup            `toml:"rollups"`
+	ComparePrevious        bool                           `toml:"compare_previous"` // compare the counts to the previous window
+	CompareSeconds         []int64                        `toml:"compare_seconds"`  // also compare the counts to the windows this long before
+	SourceSettings         []ConfigStatsTypeSourceSetting `toml:"source_settings"`
+}
+
+type ConfigStatsRollup struct {
+	DurationSeconds  int64 `toml:"duration_seconds"`
+	RetentionWindows int   `toml:"retention_windows"` // windows kept in memory, defaults to 100, a negative value keeps all
+	RetentionSeconds int64 `toml:"retention_seconds"` // how long windows are kept in memory, 0 for no limit
+	ReportSeconds    int64 `toml:"report_seconds"`    // how often the window in progress is reported, defaults to once when it ends
 }
 
 type ConfigStatsTypeSourceSetting struct {
@@ -50,14 +94,51 @@ type ConfigStatsTypeSourceSetting struct {
 	Key                 string
 	ValueMutateFuncName string   `toml:"value_mutator_func"`
 	OtherKeys           []string `toml:"other_keys"`
+	Filter              string
 }
 
 type ConfigAlertType struct {
-	Name            string
-	DurationSeconds int64 `toml:"duration_seconds"`
-	Threshold       int
-	Disabled        bool
-	SourceSettings  []ConfigAlertTypeSourceSetting `toml:"source_settings"`
+	Name              string
+	Kind              string // "threshold" (default), "anomaly", "ratio" or "absence"
+	DurationSeconds   int64  `toml:"duration_seconds"`
+	ResolutionSeconds int64  `toml:"resolution_seconds"` // width of the buckets of the rolling count, defaults to 1
+	Threshold         int
+	Disabled          bool
+	SourceSettings    []ConfigAlertTypeSourceSetting `toml:"source_settings"`
+
+	// Anomaly alerts
+	Sensitivity     Float  // number of standard deviations from the baseline that is an anomaly, defaults to 3
+	Direction       string // "both" (default), "up" or "down"
+	Baseline        string // "ewma" (default) or "mad"
+	BaselineWindows int    `toml:"baseline_windows"` // number of durations the baseline mostly learns from, defaults to 20
+	WarmupWindows   int    `toml:"warmup_windows"`   // number of durations learned before alerting, defaults to baseline_windows
+	MinCount        int    `toml:"min_count"`        // counts (or baselines, for drops) below this never alert
+	Clock           string // what anomaly alerts are checked against when no logs come in: "auto" (default), "event" or "processing"
+
+	// Ratio alerts (min_count is the minimum denominator)
+	Numerator      string // filter expression for the logs of the rolling count that are counted in the ratio
+	RatioThreshold Float  `toml:"ratio_threshold"` // e.g. 0.05 to alert once 5% of the logs match the numerator
+
+	// Hysteresis and flapping
+	RecoveryThreshold   int   `toml:"recovery_threshold"`   // threshold alerts resolve below this, defaults to threshold
+	RecoveryRatio       Float `toml:"recovery_ratio"`       // ratio alerts resolve below this, defaults to ratio_threshold
+	RecoverySensitivity Float `toml:"recovery_sensitivity"` // anomaly alerts resolve below this, defaults to sensitivity
+	ForSeconds          int64 `toml:"for_seconds"`          // how long the condition needs to hold before the alert fires
+	MinFiringSeconds    int64 `toml:"min_firing_seconds"`   // how long an alert fires at least, even if it recovers sooner
+	FlapWindowSeconds   int64 `toml:"flap_window_seconds"`  // enables flap detection, over this duration
+	FlapThreshold       int   `toml:"flap_threshold"`       // times an alert fires or resolves within the window to be flapping, defaults to 6
+
+	// Severity, labels and annotations of the alerts
+	Severity    string            // "info", "warning" (default) or "critical"
+	Labels      map[string]string // on top of the group by values, and the alertname
+	Annotations map[string]string // text/template, rendered with the alert e.g. "{{.Labels.remotehost}} sent {{.Value}} requests"
+
+	Notifiers []string // names of the notifiers that the events of the alerts are sent to
+
+	// Group by
+	GroupBy          []string `toml:"group_by"`           // expressions (see stats), each group of logs has its own rolling count and alerts
+	MaxGroups        int      `toml:"max_groups"`         // the most groups kept track of at once, defaults to 10000
+	GroupIdleSeconds int64    `toml:"group_idle_seconds"` // groups without logs for this long are dropped, defaults to 10 durations
 }
 
 type ConfigAlertTypeSourceSetting struct {
@@ -65,6 +146,99 @@ type ConfigAlertTypeSourceSetting struct {
 	Key                 string
 	ValueMutateFuncName string `toml:"value_mutator_func"`
 	Values              []string
+	Filter              string
+}
+
+// ConfigRouting defines content based routing of log messages to consumers. If empty, logs are routed by source.
+type ConfigRouting struct {
+	DefaultConsumers []string `toml:"default_consumers"`
+	Routes           []ConfigRoute
+}
+
+type ConfigRoute struct {
+	Name      string
+	Sources   []string
+	Filter    string
+	Consumers []string
+	Continue  bool
+}
+
+// ConfigDeadLetter defines where log lines that cannot be processed are stored. If Path is empty, they are only logged.
+type ConfigDeadLetter struct {
+	Path         string
+	MaxSizeBytes int64 `toml:"max_size_bytes"`
+	MaxBackups   int   `toml:"max_backups"`
+}
+
+// ConfigNotifier defines where the events of alerts (pending, firing, resolved) are sent.
+type ConfigNotifier struct {
+	Name         string
+	Type         string // "webhook", "exec", "file" or "email"
+	Disabled     bool
+	SendPending  bool  `toml:"send_pending"`  // also send when alerts become pending, and when pending alerts are resolved
+	SendResolved *bool `toml:"send_resolved"` // send when firing alerts are resolved, defaults to true
+
+	// Webhook
+	URL                 string            `toml:"url"`
+	Format              string            // "json" (default) or "alertmanager"
+	Headers             map[string]string // e.g. Authorization
+	MaxRetries          *int              `toml:"max_retries"`           // on network errors, 429 and 5xx responses, defaults to 3
+	RetryBackoffSeconds int64             `toml:"retry_backoff_seconds"` // before the first retry, doubling after that, defaults to 1
+
+	// Exec
+	Command []string // the program and its arguments
+
+	// Webhook, exec and email
+	TimeoutSeconds int64 `toml:"timeout_seconds"` // of each request, run or email, defaults to 10
+
+	// File
+	Path string // the events are appended as newline delimited JSON
+
+	// Email
+	SMTPAddress           string   `toml:"smtp_address"` // host:port of the SMTP server
+	From                  string   // the sender address
+	To                    []string // the recipient addresses
+	Username              string   // optional, to authenticate with PLAIN auth, which needs STARTTLS unless the server is local
+	Password              string
+	RequireTLS            bool   `toml:"require_tls"`              // fail if the server does not offer STARTTLS, instead of sending in plain text
+	TLSInsecureSkipVerify bool   `toml:"tls_insecure_skip_verify"` // do not verify the certificate of the server
+	Subject               string // text/template, rendered with the batch of alerts
+	Text                  string // text/template, rendered with the batch of alerts
+	HTML                  string `toml:"html"`          // html/template, rendered with the batch of alerts
+	BatchSeconds          int64  `toml:"batch_seconds"` // alerts within this long of the first one are sent in the same email, defaults to 10
+}
+
+// ConfigAlertRouting defines how the alerts are grouped, deduplicated, repeated and inhibited on their way to the
+// notifiers.
+type ConfigAlertRouting struct {
+	GroupBy               []string            `toml:"group_by"`                // labels, alerts with the same values are sent in one notification; empty means each alert is sent on its own
+	GroupWaitSeconds      int64               `toml:"group_wait_seconds"`      // how long a new group waits for more alerts before its first notification
+	GroupIntervalSeconds  int64               `toml:"group_interval_seconds"`  // how long a group waits after a notification before sending the alerts that changed since
+	RepeatIntervalSeconds int64               `toml:"repeat_interval_seconds"` // how often the alerts that are still firing are sent again, 0 means never
+	InhibitRules          []ConfigInhibitRule `toml:"inhibit_rules"`
+}
+
+// ConfigInhibitRule mutes the alerts that match the target, while an alert that matches the source is firing.
+type ConfigInhibitRule struct {
+	SourceMatch map[string]string `toml:"source_match"` // labels, and their values
+	TargetMatch map[string]string `toml:"target_match"`
+	Equal       []string          // labels that the source and target alerts should have the same values for
+}
+
+// Float is a float64 that can also be written as an integer in the config file, e.g. `sensitivity = 3`, which the TOML
+// decoder does not convert to a float on its own.
+type Float float64
+
+func (f *Float) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case float64:
+		*f = Float(v)
+	case int64:
+		*f = Float(v)
+	default:
+		return fmt.Errorf("expected a number, got %T '%v'", data, data)
+	}
+	return nil
 }
 
 // ReadConfigTOML takes a path to a config file in TOML format, and parses it into a Config struct
@@ -20,6 +20,11 @@ type LogConsumer interface {
 
 	PrepareForConsumption(currentTime time.Time) error
 	ConsumeLog(lg LogMessageStructured) error
+	// Flush is called periodically with the current time, so the consumer can act even when no logs are coming in.
+	Flush(now time.Time) error
+	// FinishConsumption is called once there are no more logs to consume, e.g. when we're shutting down. It's called
+	// even if no log ever came in, in which case PrepareForConsumption was never called.
+	FinishConsumption() error
 }
 
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
@@ -56,6 +61,17 @@ func (c *baseLogConsumer) GetAllSourceSettings() map[string]LogConsumerSourceSet
 	return c.SourceSettings
 }
 
+// detectClock decides which clock to use for StatsClockAuto, from the sources the consumer gets logs from.
+func (c *baseLogConsumer) detectClock() StatsClock {
+	for srcName := range c.SourceSettings {
+		src, err := GetSourceFromStore(srcName)
+		if err == nil && IsLiveSource(src) {
+			return StatsClockProcessing
+		}
+	}
+	return StatsClockEvent
+}
+
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
 *  L O G  C O N S U M E R  S O U R C E  S E T T I N G S
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
@@ -12,8 +12,9 @@ import (
 // ConsumerStore holds an easy mapping of LogSources to LogConsumers that  are relevant to that
 // LogSource. One source can have many different consumers acting on it. It is good for concurrent access.
 type ConsumerStore struct {
-	Data map[string][]LogConsumer
-	Lock sync.RWMutex
+	Data   map[string][]LogConsumer
+	ByName map[string]LogConsumer
+	Lock   sync.RWMutex
 }
 
 var consumerStore ConsumerStore
@@ -26,6 +27,13 @@ func RegisterConsumerInStore(c LogConsumer) error {
 	if consumerStore.Data == nil {
 		consumerStore.Data = make(map[string][]LogConsumer)
 	}
+	if consumerStore.ByName == nil {
+		consumerStore.ByName = make(map[string]LogConsumer)
+	}
+
+	if _, exists := consumerStore.ByName[c.GetName()]; exists {
+		return fmt.Errorf("consumer '%s' has already been registered", c.GetName())
+	}
 
 	allSrcSettings := c.GetAllSourceSettings()
 	if len(allSrcSettings) < 1 {
@@ -35,6 +43,7 @@ func RegisterConsumerInStore(c LogConsumer) error {
 	for srcName, _ := range allSrcSettings {
 		consumerStore.Data[srcName] = append(consumerStore.Data[srcName], c)
 	}
+	consumerStore.ByName[c.GetName()] = c
 
 	return nil
 }
@@ -45,3 +54,14 @@ func GetConsumersBySourceFromStore(srcName string) []LogConsumer {
 
 	return consumerStore.Data[srcName]
 }
+
+func GetConsumerByNameFromStore(name string) (LogConsumer, error) {
+	consumerStore.Lock.RLock()
+	defer consumerStore.Lock.RUnlock()
+
+	c, exists := consumerStore.ByName[name]
+	if !exists {
+		return nil, fmt.Errorf("consumer name '%s' not found in store", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  D E A D  L E T T E R S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DeadLetter is a log line that could not be processed, along with the reason why. Dead letters can be replayed once the
+// config has been fixed (see `logdog replay-dlq`).
+type DeadLetter struct {
+	Time       time.Time `json:"time"`
+	SourceName string    `json:"source"`
+	Id         int64     `json:"id"`
+	Message    string    `json:"message"`
+	Reason     string    `json:"reason"`
+	// Headers are the headers the source had learnt from its first line, if it was configured to do so. They are needed
+	// to parse the message again during a replay, when the source is not read.
+	Headers []string `json:"headers,omitempty"`
+}
+
+// NewDeadLetter creates a DeadLetter for a raw log message that failed with the given error.
+func NewDeadLetter(rawMsg LogMessage, reason error) DeadLetter {
+	dl := DeadLetter{
+		Time:       time.Now(),
+		SourceName: rawMsg.SourceName,
+		Id:         rawMsg.Id,
+		Message:    rawMsg.Message,
+		Reason:     reason.Error(),
+	}
+	if len(rawMsg.Headers) > 0 {
+		dl.Headers = rawMsg.Headers
+	} else if src, err := GetSourceFromStore(rawMsg.SourceName); err == nil && src.GetSettings().UseFirstlineAsHeader {
+		dl.Headers = src.GetSettings().Headers
+	}
+	return dl
+}
+
+// DeadLetterSink is anything that can store dead letters.
+type DeadLetterSink interface {
+	Write(dl DeadLetter) error
+	Close() error
+}
+
+// NewDeadLetterSinkFromConfig returns a file based sink if a path is configured, otherwise a sink that only logs.
+func NewDeadLetterSinkFromConfig(req config.ConfigDeadLetter) (DeadLetterSink, error) {
+	if req.Path == "" {
+		return LogDeadLetterSink{}, nil
+	}
+	return NewFileDeadLetterSink(req.Path, req.MaxSizeBytes, req.MaxBackups)
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  D E A D  L E T T E R S  -  L O G  S I N K
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// LogDeadLetterSink implements DeadLetterSink by writing dead letters to the application log.
+type LogDeadLetterSink struct{}
+
+func (LogDeadLetterSink) Write(dl DeadLetter) error {
+	clog.Warnf("[%s] [%d] Dead letter: %s: %s", dl.SourceName, dl.Id, dl.Reason, dl.Message)
+	return nil
+}
+
+func (LogDeadLetterSink) Close() error {
+	return nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  D E A D  L E T T E R S  -  F I L E  S I N K
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// FileDeadLetterSink implements DeadLetterSink by appending dead letters to a file as newline delimited JSON. Once the
+// file grows beyond maxSizeBytes, it is rotated: `path` becomes `path.1`, `path.1` becomes `path.2` and so on, keeping
+// at most maxBackups old files.
+type FileDeadLetterSink struct {
+	path         string
+	maxSizeBytes int64
+	maxBackups   int
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+// NewFileDeadLetterSink opens (or creates) the dead letter file at path. A maxSizeBytes of 0 disables rotation.
+func NewFileDeadLetterSink(path string, maxSizeBytes int64, maxBackups int) (*FileDeadLetterSink, error) {
+	s := FileDeadLetterSink{
+		path:         path,
+		maxSizeBytes: maxSizeBytes,
+		maxBackups:   maxBackups,
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *FileDeadLetterSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening dead letter file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("reading dead letter file info: %w", err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileDeadLetterSink) Write(dl DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.maxSizeBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSizeBytes {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *FileDeadLetterSink) rotate() error {
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.maxBackups < 1 {
+		// Nothing to keep, just start over
+		err = os.Remove(s.path)
+		if err != nil {
+			return fmt.Errorf("removing dead letter file: %w", err)
+		}
+		return s.open()
+	}
+
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		err = os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil {
+			return fmt.Errorf("rotating dead letter file: %w", err)
+		}
+	}
+	err = os.Rename(s.path, s.path+".1")
+	if err != nil {
+		return fmt.Errorf("rotating dead letter file: %w", err)
+	}
+
+	return s.open()
+}
+
+func (s *FileDeadLetterSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  D E A D  L E T T E R S  -  R E A D E R
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ReadDeadLetterFile reads all the dead letters from a newline delimited JSON file.
+func ReadDeadLetterFile(path string) ([]DeadLetter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening dead letter file: %w", err)
+	}
+	defer file.Close()
+
+	var dls []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var dl DeadLetter
+		err := json.Unmarshal(scanner.Bytes(), &dl)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of dead letter file: %w", lineNum, err)
+		}
+		dls = append(dls, dl)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead letter file: %w", err)
+	}
+
+	return dls, nil
+}
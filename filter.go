@@ -0,0 +1,784 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  F I L T E R  E X P R E S S I O N
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// FilterExpr is a compiled boolean expression that can be evaluated against the key-values of a structured log. It allows
+// consumers (and anything else that needs to make a decision on a log) to express conditions such as:
+//
+//	status >= 500 && section == '/api'
+//	remotehost in ['10.0.0.1', '10.0.0.2'] || !exists(authuser)
+//	request =~ '^"GET ' && startsWith(section(request), '/rep')
+//
+// Supported operators are comparisons (==, !=, <, <=, >, >=), regex matches (=~, !~), list membership (in, not in),
+// and boolean logic (&&, ||, !) with parentheses. If both sides of a comparison look like numbers, they are compared
+// numerically, otherwise as strings. Field values are looked up with surrounding double quotes removed. Logs that do not
+// have a field of their own named like one of the derived fields (see filterDerivedFields), e.g. `section`, get its
+// derived value.
+type FilterExpr struct {
+	Source string
+	root   filterNode
+}
+
+// CompileFilter parses the given expression text into a FilterExpr. An empty expression gives a nil FilterExpr, which
+// matches everything. All syntax, function, and regex errors are reported here so they can surface at config load time.
+func CompileFilter(src string) (*FilterExpr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+
+	root, err := parseFilterSource(src)
+	if err != nil {
+		return nil, fmt.Errorf("filter '%s': %w", src, err)
+	}
+	if !root.returnsBool() {
+		return nil, fmt.Errorf("filter '%s': expression does not evaluate to true/false", src)
+	}
+
+	return &FilterExpr{Source: src, root: root}, nil
+}
+
+// Match evaluates the expression against the provided key-values. A nil FilterExpr always matches.
+func (f *FilterExpr) Match(kv map[string]string) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	v, err := f.root.eval(kv)
+	if err != nil {
+		return false, fmt.Errorf("evaluating filter '%s': %w", f.Source, err)
+	}
+	return v.b, nil
+}
+
+// String returns the original text of the expression.
+func (f *FilterExpr) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.Source
+}
+
+// ValueExpr is a compiled expression that evaluates to a value rather than true/false, e.g. `section(request)` or
+// `lower(authuser)`. It uses the same syntax and functions as FilterExpr, and a plain field name is the simplest one.
+type ValueExpr struct {
+	Source string
+	root   filterNode
+}
+
+// CompileValueExpr parses the given expression text into a ValueExpr.
+func CompileValueExpr(src string) (*ValueExpr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	root, err := parseFilterSource(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression '%s': %w", src, err)
+	}
+	return &ValueExpr{Source: strings.TrimSpace(src), root: root}, nil
+}
+
+// Eval evaluates the expression against the provided key-values. Booleans are returned as "true" or "false".
+func (e *ValueExpr) Eval(kv map[string]string) (string, error) {
+	v, err := e.root.eval(kv)
+	if err != nil {
+		return "", fmt.Errorf("evaluating expression '%s': %w", e.Source, err)
+	}
+	if v.isBool {
+		return strconv.FormatBool(v.b), nil
+	}
+	return v.s, nil
+}
+
+// String returns the original text of the expression.
+func (e *ValueExpr) String() string {
+	return e.Source
+}
+
+func parseFilterSource(src string) (filterNode, error) {
+	tokens, err := tokenizeFilter(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != filterTokenEOF {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos)
+	}
+	return root, nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  F I L T E R  E X P R E S S I O N  -  T O K E N I Z E R
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+type filterTokenKind int
+
+const (
+	filterTokenEOF filterTokenKind = iota
+	filterTokenIdent
+	filterTokenString
+	filterTokenNumber
+	filterTokenOp
+	filterTokenLParen
+	filterTokenRParen
+	filterTokenLBracket
+	filterTokenRBracket
+	filterTokenComma
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+// filterOperators is ordered so that longer operators are matched before their prefixes.
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!"}
+
+func tokenizeFilter(src string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+
+		switch c {
+		case '(':
+			tokens = append(tokens, filterToken{filterTokenLParen, "(", i})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, filterToken{filterTokenRParen, ")", i})
+			i++
+			continue
+		case '[':
+			tokens = append(tokens, filterToken{filterTokenLBracket, "[", i})
+			i++
+			continue
+		case ']':
+			tokens = append(tokens, filterToken{filterTokenRBracket, "]", i})
+			i++
+			continue
+		case ',':
+			tokens = append(tokens, filterToken{filterTokenComma, ",", i})
+			i++
+			continue
+		case '\'', '"':
+			// String literal, with backslash escaping the next character
+			var sb strings.Builder
+			j := i + 1
+			closed := false
+			for j < len(src) {
+				if src[j] == '\\' && j+1 < len(src) {
+					sb.WriteByte(src[j+1])
+					j += 2
+					continue
+				}
+				if rune(src[j]) == c {
+					closed = true
+					break
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string starting at position %d", i)
+			}
+			tokens = append(tokens, filterToken{filterTokenString, sb.String(), i})
+			i = j + 1
+			continue
+		}
+
+		// Operators
+		matchedOp := false
+		for _, op := range filterOperators {
+			if strings.HasPrefix(src[i:], op) {
+				tokens = append(tokens, filterToken{filterTokenOp, op, i})
+				i += len(op)
+				matchedOp = true
+				break
+			}
+		}
+		if matchedOp {
+			continue
+		}
+
+		// Numbers (optionally negative)
+		if unicode.IsDigit(c) || (c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))) {
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, filterToken{filterTokenNumber, src[i:j], i})
+			i = j
+			continue
+		}
+
+		// Identifiers: field names, function names and keywords
+		if unicode.IsLetter(c) || c == '_' {
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, filterToken{filterTokenIdent, src[i:j], i})
+			i = j
+			continue
+		}
+
+		return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+	}
+
+	tokens = append(tokens, filterToken{filterTokenEOF, "end of expression", len(src)})
+	return tokens, nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  F I L T E R  E X P R E S S I O N  -  P A R S E R
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// filterParser is a recursive descent parser for the following grammar:
+//
+//	or      := and ( '||' and )*
+//	and     := unary ( '&&' unary )*
+//	unary   := '!' unary | compare
+//	compare := primary [ op primary | 'in' list | 'not' 'in' list ]
+//	primary := '(' or ')' | string | number | 'true' | 'false' | ident | ident '(' args ')'
+//	list    := '[' primary ( ',' primary )* ']'
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != filterTokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) expect(kind filterTokenKind, text string) error {
+	tok := p.next()
+	if tok.kind != kind {
+		return fmt.Errorf("expected '%s' at position %d, got '%s'", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *filterParser) isOp(op string) bool {
+	tok := p.peek()
+	return tok.kind == filterTokenOp && tok.text == op
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		tok := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if !left.returnsBool() || !right.returnsBool() {
+			return nil, fmt.Errorf("operands of '||' at position %d must be true/false", tok.pos)
+		}
+		left = filterLogicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		tok := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if !left.returnsBool() || !right.returnsBool() {
+			return nil, fmt.Errorf("operands of '&&' at position %d must be true/false", tok.pos)
+		}
+		left = filterLogicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.isOp("!") {
+		tok := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if !operand.returnsBool() {
+			return nil, fmt.Errorf("operand of '!' at position %d must be true/false", tok.pos)
+		}
+		return filterNotNode{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (filterNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+
+	// Membership: `x in [...]` and `x not in [...]`
+	if tok.kind == filterTokenIdent && (tok.text == "in" || tok.text == "not") {
+		p.next()
+		negate := false
+		if tok.text == "not" {
+			if nxt := p.next(); nxt.kind != filterTokenIdent || nxt.text != "in" {
+				return nil, fmt.Errorf("expected 'in' after 'not' at position %d", nxt.pos)
+			}
+			negate = true
+		}
+		if left.returnsBool() {
+			return nil, fmt.Errorf("left side of 'in' at position %d must be a value", tok.pos)
+		}
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		var node filterNode = filterInNode{value: left, list: list}
+		if negate {
+			node = filterNotNode{operand: node}
+		}
+		return node, nil
+	}
+
+	if tok.kind != filterTokenOp {
+		return left, nil
+	}
+
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if left.returnsBool() || right.returnsBool() {
+			return nil, fmt.Errorf("operands of '%s' at position %d must be values", tok.text, tok.pos)
+		}
+		return filterCompareNode{op: tok.text, left: left, right: right}, nil
+
+	case "=~", "!~":
+		p.next()
+		patternTok := p.next()
+		if patternTok.kind != filterTokenString {
+			return nil, fmt.Errorf("right side of '%s' at position %d must be a quoted regex", tok.text, tok.pos)
+		}
+		re, err := regexp.Compile(patternTok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex at position %d: %w", patternTok.pos, err)
+		}
+		if left.returnsBool() {
+			return nil, fmt.Errorf("left side of '%s' at position %d must be a value", tok.text, tok.pos)
+		}
+		var node filterNode = filterRegexNode{value: left, re: re}
+		if tok.text == "!~" {
+			node = filterNotNode{operand: node}
+		}
+		return node, nil
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseList() ([]filterNode, error) {
+	if err := p.expect(filterTokenLBracket, "["); err != nil {
+		return nil, err
+	}
+	var list []filterNode
+	for {
+		item, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if item.returnsBool() {
+			return nil, fmt.Errorf("list items must be values")
+		}
+		list = append(list, item)
+
+		tok := p.next()
+		if tok.kind == filterTokenRBracket {
+			break
+		}
+		if tok.kind != filterTokenComma {
+			return nil, fmt.Errorf("expected ',' or ']' at position %d, got '%s'", tok.pos, tok.text)
+		}
+	}
+	return list, nil
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case filterTokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(filterTokenRParen, ")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case filterTokenString:
+		return filterLiteralNode{value: newFilterString(tok.text)}, nil
+
+	case filterTokenNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", tok.text, tok.pos)
+		}
+		return filterLiteralNode{value: filterValue{s: tok.text, n: n, isNum: true}}, nil
+
+	case filterTokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return filterLiteralNode{value: filterValue{b: tok.text == "true", isBool: true}}, nil
+		case "in", "not":
+			return nil, fmt.Errorf("unexpected keyword '%s' at position %d", tok.text, tok.pos)
+		}
+		// Function call
+		if p.peek().kind == filterTokenLParen {
+			return p.parseCall(tok)
+		}
+		return filterFieldNode{key: tok.text}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos)
+}
+
+func (p *filterParser) parseCall(name filterToken) (filterNode, error) {
+	fn, exists := filterFuncs[name.text]
+	if !exists {
+		return nil, fmt.Errorf("unknown function '%s' at position %d", name.text, name.pos)
+	}
+	p.next() // (
+
+	var args []filterNode
+	if p.peek().kind == filterTokenRParen {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if arg.returnsBool() {
+				return nil, fmt.Errorf("arguments to '%s' at position %d must be values", name.text, name.pos)
+			}
+			args = append(args, arg)
+			tok := p.next()
+			if tok.kind == filterTokenRParen {
+				break
+			}
+			if tok.kind != filterTokenComma {
+				return nil, fmt.Errorf("expected ',' or ')' at position %d, got '%s'", tok.pos, tok.text)
+			}
+		}
+	}
+
+	if len(args) != fn.numArgs {
+		return nil, fmt.Errorf("function '%s' at position %d expects %d argument(s), got %d", name.text, name.pos, fn.numArgs, len(args))
+	}
+	if fn.fieldArg {
+		if _, ok := args[0].(filterFieldNode); !ok {
+			return nil, fmt.Errorf("function '%s' at position %d expects a field name", name.text, name.pos)
+		}
+	}
+
+	return filterCallNode{name: name.text, fn: fn, args: args}, nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  F I L T E R  E X P R E S S I O N  -  E V A L U A T I O N
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// filterValue is the result of evaluating any node. Strings that look like numbers also carry their numeric value so
+// that comparisons can be done numerically.
+type filterValue struct {
+	s      string
+	n      float64
+	isNum  bool
+	b      bool
+	isBool bool
+}
+
+func newFilterString(s string) filterValue {
+	v := filterValue{s: s}
+	if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		v.n = n
+		v.isNum = true
+	}
+	return v
+}
+
+func newFilterBool(b bool) filterValue {
+	return filterValue{b: b, isBool: true}
+}
+
+type filterNode interface {
+	eval(kv map[string]string) (filterValue, error)
+	returnsBool() bool
+}
+
+type filterLiteralNode struct {
+	value filterValue
+}
+
+func (n filterLiteralNode) eval(kv map[string]string) (filterValue, error) { return n.value, nil }
+func (n filterLiteralNode) returnsBool() bool                              { return n.value.isBool }
+
+type filterFieldNode struct {
+	key string
+}
+
+func (n filterFieldNode) eval(kv map[string]string) (filterValue, error) {
+	v, exists := kv[n.key]
+	if derive, derived := filterDerivedFields[n.key]; !exists && derived {
+		return newFilterString(derive(kv)), nil
+	}
+	return newFilterString(removeQuotes(v)), nil
+}
+func (n filterFieldNode) returnsBool() bool { return false }
+
+type filterLogicalNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n filterLogicalNode) eval(kv map[string]string) (filterValue, error) {
+	l, err := n.left.eval(kv)
+	if err != nil {
+		return l, err
+	}
+	// Short-circuit
+	if n.op == "&&" && !l.b {
+		return newFilterBool(false), nil
+	}
+	if n.op == "||" && l.b {
+		return newFilterBool(true), nil
+	}
+	return n.right.eval(kv)
+}
+func (n filterLogicalNode) returnsBool() bool { return true }
+
+type filterNotNode struct {
+	operand filterNode
+}
+
+func (n filterNotNode) eval(kv map[string]string) (filterValue, error) {
+	v, err := n.operand.eval(kv)
+	if err != nil {
+		return v, err
+	}
+	return newFilterBool(!v.b), nil
+}
+func (n filterNotNode) returnsBool() bool { return true }
+
+type filterCompareNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n filterCompareNode) eval(kv map[string]string) (filterValue, error) {
+	l, err := n.left.eval(kv)
+	if err != nil {
+		return l, err
+	}
+	r, err := n.right.eval(kv)
+	if err != nil {
+		return r, err
+	}
+	return newFilterBool(compareFilterValues(n.op, l, r)), nil
+}
+func (n filterCompareNode) returnsBool() bool { return true }
+
+func compareFilterValues(op string, l, r filterValue) bool {
+	var cmp int
+	if l.isNum && r.isNum {
+		switch {
+		case l.n < r.n:
+			cmp = -1
+		case l.n > r.n:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(l.s, r.s)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type filterInNode struct {
+	value filterNode
+	list  []filterNode
+}
+
+func (n filterInNode) eval(kv map[string]string) (filterValue, error) {
+	v, err := n.value.eval(kv)
+	if err != nil {
+		return v, err
+	}
+	for _, item := range n.list {
+		iv, err := item.eval(kv)
+		if err != nil {
+			return iv, err
+		}
+		if compareFilterValues("==", v, iv) {
+			return newFilterBool(true), nil
+		}
+	}
+	return newFilterBool(false), nil
+}
+func (n filterInNode) returnsBool() bool { return true }
+
+type filterRegexNode struct {
+	value filterNode
+	re    *regexp.Regexp
+}
+
+func (n filterRegexNode) eval(kv map[string]string) (filterValue, error) {
+	v, err := n.value.eval(kv)
+	if err != nil {
+		return v, err
+	}
+	return newFilterBool(n.re.MatchString(v.s)), nil
+}
+func (n filterRegexNode) returnsBool() bool { return true }
+
+type filterCallNode struct {
+	name string
+	fn   filterFunc
+	args []filterNode
+}
+
+func (n filterCallNode) eval(kv map[string]string) (filterValue, error) {
+	// exists() looks at the presence of the key, not its value. Derived fields exist if they could be derived.
+	if n.fn.fieldArg {
+		key := n.args[0].(filterFieldNode).key
+		_, exists := kv[key]
+		if derive, derived := filterDerivedFields[key]; !exists && derived {
+			exists = derive(kv) != ""
+		}
+		return newFilterBool(exists), nil
+	}
+
+	var args []filterValue
+	for _, a := range n.args {
+		v, err := a.eval(kv)
+		if err != nil {
+			return v, err
+		}
+		args = append(args, v)
+	}
+	v, err := n.fn.call(args)
+	if err != nil {
+		return v, fmt.Errorf("%s(): %w", n.name, err)
+	}
+	return v, nil
+}
+func (n filterCallNode) returnsBool() bool { return n.fn.returnsBool }
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  F I L T E R  E X P R E S S I O N  -  F U N C T I O N S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+type filterFunc struct {
+	numArgs     int
+	returnsBool bool
+	fieldArg    bool // if true, the first argument must be a field name (e.g. exists)
+	call        func(args []filterValue) (filterValue, error)
+}
+
+// filterFuncs holds all the functions that can be used in a filter expression.
+var filterFuncs = map[string]filterFunc{
+	"exists": {numArgs: 1, returnsBool: true, fieldArg: true},
+	"startsWith": {numArgs: 2, returnsBool: true, call: func(args []filterValue) (filterValue, error) {
+		return newFilterBool(strings.HasPrefix(args[0].s, args[1].s)), nil
+	}},
+	"endsWith": {numArgs: 2, returnsBool: true, call: func(args []filterValue) (filterValue, error) {
+		return newFilterBool(strings.HasSuffix(args[0].s, args[1].s)), nil
+	}},
+	"contains": {numArgs: 2, returnsBool: true, call: func(args []filterValue) (filterValue, error) {
+		return newFilterBool(strings.Contains(args[0].s, args[1].s)), nil
+	}},
+	"lower": {numArgs: 1, call: func(args []filterValue) (filterValue, error) {
+		return newFilterString(strings.ToLower(args[0].s)), nil
+	}},
+	"upper": {numArgs: 1, call: func(args []filterValue) (filterValue, error) {
+		return newFilterString(strings.ToUpper(args[0].s)), nil
+	}},
+	"section": {numArgs: 1, call: func(args []filterValue) (filterValue, error) {
+		section, err := HTTPStatusLineToSection(args[0].s)
+		if err != nil {
+			return filterValue{}, err
+		}
+		return newFilterString(section), nil
+	}},
+	"statusClass": {numArgs: 1, call: func(args []filterValue) (filterValue, error) {
+		if !args[0].isNum || args[0].n < 100 || args[0].n >= 600 {
+			return filterValue{}, fmt.Errorf("'%s' is not an HTTP status", args[0].s)
+		}
+		return newFilterString(fmt.Sprintf("%dxx", int(args[0].n)/100)), nil
+	}},
+}
+
+// filterDerivedFields holds the fields that are derived from the other fields of a log, for the logs that do not have
+// them. A derived field is empty if it cannot be derived, e.g. `section` for a log without an HTTP request line.
+var filterDerivedFields = map[string]func(kv map[string]string) string{
+	"section": func(kv map[string]string) string {
+		section, err := HTTPStatusLineToSection(removeQuotes(kv["request"]))
+		if err != nil {
+			return ""
+		}
+		return section
+	},
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S K E T C H  -  H E A V Y  H I T T E R S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// StatsCounterMode determines how the values of a stats key (and of its breakdowns) are counted.
+type StatsCounterMode string
+
+const (
+	// StatsCounterExact keeps a count for every value. Counts are exact, but memory grows with the number of values.
+	StatsCounterExact StatsCounterMode = "exact"
+	// StatsCounterSpaceSaving only keeps counts for a fixed number of values (see SpaceSavingCounter), which is enough to
+	// report the most frequent ones on high cardinality keys like full URLs or IPs.
+	StatsCounterSpaceSaving StatsCounterMode = "space_saving"
+)
+
+// DefaultStatsCounterCapacity is the number of values a Space-Saving counter keeps when none is configured.
+const DefaultStatsCounterCapacity = 1000
+
+// ParseStatsCounterMode parses the counter mode from the config. Empty means exact.
+func ParseStatsCounterMode(str string) (StatsCounterMode, error) {
+	switch StatsCounterMode(str) {
+	case "", StatsCounterExact:
+		return StatsCounterExact, nil
+	case StatsCounterSpaceSaving:
+		return StatsCounterSpaceSaving, nil
+	}
+	return "", fmt.Errorf("counter '%s' not recognized", str)
+}
+
+// HeavyHitter is a value and how often it has been seen. The true count is between Count-Error and Count.
+type HeavyHitter struct {
+	Value string
+	Count int
+	Error int
+}
+
+// HeavyHitters counts how often values occur, so that the most frequent ones can be reported.
+type HeavyHitters interface {
+	// Add counts one occurrence of the value. If another value had to be dropped to make room for it, that value is
+	// returned.
+	Add(value string) *HeavyHitter
+	// Top returns the n most frequent values, most frequent first. Ties are ordered by value. If n < 1, all the
+	// values that are kept are returned.
+	Top(n int) []HeavyHitter
+	// Len returns the number of values that are kept.
+	Len() int
+	// Merge adds all the counts of the other counter to this one.
+	Merge(other HeavyHitters) error
+}
+
+// NewHeavyHitters creates a counter for the given mode. The capacity is only used by Space-Saving counters.
+func NewHeavyHitters(mode StatsCounterMode, capacity int) HeavyHitters {
+	if mode == StatsCounterSpaceSaving {
+		return NewSpaceSavingCounter(capacity)
+	}
+	return ExactCounter{}
+}
+
+// sortHeavyHitters sorts the heavy hitters from the most frequent to the least, and by value for the same count, so
+// that reports are stable.
+func sortHeavyHitters(hs []HeavyHitter) {
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].Count != hs[j].Count {
+			return hs[i].Count > hs[j].Count
+		}
+		return hs[i].Value < hs[j].Value
+	})
+}
+
+func topHeavyHitters(hs []HeavyHitter, n int) []HeavyHitter {
+	sortHeavyHitters(hs)
+	if n > 0 && len(hs) > n {
+		hs = hs[:n]
+	}
+	return hs
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  H E A V Y  H I T T E R S  -  E X A C T
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ExactCounter keeps a count for every value it sees.
+type ExactCounter map[string]int
+
+func (c ExactCounter) Add(value string) *HeavyHitter {
+	c[value]++
+	return nil
+}
+
+func (c ExactCounter) Top(n int) []HeavyHitter {
+	var hs = make([]HeavyHitter, 0, len(c))
+	for v, cnt := range c {
+		hs = append(hs, HeavyHitter{Value: v, Count: cnt})
+	}
+	return topHeavyHitters(hs, n)
+}
+
+func (c ExactCounter) Len() int {
+	return len(c)
+}
+
+func (c ExactCounter) Merge(other HeavyHitters) error {
+	if other == nil {
+		return nil
+	}
+	for _, h := range other.Top(-1) {
+		c[h.Value] += h.Count
+	}
+	return nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  H E A V Y  H I T T E R S  -  S P A C E  S A V I N G
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// SpaceSavingCounter keeps counts for at most Capacity values (https://www.cs.ucsb.edu/sites/default/files/documents/2005-23.pdf).
+// When a new value comes in and the counter is full, it takes over the slot of the least frequent value, along with its
+// count. Counts are therefore never underestimated, and any value that occurs more than 1/Capacity of the time is
+// guaranteed to be kept.
+type SpaceSavingCounter struct {
+	Capacity int
+	entries  spaceSavingHeap // min-heap by count, so the least frequent value is always at the top
+	index    map[string]*spaceSavingEntry
+}
+
+type spaceSavingEntry struct {
+	HeavyHitter
+	heapIndex int
+}
+
+func NewSpaceSavingCounter(capacity int) *SpaceSavingCounter {
+	if capacity < 1 {
+		capacity = DefaultStatsCounterCapacity
+	}
+	return &SpaceSavingCounter{
+		Capacity: capacity,
+		index:    make(map[string]*spaceSavingEntry),
+	}
+}
+
+func (c *SpaceSavingCounter) Add(value string) *HeavyHitter {
+	if e, exists := c.index[value]; exists {
+		e.Count++
+		heap.Fix(&c.entries, e.heapIndex)
+		return nil
+	}
+
+	if len(c.entries) < c.Capacity {
+		e := &spaceSavingEntry{HeavyHitter: HeavyHitter{Value: value, Count: 1}}
+		heap.Push(&c.entries, e)
+		c.index[value] = e
+		return nil
+	}
+
+	// Replace the least frequent value. The new value may have been seen up to min times before, as its earlier
+	// occurrences could have been dropped.
+	e := c.entries[0]
+	evicted := e.HeavyHitter
+	delete(c.index, evicted.Value)
+	e.Value = value
+	e.Error = evicted.Count
+	e.Count = evicted.Count + 1
+	c.index[value] = e
+	heap.Fix(&c.entries, 0)
+
+	return &evicted
+}
+
+func (c *SpaceSavingCounter) Top(n int) []HeavyHitter {
+	var hs = make([]HeavyHitter, 0, len(c.entries))
+	for _, e := range c.entries {
+		hs = append(hs, e.HeavyHitter)
+	}
+	return topHeavyHitters(hs, n)
+}
+
+func (c *SpaceSavingCounter) Len() int {
+	return len(c.entries)
+}
+
+// Merge combines the counts of both counters, and keeps the Capacity most frequent values
+// (https://arxiv.org/abs/1202.3187). A value that is missing from a full counter may still have been seen up to that
+// counter's minimum count, so that is added to its count and error.
+func (c *SpaceSavingCounter) Merge(other HeavyHitters) error {
+	if other == nil {
+		return nil
+	}
+	var otherMin int
+	if o, ok := other.(*SpaceSavingCounter); ok {
+		otherMin = o.minDroppableCount()
+	}
+	myMin := c.minDroppableCount()
+
+	var combined = make(map[string]HeavyHitter)
+	for _, e := range c.entries {
+		combined[e.Value] = HeavyHitter{Value: e.Value, Count: e.Count + otherMin, Error: e.Error + otherMin}
+	}
+	for _, h := range other.Top(-1) {
+		if mine, exists := combined[h.Value]; exists {
+			// Undo the minimum we assumed above, as we have the actual count
+			combined[h.Value] = HeavyHitter{Value: h.Value, Count: mine.Count - otherMin + h.Count, Error: mine.Error - otherMin + h.Error}
+			continue
+		}
+		combined[h.Value] = HeavyHitter{Value: h.Value, Count: h.Count + myMin, Error: h.Error + myMin}
+	}
+
+	var hs = make([]HeavyHitter, 0, len(combined))
+	for _, h := range combined {
+		hs = append(hs, h)
+	}
+	c.entries = nil
+	c.index = make(map[string]*spaceSavingEntry)
+	for _, h := range topHeavyHitters(hs, c.Capacity) {
+		e := &spaceSavingEntry{HeavyHitter: h}
+		heap.Push(&c.entries, e)
+		c.index[h.Value] = e
+	}
+	return nil
+}
+
+// minDroppableCount returns how many times a value that is not kept may have been seen: zero until the counter is full,
+// as no value has been dropped yet, and the smallest count after that.
+func (c *SpaceSavingCounter) minDroppableCount() int {
+	if len(c.entries) < c.Capacity {
+		return 0
+	}
+	return c.entries[0].Count
+}
+
+// spaceSavingHeap implements heap.Interface.
+type spaceSavingHeap []*spaceSavingEntry
+
+func (h spaceSavingHeap) Len() int { return len(h) }
+
+func (h spaceSavingHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	e := x.(*spaceSavingEntry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S K E T C H  -  D I S T I N C T  C O U N T S  ( H Y P E R L O G L O G )
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultHyperLogLogPrecision gives 2^14 registers, i.e. a standard error of ~0.8% using at most 16KB per sketch.
+const DefaultHyperLogLogPrecision = 14
+
+// HyperLogLog estimates the number of distinct values added to it, using a fixed amount of memory
+// (https://algo.inria.fr/flajolet/Publications/FlFuGaMe07.pdf). Small sets are kept in a sparse map of registers, so a
+// sketch only takes its full size once it has seen enough distinct values. Sketches with the same precision can be
+// merged, which lets us combine windows.
+type HyperLogLog struct {
+	Precision uint8
+	m         uint32
+
+	sparse    map[uint32]uint8 // register index -> rank, used while the sketch is small
+	registers []uint8          // all registers, used once the sparse map grows too big
+}
+
+// NewHyperLogLog creates an empty sketch with 2^precision registers. The precision should be between 4 and 18.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{
+		Precision: precision,
+		m:         1 << precision,
+		sparse:    make(map[uint32]uint8),
+	}
+}
+
+// hashHyperLogLogValue hashes the value into 64 bits. FNV alone does not spread short, similar strings (e.g. IPs) well
+// enough, so its result goes through a finalizer.
+func hashHyperLogLogValue(v string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add adds a value to the sketch.
+func (h *HyperLogLog) Add(v string) {
+	x := hashHyperLogLogValue(v)
+	index := uint32(x >> (64 - h.Precision))
+	rank := uint8(bits.LeadingZeros64(x<<h.Precision|1<<(h.Precision-1)) + 1)
+	h.setRegister(index, rank)
+}
+
+func (h *HyperLogLog) setRegister(index uint32, rank uint8) {
+	if h.registers != nil {
+		if rank > h.registers[index] {
+			h.registers[index] = rank
+		}
+		return
+	}
+	if rank > h.sparse[index] {
+		h.sparse[index] = rank
+	}
+	// A map entry takes a lot more memory than a register, so switch once the map holds a fraction of the registers
+	if uint32(len(h.sparse)) > h.m/16 {
+		h.densify()
+	}
+}
+
+func (h *HyperLogLog) densify() {
+	h.registers = make([]uint8, h.m)
+	for i, rank := range h.sparse {
+		h.registers[i] = rank
+	}
+	h.sparse = nil
+}
+
+// Merge adds all the values of the other sketch to this one. Both sketches need to have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other == nil {
+		return nil
+	}
+	if h.Precision != other.Precision {
+		return fmt.Errorf("cannot merge HyperLogLogs with different precisions: %d and %d", h.Precision, other.Precision)
+	}
+	if other.registers != nil {
+		if h.registers == nil {
+			h.densify()
+		}
+		for i, rank := range other.registers {
+			if rank > h.registers[i] {
+				h.registers[i] = rank
+			}
+		}
+		return nil
+	}
+	for i, rank := range other.sparse {
+		h.setRegister(i, rank)
+	}
+	return nil
+}
+
+// Estimate returns the estimated number of distinct values added to the sketch.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(h.m)
+
+	var sum float64
+	var zeros int
+	if h.registers != nil {
+		for _, rank := range h.registers {
+			sum += 1 / float64(uint64(1)<<rank)
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		for _, rank := range h.sparse {
+			sum += 1 / float64(uint64(1)<<rank)
+		}
+		zeros = int(h.m) - len(h.sparse)
+		sum += float64(zeros)
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	switch h.m {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	}
+	estimate := alpha * m * m / sum
+
+	// Small range correction: linear counting is more accurate while there are empty registers
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
@@ -37,14 +37,24 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/teejays/logdoc/config"
 
 	"github.com/teejays/clog"
 )
 
+// sourceStopGracePeriod is how long we wait for the log sources to stop, after being asked to.
+const sourceStopGracePeriod = time.Second
+
+// consumerFlushInterval is how often the consumers are flushed, so they can report even when no logs are coming in.
+const consumerFlushInterval = time.Second
+
 // Args holds the command line arguments that are needed to run the application
 type Args struct {
 	// ConfigFilePath is the file path where config file for this application lives
@@ -67,7 +77,13 @@ func CreateQueue(size int) chan LogMessage {
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
 
 func main() {
-	err := run()
+	var err error
+	// Sub-commands
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		err = runReplayDeadLetters(os.Args[2:])
+	} else {
+		err = run()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -87,103 +103,25 @@ func run() error {
 	}
 
 	// Step 2: From the config file, create LogSource instances
-	var sources []LogSource
-	for _, cfgSrc := range cfg.LogSources {
-
-		if cfgSrc.Disabled {
-			continue
-		}
-
-		// Get the LogSource instance
-		src, err := NewLogSourceFromConfig(cfgSrc)
-		if err != nil {
-			return fmt.Errorf("creating log source '%s': %w", cfgSrc.Name, err)
-		}
-
-		// Store the LogSource instance in-memory for shared access
-		err = RegisterSourceInStore(src)
-		if err != nil {
-			return err
-		}
-
-		sources = append(sources, src)
-	}
-
-	if len(sources) < 1 {
-		return fmt.Errorf("No valid log sources created")
-	}
-	clog.Debugf("Log Sources: %v", sources)
-
-	// Step 3: Create a channel that can be used to push messages from log sources to the listener
-	var queue = CreateQueue(cfg.InQueueBufferSize)
-
-	// - Start the Log Listener in a goroutine
-	go ListenToLogSources(queue)
-
-	// Step 4: Setup the log consumers.
-	var consumers []LogConsumer
-
-	// - Register Stats types: these define what kind of stats do keep track of
-	clog.Debugf("Stats Types: %v", cfg.Stats.Types)
-	for _, st := range cfg.Stats.Types {
-		if st.Disabled {
-			continue
-		}
-
-		// Get the Stats LogConsumer instance
-		c, err := NewStatsTypeFromConfig(st)
-		if err != nil {
-			return err
-		}
-
-		// Store the LogConsumer in memory for shared access
-		err = RegisterConsumerInStore(c)
-		if err != nil {
-			return err
-		}
-
-		consumers = append(consumers, c)
-	}
-
-	// - Register Alert Types: these define what kind of alerts do we keep track of
-	clog.Debugf("Alert Types: %v", cfg.Alert.Types)
-	for _, at := range cfg.Alert.Types {
-		if at.Disabled {
-			continue
-		}
-
-		// Get the Alert LogConsumer instance
-		c, err := NewAlertTypeFromConfig(at)
-		if err != nil {
-			return err
-		}
-
-		// Store the LogConsumer in memory for shared access
-		err = RegisterConsumerInStore(c)
-		if err != nil {
-			return err
-		}
-
-		consumers = append(consumers, c)
+	sources, err := setupSources(cfg)
+	if err != nil {
+		return err
 	}
 
-	// - For each LogConsumer, we need to start a listener go routine that received log messages for them
-	for _, c := range consumers {
-		go func(c LogConsumer) {
-			err := ListenForLogMessageOnConsumer(c)
-			if err != nil {
-				clog.Warnf("[Consumer %s] Listening for messages: %s", c.GetName(), err)
-			}
-
-		}(c)
+	// Step 3: Setup the queue, the log consumers, the router and the dead letter sink, and start listening to the queue
+	processor, err := NewLogProcessorFromConfig(cfg)
+	if err != nil {
+		return err
 	}
+	processor.Start()
 
-	// Step 6: Initialize and start reading from all the log sources.
+	// Step 4: Initialize and start reading from all the log sources.
 	// At this point all we need to do is start steaming log from source. We already
 	//  have a listener listening to take raw log data, process it a little, and send to consumers.
 
 	// WaitGroup helps making sure that we don't exit the program unless all log sources are over
 	var wg sync.WaitGroup
+	var stop = make(chan struct{}) // closed when the sources should stop reading
 	for _, src := range sources {
 		wg.Add(1)
 		go func(src LogSource) {
@@ -193,21 +131,101 @@ func run() error {
 				}
 				wg.Done()
 			}()
-			err := StreamLogMessagesFromSource(src, queue)
+			err := StreamLogMessagesFromSource(src, processor.Queue, stop)
 			if err != nil {
-				clog.Errorf("Initializing log source %s: %w", src.GetName(), err)
+				clog.Errorf("Initializing log source %s: %s", src.GetName(), err)
 			}
 		}(src)
 	}
+	var sourcesDone = make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sourcesDone)
+	}()
+
+	// Step 5: Wait for the sources to finish, or for a signal to shut down
+	var sigs = make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var deadline time.Time
+	select {
+	case <-sourcesDone:
+		clog.Debugf("All log sources are done")
+		deadline = time.Now().Add(cfg.GetShutdownTimeout())
+	case sig := <-sigs:
+		clog.Warnf("Received %s, shutting down...", sig)
+		deadline = time.Now().Add(cfg.GetShutdownTimeout())
+		close(stop)
+		// Sources that are blocked reading (e.g. stdin) cannot be interrupted, but once stopped they won't send anything
+		// to the queue, so we don't have to wait for them for long
+		select {
+		case <-sourcesDone:
+		case <-time.After(sourceStopGracePeriod):
+			clog.Debugf("Not all log sources stopped, moving on")
+		}
+	}
 
-	wg.Wait()
+	// A second signal means we should not wait any longer
+	go func() {
+		sig := <-sigs
+		clog.Errorf("Received %s again, exiting without draining", sig)
+		os.Exit(1)
+	}()
+
+	// Step 6: Drain everything that is still in the queue and the consumers, so final stats are reported and alerts resolved
+	err = processor.Drain(deadline)
+	if err != nil {
+		clog.Errorf("Shutting down: %s", err)
+	}
 
+	logSourceErrorCounts()
 	clog.Info("Exiting.")
 
 	return nil
 }
 
-func StreamLogMessagesFromSource(src LogSource, inQueue chan LogMessage) error {
+// setupSources creates the LogSources from the config, and registers them in the store.
+func setupSources(cfg config.Config) ([]LogSource, error) {
+	var sources []LogSource
+	for _, cfgSrc := range cfg.LogSources {
+
+		if cfgSrc.Disabled {
+			continue
+		}
+
+		// Get the LogSource instance
+		src, err := NewLogSourceFromConfig(cfgSrc)
+		if err != nil {
+			return nil, fmt.Errorf("creating log source '%s': %w", cfgSrc.Name, err)
+		}
+
+		// Store the LogSource instance in-memory for shared access
+		err = RegisterSourceInStore(src)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, src)
+	}
+
+	if len(sources) < 1 {
+		return nil, fmt.Errorf("No valid log sources created")
+	}
+	clog.Debugf("Log Sources: %v", sources)
+
+	return sources, nil
+}
+
+// logSourceErrorCounts logs how many lines from each source could not be processed.
+func logSourceErrorCounts() {
+	for srcName, cnt := range GetSourceErrorCountsFromStore() {
+		clog.Warnf("[%s] %d log line(s) could not be processed and were sent to dead letters", srcName, cnt)
+	}
+}
+
+// StreamLogMessagesFromSource reads the source line by line and sends each line to the queue, until the source ends or
+// the stop channel is closed.
+func StreamLogMessagesFromSource(src LogSource, inQueue chan LogMessage, stop <-chan struct{}) error {
 
 	reader, err := src.NewReader()
 	if err != nil {
@@ -218,6 +236,13 @@ func StreamLogMessagesFromSource(src LogSource, inQueue chan LogMessage) error {
 
 	var id int64
 	for {
+		// Stop if we've been asked to
+		if isStopped(stop) {
+			clog.Debugf("[%s] Stop signal received", src.GetName())
+			reader.Close()
+			return nil
+		}
+
 		// Read the next/first line
 		text, err := buffReader.ReadString('\n')
 		if err != nil && err != io.EOF {
@@ -258,8 +283,22 @@ func StreamLogMessagesFromSource(src LogSource, inQueue chan LogMessage) error {
 		// Uniqueinternal ID for this log message
 		id++
 
+		// Reading may have blocked for a while, so check again: if the queue has room too, the select below would pick
+		// either of them at random
+		if isStopped(stop) {
+			clog.Debugf("[%s] Stop signal received", src.GetName())
+			reader.Close()
+			return nil
+		}
+
 		// clog.Debugf("[%s] [%d] Sending message to queue: %s", src.GetName(), id, text)
-		inQueue <- LogMessage{SourceName: src.GetName(), Message: text, Id: id}
+		select {
+		case inQueue <- LogMessage{SourceName: src.GetName(), Message: text, Id: id, ReceivedAt: time.Now()}:
+		case <-stop:
+			clog.Debugf("[%s] Stop signal received", src.GetName())
+			reader.Close()
+			return nil
+		}
 	}
 
 	reader.Close()
@@ -267,46 +306,41 @@ func StreamLogMessagesFromSource(src LogSource, inQueue chan LogMessage) error {
 	return nil
 }
 
-func ListenToLogSources(inQueue chan LogMessage) error {
+// isStopped tells if the stop channel has been closed, without blocking.
+func isStopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListenToLogSources listens on the queue for raw log messages, makes them structured and sends them to the consumers.
+// Log lines that cannot be processed are sent to the dead letter sink, and do not stop the processing.
+func ListenToLogSources(inQueue chan LogMessage, router *LogRouter, dlq DeadLetterSink) error {
 
 	for {
 		rawMsg := <-inQueue
 
 		if rawMsg.IsCancelSignal {
-			clog.Warnf("[%s] [%d] Cancel Signal Received", rawMsg.SourceName, rawMsg.Id)
+			clog.Debugf("[%s] [%d] Cancel Signal Received", rawMsg.SourceName, rawMsg.Id)
 			break
 		}
 
 		clog.Debugf("[%s] [%d] Message received from queue: %s", rawMsg.SourceName, rawMsg.Id, rawMsg.Message)
 
-		// If an empty message, do nothing
-		if strings.TrimSpace(rawMsg.Message) == "" {
-			return fmt.Errorf("received an empty message")
-		}
-
-		// Make the Log Message Structured
-		// Get the format config for this source type
-		src, err := GetSourceFromStore(rawMsg.SourceName)
+		msg, consumers, err := processLogMessage(rawMsg, router)
 		if err != nil {
-			return err
-		}
-		settings := src.GetSettings()
-		clog.Debugf("[%s] [%d] Source settings fetched: %+v", rawMsg.SourceName, rawMsg.Id, settings)
-
-		msg, err := NewLogMessageStructured(rawMsg, settings)
-		if err != nil {
-			return err
+			clog.Debugf("[%s] [%d] Sending message to dead letters: %s", rawMsg.SourceName, rawMsg.Id, err)
+			IncrementSourceErrorCountInStore(rawMsg.SourceName)
+			err = dlq.Write(NewDeadLetter(rawMsg, err))
+			if err != nil {
+				clog.Errorf("[%s] [%d] Could not write dead letter: %s", rawMsg.SourceName, rawMsg.Id, err)
+			}
+			continue
 		}
 
-		clog.Debugf("[%s] [%d] Structured Log Message created", rawMsg.SourceName, rawMsg.Id)
-
-		// Get all the consumers for this source...
-		// Get all the consumer's channels
-		// Send it to the channels
-
-		consumers := GetConsumersBySourceFromStore(msg.SourceName)
-		clog.Debugf("[%s] [%d] # Consumers Fetched: %d", rawMsg.SourceName, rawMsg.Id, len(consumers))
-
 		for _, c := range consumers {
 			clog.Debugf("[%s] [%d] Handling Consumer: %s", rawMsg.SourceName, rawMsg.Id, c.GetName())
 			ch := c.GetChannel()
@@ -319,16 +353,76 @@ func ListenToLogSources(inQueue chan LogMessage) error {
 
 }
 
+// processLogMessage converts a raw log message into a structured one, and finds the consumers it should be sent to.
+func processLogMessage(rawMsg LogMessage, router *LogRouter) (LogMessageStructured, []LogConsumer, error) {
+	var msg LogMessageStructured
+
+	// If an empty message, there is nothing to process
+	if strings.TrimSpace(rawMsg.Message) == "" {
+		return msg, nil, fmt.Errorf("received an empty message")
+	}
+
+	// Make the Log Message Structured
+	// Get the format config for this source type
+	src, err := GetSourceFromStore(rawMsg.SourceName)
+	if err != nil {
+		return msg, nil, err
+	}
+	settings := src.GetSettings()
+	clog.Debugf("[%s] [%d] Source settings fetched: %+v", rawMsg.SourceName, rawMsg.Id, settings)
+
+	msg, err = NewLogMessageStructured(rawMsg, settings)
+	if err != nil {
+		return msg, nil, err
+	}
+
+	clog.Debugf("[%s] [%d] Structured Log Message created", rawMsg.SourceName, rawMsg.Id)
+
+	// Get all the consumers for this message (by source, or by routes)...
+	consumers, err := router.GetConsumers(msg)
+	if err != nil {
+		return msg, nil, err
+	}
+	clog.Debugf("[%s] [%d] # Consumers Fetched: %d", rawMsg.SourceName, rawMsg.Id, len(consumers))
+
+	return msg, consumers, nil
+}
+
 func ListenForLogMessageOnConsumer(c LogConsumer) error {
 
 	// Listen on the
 	ch := c.GetChannel()
 
+	// Flush the consumer periodically, so it does not depend on new logs coming in to report
+	ticker := time.NewTicker(consumerFlushInterval)
+	defer ticker.Stop()
+
 	firstMsg := true
 	for {
 		clog.Debugf("[Consumer %s] Waiting for message...", c.GetName())
-		msg := <-ch
+		var msg LogMessageStructured
+		select {
+		case msg = <-ch:
+		case now := <-ticker.C:
+			// Consumers are flushed even before their first log, e.g. to alert that it never came
+			err := c.Flush(now)
+			if err != nil {
+				clog.Errorf("[%s] Error flushing: %s", c.GetName(), err)
+			}
+			continue
+		}
 		clog.Debugf("[%s] [%d] [%s] Message received: %+v", msg.SourceName, msg.Id, c.GetName(), msg)
+
+		if msg.IsCancelSignal {
+			clog.Debugf("[%s] [%d] [%s] Cancel Signal Received", msg.SourceName, msg.Id, c.GetName())
+			// Finish even without any logs, as the flushes may have started something e.g. an absence alert
+			err := c.FinishConsumption()
+			if err != nil {
+				return err
+			}
+			break
+		}
+
 		// Prepare for consumption (call it on first message)
 		if firstMsg {
 			err := c.PrepareForConsumption(msg.T)
@@ -338,11 +432,6 @@ func ListenForLogMessageOnConsumer(c LogConsumer) error {
 			firstMsg = false
 		}
 
-		if msg.IsCancelSignal {
-			clog.Warnf("[%s] [%d] [%s] Cancel Signal Received", msg.SourceName, msg.Id, c.GetName())
-			break
-		}
-
 		err := c.ConsumeLog(msg)
 		if err != nil {
 			clog.Errorf("[%s] [%d] [%s] Error consuming log: %s", msg.SourceName, msg.Id, c.GetName(), err)
@@ -12,6 +12,8 @@ type LogMessage struct {
 	Message        string
 	Id             int64
 	IsCancelSignal bool
+	ReceivedAt     time.Time // processing time at which the log was read from its source
+	Headers        []string  // parsed with these headers instead of those of its source, if set e.g. for dead letters
 }
 
 type LogMessageStructured struct {
@@ -29,7 +31,11 @@ func NewLogMessageStructured(rawMsg LogMessage, settings LogSourceSettings) (Log
 	var msg LogMessageStructured
 
 	// Make a KV map so the log is structured
-	kv, err := settings.Format.GetKeyValueMap(rawMsg.Message, settings.Headers)
+	headers := settings.Headers
+	if len(rawMsg.Headers) > 0 {
+		headers = rawMsg.Headers
+	}
+	kv, err := settings.Format.GetKeyValueMap(rawMsg.Message, headers)
 	if err != nil {
 		return msg, fmt.Errorf("creating a key-value map for source %s: %w", rawMsg.SourceName, err)
 	}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultNotifierQueueSize is how many events can wait for a notifier. Events that come in while the queue is full are
+// dropped, so alert types never wait on a slow notifier.
+const DefaultNotifierQueueSize = 100
+
+// DefaultNotifierTimeout bounds each request of a webhook, each run of a command, and each email, when no timeout is
+// configured.
+const DefaultNotifierTimeout = 10 * time.Second
+
+// Notifier sends the events of alerts somewhere e.g. to a webhook. Notify can take its time, e.g. to retry, as each
+// notifier is sent its notifications from its own goroutine (see NotifierQueue).
+type Notifier interface {
+	Notify(n Notification) error
+	Close() error
+}
+
+// Notification is what a notifier is sent at once: the events of a group of alerts (see AlertDispatcher).
+type Notification struct {
+	Notifier    string
+	GroupKey    string
+	GroupLabels map[string]string
+	Events      []AlertEvent
+}
+
+// NewNotifierFromConfig creates the notifier for the type in the config.
+func NewNotifierFromConfig(req config.ConfigNotifier) (Notifier, error) {
+	switch req.Type {
+	case "webhook":
+		return NewWebhookNotifierFromConfig(req)
+	case "exec":
+		return NewExecNotifierFromConfig(req)
+	case "file":
+		if req.Path == "" {
+			return nil, fmt.Errorf("file notifiers need a path")
+		}
+		return NewFileNotifier(req.Path)
+	case "email":
+		return NewEmailNotifierFromConfig(req)
+	}
+	return nil, fmt.Errorf("notifier type '%s' not recognized", req.Type)
+}
+
+// getNotifierTimeout returns the configured timeout of a notifier, or the default.
+func getNotifierTimeout(req config.ConfigNotifier) (time.Duration, error) {
+	if req.TimeoutSeconds < 0 {
+		return 0, fmt.Errorf("timeout cannot be negative")
+	}
+	if req.TimeoutSeconds == 0 {
+		return DefaultNotifierTimeout, nil
+	}
+	return time.Duration(req.TimeoutSeconds * int64(time.Second)), nil
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  Q U E U E
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// NotifierQueue sends the notifications to a notifier from its own goroutine, and decides which events the notifier
+// gets: firing alerts, and by default their resolution, but not pending alerts, or alerts that are flapping.
+type NotifierQueue struct {
+	Name         string
+	Notifier     Notifier
+	SendPending  bool
+	SendResolved bool
+
+	notifications chan Notification
+	done          chan struct{}
+}
+
+func NewNotifierQueueFromConfig(req config.ConfigNotifier) (*NotifierQueue, error) {
+	if req.Name == "" {
+		return nil, fmt.Errorf("notifiers need a name")
+	}
+	n, err := NewNotifierFromConfig(req)
+	if err != nil {
+		return nil, fmt.Errorf("notifier '%s': %w", req.Name, err)
+	}
+	q := NotifierQueue{
+		Name:          req.Name,
+		Notifier:      n,
+		SendPending:   req.SendPending,
+		SendResolved:  req.SendResolved == nil || *req.SendResolved,
+		notifications: make(chan Notification, DefaultNotifierQueueSize),
+		done:          make(chan struct{}),
+	}
+	return &q, nil
+}
+
+// Start sends the queued notifications to the notifier, until the queue is closed.
+func (q *NotifierQueue) Start() {
+	go func() {
+		defer close(q.done)
+		for n := range q.notifications {
+			err := q.Notifier.Notify(n)
+			if err != nil {
+				clog.Errorf("[Notifier %s] Sending %d alerts of group %s: %s", q.Name, len(n.Events), n.GroupKey, err)
+			}
+		}
+	}()
+}
+
+// Handle queues the notification for the notifier. It does not block: if the queue is full, the notification is
+// dropped.
+func (q *NotifierQueue) Handle(n Notification) {
+	select {
+	case q.notifications <- n:
+	default:
+		clog.Warnf("[Notifier %s] Queue is full, dropping %d alerts of group %s", q.Name, len(n.Events), n.GroupKey)
+	}
+}
+
+// ShouldNotify tells if the notifier should get the event. The AlertDispatcher only sends it the events it should get.
+func (q *NotifierQueue) ShouldNotify(e AlertEvent) bool {
+	if e.Alert.Flapping {
+		return false
+	}
+	switch e.Alert.State {
+	case AlertStatePending:
+		return q.SendPending
+	case AlertStateResolved:
+		if e.Previous == AlertStatePending {
+			return q.SendPending
+		}
+		return q.SendResolved
+	}
+	return true
+}
+
+// Close waits for the queued notifications to be sent, and closes the notifier. No notifications should be handled
+// after that.
+func (q *NotifierQueue) Close() error {
+	close(q.notifications)
+	<-q.done
+	return q.Notifier.Close()
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  P A Y L O A D
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// NotificationPayload is a notification as notifiers send it, as JSON.
+type NotificationPayload struct {
+	Notifier    string              `json:"notifier"`
+	GroupKey    string              `json:"group_key"`
+	GroupLabels map[string]string   `json:"group_labels"`
+	Alerts      []AlertNotification `json:"alerts"`
+}
+
+func NewNotificationPayload(n Notification) NotificationPayload {
+	var p = NotificationPayload{Notifier: n.Notifier, GroupKey: n.GroupKey, GroupLabels: n.GroupLabels}
+	for _, e := range n.Events {
+		p.Alerts = append(p.Alerts, NewAlertNotification(e))
+	}
+	return p
+}
+
+// AlertNotification is an alert event as notifiers send it, as JSON.
+type AlertNotification struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	State         AlertState        `json:"state"`
+	PreviousState AlertState        `json:"previous_state"`
+	Severity      AlertSeverity     `json:"severity"`
+	Labels        map[string]string `json:"labels"`
+	Annotations   map[string]string `json:"annotations"`
+	Flapping      bool              `json:"flapping"`
+	ActiveAt      time.Time         `json:"active_at"`
+	StartsAt      *time.Time        `json:"starts_at,omitempty"` // if it fired
+	EndsAt        *time.Time        `json:"ends_at,omitempty"`   // if it's resolved
+	Value         float64           `json:"value"`
+	PeakValue     float64           `json:"peak_value"`
+	TriggerValue  float64           `json:"trigger_value"`
+	Time          time.Time         `json:"time"`
+}
+
+func NewAlertNotification(e AlertEvent) AlertNotification {
+	a := e.Alert
+	n := AlertNotification{
+		ID:            a.ID,
+		Name:          a.Name,
+		State:         a.State,
+		PreviousState: e.Previous,
+		Severity:      a.Severity,
+		Labels:        a.Labels,
+		Annotations:   a.Annotations,
+		Flapping:      a.Flapping,
+		ActiveAt:      a.ActiveAt,
+		Value:         a.Value,
+		PeakValue:     a.PeakValue,
+		TriggerValue:  a.TriggerValue,
+		Time:          e.Time,
+	}
+	if !a.Start.IsZero() {
+		n.StartsAt = &a.Start
+	}
+	if !a.End.IsZero() {
+		n.EndsAt = &a.End
+	}
+	return n
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  F I L E
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// FileNotifier implements Notifier by appending the events to a file, as newline delimited JSON, one per line.
+type FileNotifier struct {
+	path string
+	file *os.File
+	lock sync.Mutex
+}
+
+// NewFileNotifier opens (or creates) the file at path.
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening notification file: %w", err)
+	}
+	return &FileNotifier{path: path, file: file}, nil
+}
+
+func (n *FileNotifier) Notify(notification Notification) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var lines []byte
+	for _, e := range notification.Events {
+		line, err := json.Marshal(NewAlertNotification(e))
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	_, err := n.file.Write(lines)
+	return err
+}
+
+func (n *FileNotifier) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.file.Close()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  E M A I L
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultEmailBatchInterval is how long an email waits for more alerts after the first one, when none is configured.
+const DefaultEmailBatchInterval = 10 * time.Second
+
+// The templates of emails, when none are configured. They are rendered with an EmailData.
+const (
+	DefaultEmailSubject = `{{if eq (len .Alerts) 1}}{{with index .Alerts 0}}[{{.State}}] {{.Name}}{{end}}{{else}}{{len .Firing}} firing, {{len .Resolved}} resolved alerts{{end}}`
+
+	DefaultEmailText = `{{range .Alerts}}[{{.State}}] {{.Name}} ({{.Severity}})
+{{range $k, $v := .Labels}}  {{$k}} = {{$v}}
+{{end}}{{range $k, $v := .Annotations}}  {{$k}}: {{$v}}
+{{end}}  value {{.Value}}, peak {{.PeakValue}}
+  active since {{.ActiveAt}}{{with .StartsAt}}, fired at {{.}}{{end}}{{with .EndsAt}}, resolved at {{.}}{{end}}
+
+{{end}}`
+
+	DefaultEmailHTML = `<html><body>
+{{range .Alerts}}<h3>[{{.State}}] {{.Name}} ({{.Severity}})</h3>
+<table>
+{{range $k, $v := .Labels}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>
+{{end}}{{range $k, $v := .Annotations}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>
+{{end}}<tr><td>value</td><td>{{.Value}}, peak {{.PeakValue}}</td></tr>
+<tr><td>active since</td><td>{{.ActiveAt}}</td></tr>
+{{with .StartsAt}}<tr><td>fired at</td><td>{{.}}</td></tr>
+{{end}}{{with .EndsAt}}<tr><td>resolved at</td><td>{{.}}</td></tr>
+{{end}}</table>
+{{end}}</body></html>`
+)
+
+// EmailData is what the templates of emails are rendered with: the alerts of a batch, in the order of their events.
+type EmailData struct {
+	Alerts   []AlertNotification
+	Firing   []AlertNotification
+	Resolved []AlertNotification
+}
+
+func NewEmailData(events []AlertEvent) EmailData {
+	var d EmailData
+	for _, e := range events {
+		n := NewAlertNotification(e)
+		d.Alerts = append(d.Alerts, n)
+		switch n.State {
+		case AlertStateFiring:
+			d.Firing = append(d.Firing, n)
+		case AlertStateResolved:
+			d.Resolved = append(d.Resolved, n)
+		}
+	}
+	return d
+}
+
+// EmailNotifier implements Notifier by sending emails over SMTP, using STARTTLS if the server offers it. The alerts that
+// come in within BatchInterval of the first one are sent in the same email.
+type EmailNotifier struct {
+	Address               string
+	From                  string
+	To                    []string
+	Username              string
+	Password              string
+	RequireTLS            bool
+	TLSInsecureSkipVerify bool
+	Timeout               time.Duration
+	BatchInterval         time.Duration
+
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+
+	batch     []AlertEvent
+	timer     *time.Timer
+	lock      sync.Mutex // for the batch
+	sendLock  sync.Mutex // so emails are sent one at a time, in order
+	hostname  string
+	fromEmail string
+}
+
+func NewEmailNotifierFromConfig(req config.ConfigNotifier) (*EmailNotifier, error) {
+	if req.SMTPAddress == "" {
+		return nil, fmt.Errorf("email notifiers need an smtp address")
+	}
+	if _, _, err := net.SplitHostPort(req.SMTPAddress); err != nil {
+		return nil, fmt.Errorf("smtp address should be host:port: %w", err)
+	}
+	from, err := mail.ParseAddress(req.From)
+	if err != nil {
+		return nil, fmt.Errorf("from address: %w", err)
+	}
+	if len(req.To) == 0 {
+		return nil, fmt.Errorf("email notifiers need a to address")
+	}
+	for _, to := range req.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("to address: %w", err)
+		}
+	}
+	timeout, err := getNotifierTimeout(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.BatchSeconds < 0 {
+		return nil, fmt.Errorf("batch interval cannot be negative")
+	}
+
+	var n = EmailNotifier{
+		Address:               req.SMTPAddress,
+		From:                  req.From,
+		To:                    req.To,
+		Username:              req.Username,
+		Password:              req.Password,
+		RequireTLS:            req.RequireTLS,
+		TLSInsecureSkipVerify: req.TLSInsecureSkipVerify,
+		Timeout:               timeout,
+		BatchInterval:         DefaultEmailBatchInterval,
+		fromEmail:             from.Address,
+	}
+	if req.BatchSeconds > 0 {
+		n.BatchInterval = time.Duration(req.BatchSeconds * int64(time.Second))
+	}
+
+	n.subject, err = template.New("subject").Option("missingkey=zero").Parse(orDefault(req.Subject, DefaultEmailSubject))
+	if err != nil {
+		return nil, fmt.Errorf("subject template: %w", err)
+	}
+	n.text, err = template.New("text").Option("missingkey=zero").Parse(orDefault(req.Text, DefaultEmailText))
+	if err != nil {
+		return nil, fmt.Errorf("text template: %w", err)
+	}
+	n.html, err = htmltemplate.New("html").Option("missingkey=zero").Parse(orDefault(req.HTML, DefaultEmailHTML))
+	if err != nil {
+		return nil, fmt.Errorf("html template: %w", err)
+	}
+
+	n.hostname, _ = os.Hostname()
+	if n.hostname == "" {
+		n.hostname = "localhost"
+	}
+	return &n, nil
+}
+
+func orDefault(str, def string) string {
+	if str == "" {
+		return def
+	}
+	return str
+}
+
+// Notify adds the events to the batch, which is sent once the batch interval is over.
+func (n *EmailNotifier) Notify(notification Notification) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	first := len(n.batch) == 0
+	n.batch = append(n.batch, notification.Events...)
+	if first && len(n.batch) > 0 {
+		n.timer = time.AfterFunc(n.BatchInterval, func() {
+			if err := n.Flush(); err != nil {
+				clog.Errorf("[Email] Sending to %s: %s", strings.Join(n.To, ", "), err)
+			}
+		})
+	}
+	return nil
+}
+
+// Flush sends the batch now, if there is one.
+func (n *EmailNotifier) Flush() error {
+	n.sendLock.Lock()
+	defer n.sendLock.Unlock()
+
+	n.lock.Lock()
+	events := n.batch
+	n.batch = nil
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	n.lock.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+	msg, err := n.message(NewEmailData(events))
+	if err != nil {
+		return err
+	}
+	return n.send(msg)
+}
+
+// Close sends what's left of the batch.
+func (n *EmailNotifier) Close() error {
+	return n.Flush()
+}
+
+// message renders the email, with a text and an HTML part.
+func (n *EmailNotifier) message(data EmailData) ([]byte, error) {
+	var subject, text, html bytes.Buffer
+	if err := n.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("rendering subject: %w", err)
+	}
+	if err := n.text.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("rendering text: %w", err)
+	}
+	if err := n.html.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("rendering html: %w", err)
+	}
+
+	var msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	now := time.Now()
+	headers := []string{
+		"From: " + n.From,
+		"To: " + strings.Join(n.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())),
+		"Date: " + now.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%d.%s@%s>", now.UnixNano(), data.Alerts[0].ID, n.hostname),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	msg.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// send sends the message to the SMTP server, upgrading to TLS if the server offers it, and authenticating if there is
+// a username.
+func (n *EmailNotifier) send(msg []byte) error {
+	host, _, _ := net.SplitHostPort(n.Address)
+	conn, err := net.DialTimeout("tcp", n.Address, n.Timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(n.Timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(n.hostname); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: n.TLSInsecureSkipVerify})
+		if err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	} else if n.RequireTLS {
+		return fmt.Errorf("server does not offer STARTTLS")
+	}
+	if n.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("server does not offer AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	if err := c.Mail(n.fromEmail); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  E X E C
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ExecNotifier implements Notifier by running a command for each event of a notification, one after the other. The
+// command is given the event as JSON on its stdin (see AlertNotification), and as LOGDOG_* environment variables e.g.
+// LOGDOG_ALERT_STATE, LOGDOG_LABEL_<NAME>.
+type ExecNotifier struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func NewExecNotifierFromConfig(req config.ConfigNotifier) (*ExecNotifier, error) {
+	if len(req.Command) == 0 || req.Command[0] == "" {
+		return nil, fmt.Errorf("exec notifiers need a command")
+	}
+	timeout, err := getNotifierTimeout(req)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecNotifier{Command: req.Command, Timeout: timeout}, nil
+}
+
+func (n *ExecNotifier) Notify(notification Notification) error {
+	var errs []string
+	for _, e := range notification.Events {
+		if err := n.run(e); err != nil {
+			errs = append(errs, fmt.Sprintf("alert '%s' (%s): %s", e.Alert.Name, e.Alert.ID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// run runs the command for the event.
+func (n *ExecNotifier) run(e AlertEvent) error {
+	stdin, err := json.Marshal(NewAlertNotification(e))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.Command[0], n.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(), alertEventEnv(e)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("running %s: %w: %s", n.Command[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (n *ExecNotifier) Close() error {
+	return nil
+}
+
+// alertEventEnv returns the event as environment variables.
+func alertEventEnv(e AlertEvent) []string {
+	a := e.Alert
+	var env = []string{
+		"LOGDOG_ALERT_ID=" + a.ID,
+		"LOGDOG_ALERT_NAME=" + a.Name,
+		"LOGDOG_ALERT_STATE=" + string(a.State),
+		"LOGDOG_ALERT_PREVIOUS_STATE=" + string(e.Previous),
+		"LOGDOG_ALERT_SEVERITY=" + string(a.Severity),
+		"LOGDOG_ALERT_VALUE=" + strconv.FormatFloat(a.Value, 'f', -1, 64),
+		"LOGDOG_ALERT_PEAK_VALUE=" + strconv.FormatFloat(a.PeakValue, 'f', -1, 64),
+		"LOGDOG_ALERT_TRIGGER_VALUE=" + strconv.FormatFloat(a.TriggerValue, 'f', -1, 64),
+	}
+	for k, v := range a.Labels {
+		env = append(env, "LOGDOG_LABEL_"+envName(k)+"="+v)
+	}
+	for k, v := range a.Annotations {
+		env = append(env, "LOGDOG_ANNOTATION_"+envName(k)+"="+v)
+	}
+	return env
+}
+
+// envName turns a label or annotation name into the upper case, underscore separated form of environment variables.
+func envName(name string) string {
+	return strings.ToUpper(alertmanagerInvalidLabelChars.ReplaceAllString(name, "_"))
+}
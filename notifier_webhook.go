@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  N O T I F I E R S  -  W E B H O O K
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// WebhookFormat is the format of the payload that webhooks are sent.
+type WebhookFormat string
+
+const (
+	// WebhookFormatJSON is a NotificationPayload.
+	WebhookFormatJSON WebhookFormat = "json"
+	// WebhookFormatAlertmanager is what Alertmanager takes at /api/v2/alerts: an array of alerts with labels,
+	// annotations, startsAt and endsAt. Alertmanager has no pending alerts, so alerts that have not fired are left out.
+	WebhookFormatAlertmanager WebhookFormat = "alertmanager"
+)
+
+// ParseWebhookFormat parses the format from the config. Empty means json.
+func ParseWebhookFormat(str string) (WebhookFormat, error) {
+	switch WebhookFormat(str) {
+	case "", WebhookFormatJSON:
+		return WebhookFormatJSON, nil
+	case WebhookFormatAlertmanager:
+		return WebhookFormatAlertmanager, nil
+	}
+	return "", fmt.Errorf("webhook format '%s' not recognized", str)
+}
+
+const (
+	// DefaultWebhookMaxRetries is how many times a webhook is retried, when none is configured.
+	DefaultWebhookMaxRetries = 3
+	// DefaultWebhookRetryBackoff is the wait before the first retry of a webhook, when none is configured. It doubles
+	// with each retry, up to MaxWebhookRetryBackoff.
+	DefaultWebhookRetryBackoff = time.Second
+	MaxWebhookRetryBackoff     = time.Minute
+)
+
+// WebhookNotifier implements Notifier by POSTing the events to a URL. Requests that fail with a network error, a 429
+// or a 5xx response are retried, with a backoff.
+type WebhookNotifier struct {
+	URL          string
+	Format       WebhookFormat
+	Headers      map[string]string
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	client *http.Client
+}
+
+func NewWebhookNotifierFromConfig(req config.ConfigNotifier) (*WebhookNotifier, error) {
+	if req.URL == "" {
+		return nil, fmt.Errorf("webhook notifiers need a url")
+	}
+	format, err := ParseWebhookFormat(req.Format)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := getNotifierTimeout(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var n = WebhookNotifier{
+		URL:          req.URL,
+		Format:       format,
+		Headers:      req.Headers,
+		MaxRetries:   DefaultWebhookMaxRetries,
+		RetryBackoff: DefaultWebhookRetryBackoff,
+		client:       &http.Client{Timeout: timeout},
+	}
+	if req.MaxRetries != nil {
+		if *req.MaxRetries < 0 {
+			return nil, fmt.Errorf("max retries cannot be negative")
+		}
+		n.MaxRetries = *req.MaxRetries
+	}
+	if req.RetryBackoffSeconds < 0 {
+		return nil, fmt.Errorf("retry backoff cannot be negative")
+	}
+	if req.RetryBackoffSeconds > 0 {
+		n.RetryBackoff = time.Duration(req.RetryBackoffSeconds * int64(time.Second))
+	}
+	return &n, nil
+}
+
+func (n *WebhookNotifier) Notify(notification Notification) error {
+	body, err := n.payload(notification)
+	if err != nil || body == nil {
+		return err
+	}
+
+	backoff := n.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.MaxRetries {
+			return err
+		}
+		clog.Warnf("[Webhook] Sending to %s: %s, retrying in %s", n.URL, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MaxWebhookRetryBackoff {
+			backoff = MaxWebhookRetryBackoff
+		}
+	}
+}
+
+// post sends the body once, and tells if it's worth retrying when it fails.
+func (n *WebhookNotifier) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // so the connection can be reused
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("response status %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// payload returns the body of the request, or nil if there is nothing to send.
+func (n *WebhookNotifier) payload(notification Notification) ([]byte, error) {
+	if n.Format != WebhookFormatAlertmanager {
+		return json.Marshal(NewNotificationPayload(notification))
+	}
+	var alerts []alertmanagerAlert
+	for _, e := range notification.Events {
+		if e.Alert.Start.IsZero() {
+			continue // pending, or resolved without firing
+		}
+		alerts = append(alerts, newAlertmanagerAlert(e))
+	}
+	if len(alerts) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(alerts)
+}
+
+func (n *WebhookNotifier) Close() error {
+	n.client.CloseIdleConnections()
+	return nil
+}
+
+// alertmanagerAlert is an alert as Alertmanager takes it. An alert with an endsAt in the past is resolved.
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// alertmanagerInvalidLabelChars matches what Alertmanager does not allow in label names.
+var alertmanagerInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func newAlertmanagerAlert(e AlertEvent) alertmanagerAlert {
+	a := e.Alert
+	var labels = make(map[string]string, len(a.Labels)+1)
+	for k, v := range a.Labels {
+		labels[alertmanagerInvalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	if _, exists := labels["severity"]; !exists {
+		labels["severity"] = string(a.Severity)
+	}
+
+	am := alertmanagerAlert{
+		Labels:      labels,
+		Annotations: a.Annotations,
+		StartsAt:    a.Start,
+	}
+	if !a.End.IsZero() {
+		am.EndsAt = &a.End
+	}
+	return am
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  L O G  P R O C E S S O R
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// LogProcessor holds everything that handles the log messages once they are in the queue: the listener that makes them
+// structured, the router, the LogConsumers, the alert dispatcher and notifiers, and the dead letter sink. It knows how to start all the
+// goroutines, and how to drain them in order when we're shutting down.
+type LogProcessor struct {
+	Queue       chan LogMessage
+	Router      *LogRouter
+	Consumers   []LogConsumer
+	Dispatcher  *AlertDispatcher
+	Notifiers   []*NotifierQueue
+	DeadLetters DeadLetterSink
+
+	listenerDone chan struct{}
+	consumersWg  sync.WaitGroup
+}
+
+// NewLogProcessorFromConfig creates the queue, the LogConsumers, the alert dispatcher and notifiers, the router and the
+// dead letter sink from the config. The consumers are registered in the store. LogSources should already be registered.
+func NewLogProcessorFromConfig(cfg config.Config) (*LogProcessor, error) {
+	var p LogProcessor
+
+	// Create a channel that can be used to push messages from log sources to the listener
+	p.Queue = CreateQueue(cfg.InQueueBufferSize)
+
+	// - Register Stats types: these define what kind of stats do keep track of
+	clog.Debugf("Stats Types: %v", cfg.Stats.Types)
+	for _, st := range cfg.Stats.Types {
+		if st.Disabled {
+			continue
+		}
+
+		// Get the Stats LogConsumer instance
+		c, err := NewStatsTypeFromConfig(st)
+		if err != nil {
+			return nil, err
+		}
+
+		// Store the LogConsumer in memory for shared access
+		err = RegisterConsumerInStore(c)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Consumers = append(p.Consumers, c)
+	}
+
+	// - Create the Notifiers: these are where the alerts are sent, by name
+	var notifiers = make(map[string]*NotifierQueue)
+	var disabledNotifiers = make(map[string]bool)
+	for _, n := range cfg.Notifiers {
+		if _, exists := notifiers[n.Name]; exists || disabledNotifiers[n.Name] {
+			return nil, fmt.Errorf("notifier '%s' is defined more than once", n.Name)
+		}
+		if n.Disabled {
+			disabledNotifiers[n.Name] = true
+			continue
+		}
+		q, err := NewNotifierQueueFromConfig(n)
+		if err != nil {
+			return nil, err
+		}
+		notifiers[n.Name] = q
+		p.Notifiers = append(p.Notifiers, q)
+	}
+
+	// - Create the Alert Dispatcher: it groups, deduplicates and inhibits the alerts on their way to the notifiers
+	dispatcher, err := NewAlertDispatcherFromConfig(cfg.AlertRouting)
+	if err != nil {
+		return nil, fmt.Errorf("creating alert dispatcher: %w", err)
+	}
+	p.Dispatcher = dispatcher
+
+	// - Register Alert Types: these define what kind of alerts do we keep track of
+	clog.Debugf("Alert Types: %v", cfg.Alert.Types)
+	for _, at := range cfg.Alert.Types {
+		if at.Disabled {
+			continue
+		}
+
+		// Get the Alert LogConsumer instance
+		c, err := NewAlertTypeFromConfig(at)
+		if err != nil {
+			return nil, err
+		}
+
+		// Send the events of its alerts to its notifiers, through the dispatcher, which tracks all of them
+		c.AddEventHandler(p.Dispatcher.Track)
+		for _, name := range at.Notifiers {
+			if disabledNotifiers[name] {
+				clog.Warnf("[%s] Notifier '%s' is disabled, alerts will not be sent to it", at.Name, name)
+				continue
+			}
+			q, exists := notifiers[name]
+			if !exists {
+				return nil, fmt.Errorf("alert type '%s': notifier '%s' not found", at.Name, name)
+			}
+			c.AddEventHandler(p.Dispatcher.Handler(q))
+		}
+
+		// Store the LogConsumer in memory for shared access
+		err = RegisterConsumerInStore(c)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Consumers = append(p.Consumers, c)
+	}
+
+	// - Create the router that decides which consumers get which log message
+	p.Router, err = NewLogRouterFromConfig(cfg.Routing)
+	if err != nil {
+		return nil, fmt.Errorf("creating log router: %w", err)
+	}
+
+	// - Create the sink where log lines that cannot be processed go
+	p.DeadLetters, err = NewDeadLetterSinkFromConfig(cfg.DeadLetter)
+	if err != nil {
+		return nil, fmt.Errorf("creating dead letter sink: %w", err)
+	}
+
+	return &p, nil
+}
+
+// Start starts the goroutines that listen on the queue and on the consumer channels.
+func (p *LogProcessor) Start() {
+
+	// - Start the Log Listener in a goroutine
+	p.listenerDone = make(chan struct{})
+	go func() {
+		defer close(p.listenerDone)
+		err := ListenToLogSources(p.Queue, p.Router, p.DeadLetters)
+		if err != nil {
+			clog.Errorf("Listening to log sources: %s", err)
+		}
+	}()
+
+	// - Start sending to the notifiers, before any alert can fire
+	for _, n := range p.Notifiers {
+		n.Start()
+	}
+
+	// - For each LogConsumer, we need to start a listener go routine that received log messages for them
+	for _, c := range p.Consumers {
+		p.consumersWg.Add(1)
+		go func(c LogConsumer) {
+			defer p.consumersWg.Done()
+			err := ListenForLogMessageOnConsumer(c)
+			if err != nil {
+				clog.Warnf("[Consumer %s] Listening for messages: %s", c.GetName(), err)
+			}
+		}(c)
+	}
+}
+
+// Drain shuts the processor down in order. It should only be called once nothing else is sending to the queue. It:
+// 1) sends a cancel signal through the queue, so every message already in it gets processed and sent to the consumers,
+// 2) sends a cancel signal to every consumer, after which they flush their final stats windows and resolve their alerts,
+// 3) has the dispatcher send the alerts that are waiting for their group, waits for the notifiers to send the alerts
+// that are still queued, and closes them,
+// 4) closes the dead letter sink.
+// If all of that does not finish before the deadline, it gives up and returns an error.
+func (p *LogProcessor) Drain(deadline time.Time) error {
+	var drained = make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		clog.Debugf("Draining the queue...")
+		p.Queue <- LogMessage{IsCancelSignal: true}
+		<-p.listenerDone
+
+		clog.Debugf("Draining the consumers...")
+		for _, c := range p.Consumers {
+			c.GetChannel() <- LogMessageStructured{LogMessage: LogMessage{IsCancelSignal: true}}
+		}
+		p.consumersWg.Wait()
+
+		clog.Debugf("Draining the notifiers...")
+		p.Dispatcher.Close()
+		for _, n := range p.Notifiers {
+			if err := n.Close(); err != nil {
+				clog.Warnf("[Notifier %s] Closing: %s", n.Name, err)
+			}
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		// The dead letters written so far should not be lost with the rest
+		if err := p.DeadLetters.Close(); err != nil {
+			clog.Warnf("Closing the dead letters: %s", err)
+		}
+		return fmt.Errorf("timed out draining the log processor, some messages may not have been processed")
+	}
+
+	return p.DeadLetters.Close()
+}
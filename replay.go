@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  R E P L A Y  D E A D  L E T T E R S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ReplayArgs holds the command line arguments for the `replay-dlq` sub-command
+type ReplayArgs struct {
+	// ConfigFilePath is the file path where config file for this application lives
+	ConfigFilePath string
+	// DeadLetterFilePath is the dead letter file to replay. Defaults to the dead letter path in the config.
+	DeadLetterFilePath string
+}
+
+// runReplayDeadLetters re-feeds dead letters into the processor, as if they were coming from their original sources.
+// Usually done after the config has been fixed. The rotated backups of the file (`<path>.1`, `<path>.2` ...) are replayed
+// too, oldest first. Once the config has been set up, the replayed files are moved to `<file>.replayed`, so lines that
+// fail again end up in a fresh dead letter file. If the config cannot be set up, the files are left where they are.
+func runReplayDeadLetters(argv []string) error {
+	var args ReplayArgs
+	fs := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	fs.StringVar(&args.ConfigFilePath, "config-file", "", "Path to the config file in TOML format (required)")
+	fs.StringVar(&args.DeadLetterFilePath, "dlq-file", "", "Path to the dead letter file to replay, along with its rotated backups <file>.1, <file>.2 ... (defaults to the dead_letter path in the config)")
+	fs.Parse(argv)
+
+	cfg, err := config.ReadConfigTOML(args.ConfigFilePath)
+	if err != nil {
+		return fmt.Errorf("uploading config file at %s: %w", args.ConfigFilePath, err)
+	}
+
+	path := args.DeadLetterFilePath
+	if path == "" {
+		path = cfg.DeadLetter.Path
+	}
+	if path == "" {
+		return fmt.Errorf("no dead letter file provided, and no dead letter path in the config")
+	}
+
+	files := getDeadLetterFiles(path)
+	var dls []DeadLetter
+	for _, file := range files {
+		fileDLs, err := ReadDeadLetterFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		dls = append(dls, fileDLs...)
+	}
+
+	// Sources are needed for their settings, but they are not read from
+	_, err = setupSources(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The files are moved before the processor opens the dead letter sink, which may be at the same path
+	err = moveDeadLetterFiles(files, "", ".replayed")
+	if err != nil {
+		return err
+	}
+	processor, err := NewLogProcessorFromConfig(cfg)
+	if err != nil {
+		if err := moveDeadLetterFiles(files, ".replayed", ""); err != nil {
+			clog.Errorf("Moving back the dead letter files: %s", err)
+		}
+		return err
+	}
+	clog.Infof("Replaying %d dead letter(s) from %d file(s) at %s", len(dls), len(files), path)
+	processor.Start()
+
+	for _, dl := range dls {
+		processor.Queue <- LogMessage{SourceName: dl.SourceName, Message: dl.Message, Id: dl.Id, Headers: getReplayHeaders(dl)}
+	}
+
+	err = processor.Drain(time.Now().Add(cfg.GetShutdownTimeout()))
+	if err != nil {
+		return err
+	}
+
+	var numFailed int
+	for _, cnt := range GetSourceErrorCountsFromStore() {
+		numFailed += cnt
+	}
+	logSourceErrorCounts()
+	clog.Noticef("Replayed %d dead letter(s), %d failed again", len(dls), numFailed)
+
+	return nil
+}
+
+// getDeadLetterFiles returns the dead letter file at path, and its rotated backups before it, oldest first.
+func getDeadLetterFiles(path string) []string {
+	var files = []string{path}
+	for i := 1; ; i++ {
+		backup := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		files = append([]string{backup}, files...)
+	}
+	return files
+}
+
+// moveDeadLetterFiles renames each of the files from file+fromSuffix to file+toSuffix. If one of them cannot be renamed,
+// the ones that were are renamed back.
+func moveDeadLetterFiles(files []string, fromSuffix, toSuffix string) error {
+	for i, file := range files {
+		err := os.Rename(file+fromSuffix, file+toSuffix)
+		if err == nil {
+			continue
+		}
+		for _, moved := range files[:i] {
+			os.Rename(moved+toSuffix, moved+fromSuffix)
+		}
+		return fmt.Errorf("moving dead letter file: %w", err)
+	}
+	return nil
+}
+
+// getReplayHeaders returns the headers recorded in the dead letter, if its source still learns its headers from the
+// first line. Since the source is not read during a replay, it would otherwise not have any headers. Each dead letter is
+// parsed with its own headers, as the files that are replayed together may have been recorded under different ones.
+func getReplayHeaders(dl DeadLetter) []string {
+	if len(dl.Headers) < 1 {
+		return nil
+	}
+	src, err := GetSourceFromStore(dl.SourceName)
+	if err != nil {
+		// The message will be sent to dead letters again
+		return nil
+	}
+	if !src.GetSettings().UseFirstlineAsHeader {
+		return nil
+	}
+	return dl.Headers
+}
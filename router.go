@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  L O G  R O U T E R
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// LogRouter decides which LogConsumers a structured log message should be delivered to. Without any routes, messages are
+// delivered by source name (i.e. to every consumer that has source settings for the message's source). With routes, each
+// route is evaluated in order and a matching route delivers the message to its consumers. A matching route stops the
+// evaluation unless it is marked to continue. A route whose filter cannot be evaluated for a message does not match it.
+// Messages that match no route go to the default consumers, or if none are configured, are delivered by source name.
+type LogRouter struct {
+	Routes           []LogRoute
+	DefaultConsumers []LogConsumer
+}
+
+// LogRoute is a single routing rule.
+type LogRoute struct {
+	Name      string
+	Sources   map[string]bool // if empty, the route applies to messages from all sources
+	Filter    *FilterExpr     // if nil, the route matches all messages (from the sources above)
+	Consumers []LogConsumer
+	Continue  bool // if true, evaluation continues with the next route even if this one matches
+}
+
+// NewLogRouterFromConfig creates a LogRouter from the config. It should be called after all the LogConsumers have been
+// registered in the store, since routes refer to consumers by name.
+func NewLogRouterFromConfig(req config.ConfigRouting) (*LogRouter, error) {
+	var r LogRouter
+
+	for i, cfgRoute := range req.Routes {
+		name := cfgRoute.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		route := LogRoute{
+			Name:     name,
+			Sources:  make(map[string]bool),
+			Continue: cfgRoute.Continue,
+		}
+		for _, srcName := range cfgRoute.Sources {
+			route.Sources[srcName] = true
+		}
+
+		var err error
+		route.Filter, err = CompileFilter(cfgRoute.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", name, err)
+		}
+
+		if len(cfgRoute.Consumers) < 1 {
+			return nil, fmt.Errorf("route '%s': no consumers provided", name)
+		}
+		route.Consumers, err = getConsumersByNames(cfgRoute.Consumers)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", name, err)
+		}
+
+		r.Routes = append(r.Routes, route)
+	}
+
+	var err error
+	r.DefaultConsumers, err = getConsumersByNames(req.DefaultConsumers)
+	if err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+
+	return &r, nil
+}
+
+func getConsumersByNames(names []string) ([]LogConsumer, error) {
+	var consumers []LogConsumer
+	for _, n := range names {
+		c, err := GetConsumerByNameFromStore(n)
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, c)
+	}
+	return consumers, nil
+}
+
+// GetConsumers returns all the LogConsumers that the message should be delivered to. A consumer is only returned once,
+// even if multiple routes lead to it.
+func (r *LogRouter) GetConsumers(msg LogMessageStructured) ([]LogConsumer, error) {
+	if r == nil || (len(r.Routes) < 1 && len(r.DefaultConsumers) < 1) {
+		return GetConsumersBySourceFromStore(msg.SourceName), nil
+	}
+
+	var consumers []LogConsumer
+	var seen = make(map[string]bool)
+	var matched bool
+
+	for _, route := range r.Routes {
+		if len(route.Sources) > 0 && !route.Sources[msg.SourceName] {
+			continue
+		}
+		// In a mixed stream, a filter may not make sense for some of the logs e.g. section(request) for the logs that have
+		// no request line, so an error is the same as no match
+		ok, err := route.Filter.Match(msg.KV)
+		if err != nil {
+			clog.Debugf("[%s] [%d] Route %s: %s", msg.SourceName, msg.Id, route.Name, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		clog.Debugf("[%s] [%d] Route matched: %s", msg.SourceName, msg.Id, route.Name)
+		matched = true
+		consumers = appendRoutableConsumers(consumers, seen, route.Consumers, msg.SourceName)
+
+		if !route.Continue {
+			break
+		}
+	}
+
+	if matched {
+		return consumers, nil
+	}
+
+	// Default route
+	if len(r.DefaultConsumers) > 0 {
+		return appendRoutableConsumers(consumers, seen, r.DefaultConsumers, msg.SourceName), nil
+	}
+	return GetConsumersBySourceFromStore(msg.SourceName), nil
+}
+
+// appendRoutableConsumers adds the consumers that haven't been seen yet. Consumers that do not have settings for the
+// source of the message would not know how to handle it, so they are skipped.
+func appendRoutableConsumers(consumers []LogConsumer, seen map[string]bool, candidates []LogConsumer, srcName string) []LogConsumer {
+	for _, c := range candidates {
+		if seen[c.GetName()] {
+			continue
+		}
+		if _, err := c.GetSourceSettings(srcName); err != nil {
+			clog.Debugf("[%s] Consumer '%s' has no settings for the source, skipping", srcName, c.GetName())
+			continue
+		}
+		seen[c.GetName()] = true
+		consumers = append(consumers, c)
+	}
+	return consumers
+}
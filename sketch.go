@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S K E T C H  -  Q U A N T I L E S  ( D D S K E T C H )
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// DefaultSketchRelativeAccuracy is the relative accuracy of the quantiles returned by a DDSketch e.g. with 0.01, a p99
+// of 200ms is reported somewhere between 198ms and 202ms.
+const DefaultSketchRelativeAccuracy = 0.01
+
+// DefaultSketchMaxBuckets bounds the memory used by a DDSketch. With 1% accuracy, 2048 buckets cover values from 1 to
+// ~10^17 without losing any accuracy. If more buckets are needed, the lowest ones are collapsed, so only the accuracy
+// of the lowest quantiles suffers.
+const DefaultSketchMaxBuckets = 2048
+
+// minSketchIndexableValue is the smallest absolute value that gets its own bucket. Anything smaller counts as zero.
+const minSketchIndexableValue = 1e-9
+
+// DDSketch is a mergeable quantile sketch (https://arxiv.org/abs/1908.10693). Values are put into buckets whose
+// boundaries grow exponentially, so that any quantile can be estimated within a relative accuracy, using bounded
+// memory. Sketches with the same accuracy can be merged, which lets us combine windows.
+type DDSketch struct {
+	RelativeAccuracy float64
+	MaxBuckets       int
+	gamma            float64
+	logGamma         float64
+
+	Positive  map[int]int // bucket index -> count, for positive values
+	Negative  map[int]int // bucket index -> count, for negative values (by their absolute value)
+	ZeroCount int
+	Count     int
+	Min       float64
+	Max       float64
+}
+
+// NewDDSketch creates an empty sketch with the given relative accuracy and bucket limit.
+func NewDDSketch(relativeAccuracy float64, maxBuckets int) *DDSketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &DDSketch{
+		RelativeAccuracy: relativeAccuracy,
+		MaxBuckets:       maxBuckets,
+		gamma:            gamma,
+		logGamma:         math.Log(gamma),
+		Positive:         make(map[int]int),
+		Negative:         make(map[int]int),
+		Min:              math.Inf(1),
+		Max:              math.Inf(-1),
+	}
+}
+
+func (s *DDSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+func (s *DDSketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// Add adds a value to the sketch.
+func (s *DDSketch) Add(v float64) {
+	switch {
+	case v > minSketchIndexableValue:
+		s.Positive[s.index(v)]++
+		s.collapse(s.Positive)
+	case v < -minSketchIndexableValue:
+		s.Negative[s.index(-v)]++
+		s.collapse(s.Negative)
+	default:
+		s.ZeroCount++
+	}
+	s.Count++
+	s.Min = math.Min(s.Min, v)
+	s.Max = math.Max(s.Max, v)
+}
+
+// collapse merges the lowest buckets of the store until it is within the bucket limit.
+func (s *DDSketch) collapse(store map[int]int) {
+	for len(store) > s.MaxBuckets {
+		indexes := sortedSketchIndexes(store)
+		store[indexes[1]] += store[indexes[0]]
+		delete(store, indexes[0])
+	}
+}
+
+// Merge adds all the values of the other sketch to this one. Both sketches need to have the same accuracy.
+func (s *DDSketch) Merge(other *DDSketch) error {
+	if other == nil {
+		return nil
+	}
+	if s.RelativeAccuracy != other.RelativeAccuracy {
+		return fmt.Errorf("cannot merge sketches with different accuracies: %v and %v", s.RelativeAccuracy, other.RelativeAccuracy)
+	}
+	for i, cnt := range other.Positive {
+		s.Positive[i] += cnt
+	}
+	for i, cnt := range other.Negative {
+		s.Negative[i] += cnt
+	}
+	s.collapse(s.Positive)
+	s.collapse(s.Negative)
+	s.ZeroCount += other.ZeroCount
+	s.Count += other.Count
+	s.Min = math.Min(s.Min, other.Min)
+	s.Max = math.Max(s.Max, other.Max)
+	return nil
+}
+
+// Quantile returns the estimated value at quantile q (between 0 and 1). The bool is false if the sketch is empty.
+func (s *DDSketch) Quantile(q float64) (float64, bool) {
+	if s.Count < 1 || q < 0 || q > 1 {
+		return 0, false
+	}
+
+	rank := q * float64(s.Count-1)
+	var seen int
+
+	// Negative values, from the most negative (highest index) to the least
+	negIndexes := sortedSketchIndexes(s.Negative)
+	for i := len(negIndexes) - 1; i >= 0; i-- {
+		seen += s.Negative[negIndexes[i]]
+		if float64(seen) > rank {
+			return s.clamp(-s.value(negIndexes[i])), true
+		}
+	}
+
+	seen += s.ZeroCount
+	if float64(seen) > rank {
+		return s.clamp(0), true
+	}
+
+	for _, i := range sortedSketchIndexes(s.Positive) {
+		seen += s.Positive[i]
+		if float64(seen) > rank {
+			return s.clamp(s.value(i)), true
+		}
+	}
+
+	return s.Max, true
+}
+
+// clamp makes sure the estimate is not outside the values we've actually seen.
+func (s *DDSketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+func sortedSketchIndexes(store map[int]int) []int {
+	var indexes []int
+	for i := range store {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -56,6 +56,13 @@ func NewLogSourceFromConfig(req config.ConfigLogSource) (LogSource, error) {
 
 }
 
+// IsLiveSource tells if the logs of the source are read as they are written, e.g. from Std. In, rather than replayed
+// from an existing file.
+func IsLiveSource(src LogSource) bool {
+	_, ok := src.(StdInSource)
+	return ok
+}
+
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
 *  L O G   S O U R C E  -  F I L E
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
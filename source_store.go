@@ -62,3 +62,36 @@ func IsSourceRegisteredInStore(name string) bool {
 	}
 	return false
 }
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+*  L O G   S O U R C E  E R R O R S - S T O R E
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// SourceErrorStore keeps count of the log lines, per LogSource, that could not be processed.
+type SourceErrorStore struct {
+	Data map[string]int
+	Lock sync.RWMutex
+}
+
+var sourceErrorStore SourceErrorStore
+
+func IncrementSourceErrorCountInStore(name string) {
+	sourceErrorStore.Lock.Lock()
+	defer sourceErrorStore.Lock.Unlock()
+
+	if sourceErrorStore.Data == nil {
+		sourceErrorStore.Data = make(map[string]int)
+	}
+	sourceErrorStore.Data[name]++
+}
+
+func GetSourceErrorCountsFromStore() map[string]int {
+	sourceErrorStore.Lock.RLock()
+	defer sourceErrorStore.Lock.RUnlock()
+
+	var counts = make(map[string]int)
+	for k, v := range sourceErrorStore.Data {
+		counts[k] = v
+	}
+	return counts
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,20 +19,319 @@ import (
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
 
 // StatsType implements a LogConsumer. It has the power to keep track of counts for periodic intervals.
+//
+// Logs are counted in tumbling windows ("panes") of Advance each. For tumbling windows, Advance is zero, panes are the
+// Duration long, and each pane is reported on its own. For hopping and sliding windows, Advance is shorter than the Duration, and each
+// report merges the panes of the last Duration, so a window is reported every Advance.
+//
+// Only the latest windows are kept in memory, in a ring buffer (see StatsWindowRing): once a window has been reported
+// (and with it, every window it's part of), it's evicted when there are more than RetentionWindows windows, or when it's
+// older than RetentionAge. Evicted windows are handed to the Archiver, if any.
+//
+// A window is reported once the watermark passes its end. The watermark is the earliest of the latest event times seen
+// from each source, minus the allowed lateness. Logs that belong to a window which has already been reported are handled
+// according to the LatePolicy. Windows are also reported when no logs come in: with the processing Clock, a source that
+// has gone quiet is assumed to have moved on as much as the wall clock has since its latest log, so Flush reports the
+// windows without any logs as empty.
 type StatsType struct {
-	Duration time.Duration
+	Duration         time.Duration
+	WindowKind       StatsWindowKind
+	Advance          time.Duration  // how often hopping and sliding windows are reported, which is also the size of the panes
+	Align            bool           // whether panes are aligned to multiples of Advance since the epoch, in Location
+	Location         *time.Location // the timezone used for aligning panes
+	AllowedLateness  time.Duration
+	LatePolicy       StatsLatePolicy
+	Clock            StatsClock
+	Aggregations     []StatsAggregation // aggregations computed for each key value, e.g. sum(bytes)
+	GroupBy          []*ValueExpr       // if set, logs are counted by the combination of these values, instead of the key
+	ReportFormat     StatsReportFormat  // how the groups are shown in the report, if there is a group by
+	TopN             int                // number of key values shown in a report
+	BreakdownTopN    map[string]int     // number of values shown in a report per breakdown key, defaults to TopN
+	Counter          StatsCounterMode   // how the key values and the breakdown values are counted
+	CounterCapacity  int                // number of values kept per counter, for StatsCounterSpaceSaving
+	RetentionWindows int                // number of windows kept in memory, 0 or less for no limit
+	RetentionAge     time.Duration      // how long windows are kept in memory after they end, 0 for no limit
+	Archiver         StatsWindowArchiver
+	Rollups          []*StatsRollup  // coarser resolutions, each fed by the complete windows of the one before
+	ComparePrevious  bool            // whether the counts are compared to the previous window in the reports
+	CompareOffsets   []time.Duration // the counts are also compared to the windows this long before, e.g. a day
 	baseLogConsumer
 
-	Windows             []StatsWindow // Each window holds data on a given time-frame
-	CurrentPointer      int           // points to the current window in the above Store
+	numericFields  []string        // fields that are read as numbers for the aggregations
+	sketchFields   map[string]bool // numeric fields that also need a quantile sketch
+	distinctFields []string        // fields whose distinct values are counted
+
+	Windows             StatsWindowRing // Each window holds data on a given time-frame (pane)
+	CurrentPointer      int             // points to the current window in the above Store
 	QueuedNotifications []int
 	LatestTimestamp     time.Time
+	SourceLatestTimes   map[string]time.Time // latest event time seen per source, used for the watermark
+	SourceLatestArrival map[string]time.Time // processing time at which the latest log of each source was read
+	ProcessingTime      time.Time            // latest processing time seen, from the logs or from Flush
+	LateCount           int                  // number of logs that arrived after their window was reported
+	EvictedCount        int                  // number of windows evicted from memory
+}
+
+// StatsWindowArchiver is handed the windows of a stats type as they are evicted from memory, e.g. to persist them.
+type StatsWindowArchiver interface {
+	ArchiveStatsWindow(statsTypeName string, w StatsWindow) error
 }
 
+// StatsWindowFileArchiver implements StatsWindowArchiver by appending the windows to a file, as newline delimited JSON,
+// one per line, with the count of each value.
+type StatsWindowFileArchiver struct {
+	path    string
+	grouped bool // whether the values are groups, which are archived as the list of their values
+	file    *os.File
+	lock    sync.Mutex
+}
+
+// statsArchivedWindow is an evicted window as the StatsWindowFileArchiver writes it.
+type statsArchivedWindow struct {
+	StatsType string               `json:"stats_type"`
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	Counts    []statsArchivedCount `json:"counts"`
+	LateCount int                  `json:"late_count"`
+}
+
+type statsArchivedCount struct {
+	Value      string   `json:"value,omitempty"`
+	Group      []string `json:"group,omitempty"`
+	Count      int      `json:"count"`
+	CountError int      `json:"count_error,omitempty"`
+}
+
+// NewStatsWindowFileArchiver opens (or creates) the file at path.
+func NewStatsWindowFileArchiver(path string, grouped bool) (*StatsWindowFileArchiver, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening stats archive file: %w", err)
+	}
+	return &StatsWindowFileArchiver{path: path, grouped: grouped, file: file}, nil
+}
+
+func (a *StatsWindowFileArchiver) ArchiveStatsWindow(statsTypeName string, w StatsWindow) error {
+	record := statsArchivedWindow{StatsType: statsTypeName, Start: w.Start, End: w.End, LateCount: w.LateCount}
+	for value, stats := range w.StatsMap {
+		count := statsArchivedCount{Value: value, Count: stats.Count, CountError: stats.CountError}
+		if a.grouped {
+			count.Value, count.Group = "", splitGroupKey(value)
+		}
+		record.Counts = append(record.Counts, count)
+	}
+	sort.Slice(record.Counts, func(i, j int) bool {
+		if record.Counts[i].Count != record.Counts[j].Count {
+			return record.Counts[i].Count > record.Counts[j].Count
+		}
+		return fmt.Sprint(record.Counts[i].Value, record.Counts[i].Group) < fmt.Sprint(record.Counts[j].Value, record.Counts[j].Group)
+	})
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+func (a *StatsWindowFileArchiver) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+// StatsLatePolicy determines what happens to logs that belong to a window which has already been reported.
+type StatsLatePolicy string
+
+const (
+	// StatsLatePolicyDrop ignores late logs (they are only counted in StatsType.LateCount).
+	StatsLatePolicyDrop StatsLatePolicy = "drop"
+	// StatsLatePolicyCount counts late logs in the 'late' bucket of the latest window, which shows up in its report.
+	StatsLatePolicyCount StatsLatePolicy = "count"
+	// StatsLatePolicyReemit adds late logs to their window, and reports the corrected window again.
+	StatsLatePolicyReemit StatsLatePolicy = "reemit"
+)
+
+// StatsClock determines what moves the windows of a stats type along, and so when they are reported.
+type StatsClock string
+
+const (
+	// StatsClockAuto uses the processing clock if any of the sources is live (see IsLiveSource), and the event clock
+	// otherwise.
+	StatsClockAuto StatsClock = "auto"
+	// StatsClockEvent only moves the watermark with the event times of the logs, so replaying a file gives the same
+	// reports however fast it's read.
+	StatsClockEvent StatsClock = "event"
+	// StatsClockProcessing also moves the watermark with the wall clock when sources go quiet, so the latest windows
+	// are reported, even without any logs.
+	StatsClockProcessing StatsClock = "processing"
+)
+
+// StatsWindowKind determines how the windows of a stats type relate to each other.
+type StatsWindowKind string
+
+const (
+	// StatsWindowTumbling windows follow each other without overlap.
+	StatsWindowTumbling StatsWindowKind = "tumbling"
+	// StatsWindowHopping windows overlap: a window of Duration is reported every Advance.
+	StatsWindowHopping StatsWindowKind = "hopping"
+	// StatsWindowSliding windows are hopping windows that move on every DefaultStatsSlidingAdvance by default, so
+	// each report covers the last Duration as closely as possible.
+	StatsWindowSliding StatsWindowKind = "sliding"
+)
+
+// DefaultStatsSlidingAdvance is the advance of sliding windows when none is configured.
+const DefaultStatsSlidingAdvance = time.Second
+
+// DefaultStatsAllowedLateness is the allowed lateness used when none is configured.
+const DefaultStatsAllowedLateness = 2 * time.Second
+
+// DefaultStatsRetentionWindows is the number of windows kept in memory when none is configured.
+const DefaultStatsRetentionWindows = 100
+
+// DefaultStatsTopN is the number of key values shown in a report when none is configured.
+const DefaultStatsTopN = 5
+
 func NewStatsTypeFromConfig(req config.ConfigStatsType) (*StatsType, error) {
 	var c = StatsType{
-		Duration: time.Duration(req.DurationSeconds * int64(time.Second)),
+		Duration:            time.Duration(req.DurationSeconds * int64(time.Second)),
+		WindowKind:          StatsWindowTumbling,
+		Align:               req.AlignWindows,
+		Location:            time.UTC,
+		AllowedLateness:     DefaultStatsAllowedLateness,
+		LatePolicy:          StatsLatePolicyDrop,
+		Clock:               StatsClockAuto,
+		TopN:                DefaultStatsTopN,
+		BreakdownTopN:       req.BreakdownTopN,
+		CounterCapacity:     DefaultStatsCounterCapacity,
+		RetentionWindows:    DefaultStatsRetentionWindows,
+		RetentionAge:        time.Duration(req.RetentionSeconds * int64(time.Second)),
+		SourceLatestTimes:   make(map[string]time.Time),
+		SourceLatestArrival: make(map[string]time.Time),
+	}
+	if req.AllowedLatenessSeconds != nil {
+		if *req.AllowedLatenessSeconds < 0 {
+			return nil, fmt.Errorf("stats type '%s': allowed lateness cannot be negative", req.Name)
+		}
+		c.AllowedLateness = time.Duration(*req.AllowedLatenessSeconds * int64(time.Second))
 	}
+	switch StatsWindowKind(req.Window) {
+	case "", StatsWindowTumbling:
+	case StatsWindowHopping:
+		c.WindowKind = StatsWindowHopping
+		c.Advance = time.Duration(req.AdvanceSeconds * int64(time.Second))
+	case StatsWindowSliding:
+		c.WindowKind = StatsWindowSliding
+		c.Advance = DefaultStatsSlidingAdvance
+		if req.AdvanceSeconds != 0 {
+			c.Advance = time.Duration(req.AdvanceSeconds * int64(time.Second))
+		}
+	default:
+		return nil, fmt.Errorf("stats type '%s': window '%s' not recognized", req.Name, req.Window)
+	}
+	// Windows are made of whole panes, so the duration needs to be a multiple of the advance
+	if c.WindowKind != StatsWindowTumbling {
+		if c.Advance <= 0 || c.Advance > c.Duration || c.Duration%c.Advance != 0 {
+			return nil, fmt.Errorf("stats type '%s': the duration of %s windows should be a multiple of the advance", req.Name, c.WindowKind)
+		}
+	}
+	if req.Timezone != "" {
+		loc, err := time.LoadLocation(req.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("stats type '%s': timezone: %w", req.Name, err)
+		}
+		c.Location = loc
+	}
+
+	switch StatsLatePolicy(req.LatePolicy) {
+	case "":
+	case StatsLatePolicyDrop, StatsLatePolicyCount, StatsLatePolicyReemit:
+		c.LatePolicy = StatsLatePolicy(req.LatePolicy)
+	default:
+		return nil, fmt.Errorf("stats type '%s': late policy '%s' not recognized", req.Name, req.LatePolicy)
+	}
+	switch StatsClock(req.Clock) {
+	case "":
+	case StatsClockAuto, StatsClockEvent, StatsClockProcessing:
+		c.Clock = StatsClock(req.Clock)
+	default:
+		return nil, fmt.Errorf("stats type '%s': clock '%s' not recognized", req.Name, req.Clock)
+	}
+
+	if req.TopN != 0 {
+		c.TopN = req.TopN
+	}
+	if req.RetentionWindows != 0 {
+		c.RetentionWindows = req.RetentionWindows
+	}
+	if c.RetentionAge < 0 {
+		return nil, fmt.Errorf("stats type '%s': retention seconds cannot be negative", req.Name)
+	}
+	if req.ArchivePath != "" {
+		archiver, err := NewStatsWindowFileArchiver(req.ArchivePath, len(req.GroupBy) > 0)
+		if err != nil {
+			return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+		}
+		c.Archiver = archiver
+	}
+	if req.CounterCapacity != 0 {
+		c.CounterCapacity = req.CounterCapacity
+	}
+	var err error
+	c.Counter, err = ParseStatsCounterMode(req.Counter)
+	if err != nil {
+		return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+	}
+	if c.CounterCapacity < 1 {
+		return nil, fmt.Errorf("stats type '%s': counter capacity should be positive", req.Name)
+	}
+	// With a Space-Saving counter, we can't report more values than we keep
+	if c.Counter == StatsCounterSpaceSaving {
+		if c.TopN < 1 || c.TopN > c.CounterCapacity {
+			return nil, fmt.Errorf("stats type '%s': top n should be between 1 and the counter capacity (%d)", req.Name, c.CounterCapacity)
+		}
+		for k, n := range c.BreakdownTopN {
+			if n < 1 || n > c.CounterCapacity {
+				return nil, fmt.Errorf("stats type '%s': top n for breakdown '%s' should be between 1 and the counter capacity (%d)", req.Name, k, c.CounterCapacity)
+			}
+		}
+	}
+
+	c.Aggregations, err = ParseStatsAggregations(req.Aggregations)
+	if err != nil {
+		return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+	}
+	c.GroupBy, err = ParseStatsGroupBy(req.GroupBy)
+	if err != nil {
+		return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+	}
+	c.ReportFormat, err = ParseStatsReportFormat(req.ReportFormat)
+	if err != nil {
+		return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+	}
+	c.Rollups, err = NewStatsRollupsFromConfig(req.Rollups, c.paneDuration())
+	if err != nil {
+		return nil, fmt.Errorf("stats type '%s': %w", req.Name, err)
+	}
+	c.ComparePrevious = req.ComparePrevious
+	for _, secs := range req.CompareSeconds {
+		offset := time.Duration(secs * int64(time.Second))
+		if offset <= 0 || offset%c.paneDuration() != 0 {
+			return nil, fmt.Errorf("stats type '%s': compare seconds should be a multiple of %s", req.Name, c.paneDuration())
+		}
+		// The windows are only there to compare against if they are retained for long enough
+		if c.RetentionWindows > 0 && offset+c.Duration > time.Duration(c.RetentionWindows)*c.paneDuration() {
+			clog.Warnf("[%s] Only %d windows are retained, which is not enough to compare against the windows %s before", req.Name, c.RetentionWindows, formatWholeDuration(offset))
+		}
+		c.CompareOffsets = append(c.CompareOffsets, offset)
+	}
+	c.numericFields = GetNumericFields(c.Aggregations)
+	c.sketchFields = GetSketchFields(c.Aggregations)
+	c.distinctFields = GetDistinctFields(c.Aggregations)
+
 	c.baseLogConsumer.Name = req.Name
 	c.baseLogConsumer.Lock = &sync.RWMutex{}
 	c.baseLogConsumer.InQueue = make(chan LogMessageStructured, 8)
@@ -41,9 +344,9 @@ func NewStatsTypeFromConfig(req config.ConfigStatsType) (*StatsType, error) {
 			return nil, fmt.Errorf("multiple stats source settings for log source found")
 		}
 
-		settings, err := NewStatsTypeSourceSettings(cfgSettings.Key, cfgSettings.ValueMutateFuncName, cfgSettings.OtherKeys)
+		settings, err := NewStatsTypeSourceSettings(cfgSettings.Key, cfgSettings.ValueMutateFuncName, cfgSettings.OtherKeys, cfgSettings.Filter)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("stats type '%s', source '%s': %w", req.Name, cfgSettings.Name, err)
 		}
 
 		sourceSettingsMap[cfgSettings.Name] = settings
@@ -55,14 +358,23 @@ func NewStatsTypeFromConfig(req config.ConfigStatsType) (*StatsType, error) {
 }
 
 func (c *StatsType) PrepareForConsumption(currentTime time.Time) error {
+	// The sources are all registered by now
+	if c.Clock == StatsClockAuto {
+		c.Clock = c.detectClock()
+		clog.Debugf("[%s] Using the %s clock", c.Name, c.Clock)
+	}
+
 	// If StatsType has no time-windows, create some now...
-	if len(c.Windows) < 1 {
+	if c.Windows.Len() < 1 {
 		// Initialize it..
 		clog.Debugf("[%s] Initializing StatsType.Windows...", c.Name)
-		c.Windows = []StatsWindow{
-			NewStatsWindow(time.Time{}, currentTime), // previous, dummy window since timeZero till current, in case we get a log that is from past
-			NewStatsWindow(currentTime, currentTime.Add(c.Duration)),
+		start := currentTime
+		if c.Align {
+			start = alignTime(currentTime, c.paneDuration(), c.Location)
 		}
+		c.Windows = NewStatsWindowRing(statsWindowRingCapacity(c.RetentionWindows))
+		c.Windows.Append(c.newWindow(time.Time{}, start)) // previous, dummy window since timeZero till current, in case we get a log that is from past
+		c.Windows.Append(c.newWindow(start, start.Add(c.paneDuration())))
 		c.CurrentPointer = 1
 	}
 	return nil
@@ -75,16 +387,43 @@ func (c *StatsType) ConsumeLog(msg LogMessageStructured) error {
 	// By now, we have the value that we need to keep track of, we just need to add it to the right time window
 	// Get current window that we have. If current window is not initialized, this means this is the first such message for this stats
 
-	// Decide what window this log go to
-	err := c.addToWindow(msg)
+	settings, err := c.GetSourceSettings(msg.SourceName)
 	if err != nil {
 		return err
 	}
 
-	// Update latestTimestamp
+	// Update latestTimestamp, overall and for the source. Logs that are not counted move the time of their source
+	// forward too, or a source whose latest logs are all filtered out would hold the watermark back.
 	if c.LatestTimestamp.Before(msg.T) {
 		c.LatestTimestamp = msg.T
 	}
+	if c.SourceLatestTimes[msg.SourceName].Before(msg.T) {
+		c.SourceLatestTimes[msg.SourceName] = msg.T
+	}
+	if !msg.ReceivedAt.IsZero() {
+		c.SourceLatestArrival[msg.SourceName] = msg.ReceivedAt
+		if c.ProcessingTime.Before(msg.ReceivedAt) {
+			c.ProcessingTime = msg.ReceivedAt
+		}
+	}
+
+	// Skip the logs that this stats type is not interested in, but report the windows they complete
+	shouldInclude, err := settings.IsMatch(msg)
+	if err != nil {
+		return err
+	}
+	if !shouldInclude {
+		if c.Windows.Len() < 1 {
+			return nil
+		}
+		return c.advanceToWatermark()
+	}
+
+	// Decide what window this log go to
+	err = c.addToWindow(msg)
+	if err != nil {
+		return err
+	}
 
 	// Release any notifications
 	err = c.releaseNotifications()
@@ -92,6 +431,88 @@ func (c *StatsType) ConsumeLog(msg LogMessageStructured) error {
 		return err
 	}
 
+	// Drop the windows we no longer need
+	c.evictWindows()
+
+	return nil
+}
+
+// Flush reports the windows that are complete even though no newer log has come in, which only happens with the
+// processing clock. With the event clock, the watermark only moves with the logs.
+func (c *StatsType) Flush(now time.Time) error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	// Nothing to report before the first log
+	if c.Clock != StatsClockProcessing || c.Windows.Len() < 1 {
+		return nil
+	}
+	if c.ProcessingTime.Before(now) {
+		c.ProcessingTime = now
+	}
+	return c.advanceToWatermark()
+}
+
+// advanceToWatermark creates the windows up to the watermark, so the ones without any logs are reported too, and reports
+// the windows that are complete.
+func (c *StatsType) advanceToWatermark() error {
+	watermark := c.getWatermark()
+	if watermark.IsZero() {
+		return nil
+	}
+	windowIndex, _ := c.determineWindow(watermark)
+	if windowIndex > c.CurrentPointer {
+		c.queueNotificationsBefore(windowIndex)
+		c.CurrentPointer = windowIndex
+	}
+
+	err := c.releaseNotifications()
+	if err != nil {
+		return err
+	}
+
+	c.evictWindows()
+
+	return nil
+}
+
+// FinishConsumption reports all the windows that have not been reported yet, including the latest window which would
+// otherwise only be reported once a newer log arrives.
+func (c *StatsType) FinishConsumption() error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	lastIndex := c.Windows.Len() - 1
+	lastQueued := false
+	for _, windowIndex := range c.QueuedNotifications {
+		c.notify(windowIndex)
+		if windowIndex == lastIndex {
+			lastQueued = true
+		}
+	}
+	c.QueuedNotifications = nil
+
+	// The first window may be the dummy window for logs from the past
+	if lastIndex >= 0 && !c.Windows.At(lastIndex).Start.IsZero() && !lastQueued {
+		c.notify(lastIndex)
+	}
+
+	// Report the rollup windows that were still open, from the finest to the coarsest
+	if len(c.Rollups) > 0 {
+		err := c.Rollups[0].flush(c)
+		if err != nil {
+			clog.Errorf("[%s] Could not roll up the stats window: %s", c.Name, err)
+		}
+	}
+
+	// No more windows are evicted
+	if closer, ok := c.Archiver.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			clog.Errorf("[%s] Could not close the stats window archive: %s", c.Name, err)
+		}
+	}
+
 	return nil
 }
 
@@ -101,39 +522,89 @@ func (c *StatsType) ConsumeLog(msg LogMessageStructured) error {
 
 func (s *StatsType) addToWindow(msg LogMessageStructured) error {
 
-	clog.Debugf("[%s] [%d] [%s] Finding the right counts window among %d windows", msg.SourceName, msg.Id, s.Name, len(s.Windows))
+	clog.Debugf("[%s] [%d] [%s] Finding the right counts window among %d windows", msg.SourceName, msg.Id, s.Name, s.Windows.Len())
 	windowIndex, newWindowCreated := s.determineWindow(msg.T)
 
+	// The log is older than any window we still have, which have all been reported, or older than the first window,
+	// in the dummy window that is never reported
+	if windowIndex < 0 || s.Windows.At(windowIndex).Start.IsZero() {
+		s.LateCount++
+		clog.Debugf("[%s] [%d] [%s] Late log from before the windows in memory, policy: %s", msg.SourceName, msg.Id, s.Name, s.LatePolicy)
+		if s.LatePolicy == StatsLatePolicyCount {
+			s.Windows.Last().LateCount++
+		}
+		return nil
+	}
+
 	// We should send a notification if new window was created, because that means we have entered a new timeframe
 	// But, let's notify after a few seconds so we have some lagging data as well. Hence, put it in a queue
 	if newWindowCreated {
-		s.QueuedNotifications = append(s.QueuedNotifications, s.CurrentPointer)
+		s.queueNotificationsBefore(windowIndex)
 	}
 
 	// Add the log to the stats window
-	window := s.Windows[windowIndex]
+	window := s.Windows.At(windowIndex)
 
 	// If we reach this point, this means that we should add the log to the current stats window
 	clog.Debugf("[%s] [%d] [%s] Window determined: index %d", msg.SourceName, msg.Id, s.Name, windowIndex)
 
+	// The window might have already been reported, which makes this log late
+	if window.Reported {
+		s.LateCount++
+		clog.Debugf("[%s] [%d] [%s] Late log for an already reported window, policy: %s", msg.SourceName, msg.Id, s.Name, s.LatePolicy)
+		switch s.LatePolicy {
+		case StatsLatePolicyDrop:
+			return nil
+		case StatsLatePolicyCount:
+			s.Windows.Last().LateCount++
+			return nil
+		case StatsLatePolicyReemit:
+			// Every reported window that includes this pane needs to be reported again
+			for i := windowIndex; i < s.Windows.Len() && i < windowIndex+s.panesPerWindow(); i++ {
+				if s.Windows.At(i).Reported && !s.isNotificationQueued(i) {
+					s.QueuedNotifications = append(s.QueuedNotifications, i)
+				}
+			}
+		}
+	}
+
 	// Get the config of how to handle a log message from this source for this particular Stats
 	srcSettings, err := s.GetSourceSettings(msg.SourceName)
 	if err != nil {
 		return err
 	}
-	cleanValue, err := srcSettings.GetCleanedValue(msg)
-	if err != nil {
-		return err
+	var cleanValue string
+	if len(s.GroupBy) > 0 {
+		cleanValue, err = s.getGroupKey(msg)
+		if err != nil {
+			return err
+		}
+		clog.Debugf("[%s] [%d] [%s] Group fetched: %v", msg.SourceName, msg.Id, s.Name, splitGroupKey(cleanValue))
+	} else {
+		cleanValue, err = srcSettings.GetCleanedValue(msg)
+		if err != nil {
+			return err
+		}
+		clog.Debugf("[%s] [%d] [%s] Value for key '%s' fetched: %s", msg.SourceName, msg.Id, s.Name, srcSettings.GetKey(), cleanValue)
 	}
-	clog.Debugf("[%s] [%d] [%s] Value for key '%s' fetched: %s", msg.SourceName, msg.Id, s.Name, srcSettings.GetKey(), cleanValue)
 	cleanKV, err := srcSettings.GetCleanedKV(msg)
 	if err != nil {
 		return err
 	}
 
-	window.add(cleanValue, cleanKV)
+	lv := StatsLogValues{
+		Value:          cleanValue,
+		OtherKV:        cleanKV,
+		NumericValues:  GetNumericValues(msg.KV, s.numericFields),
+		SketchFields:   s.sketchFields,
+		DistinctValues: GetDistinctValues(msg.KV, s.distinctFields),
+	}
+	window.add(lv)
 
-	s.Windows[windowIndex] = window
+	// The window has already been rolled up, so the late log needs to be added to the rollups directly
+	if window.Reported && len(s.Rollups) > 0 {
+		s.Rollups[0].addLate(msg.T, lv)
+	}
 
 	// Make the pointer to the new window?
 	s.CurrentPointer = windowIndex
@@ -148,23 +619,27 @@ func (s *StatsType) determineWindow(t time.Time) (int, bool) {
 
 	for {
 		// If we're in the future and haven't created a window for it yet
-		if windowIndex >= len(s.Windows) {
+		if windowIndex >= s.Windows.Len() {
 
 			// If we're creating a new window, then let's print the stats
 			newWindowCreated = true
 
-			lastWindow := s.Windows[len(s.Windows)-1]
+			lastWindow := s.Windows.Last()
 
-			newWindow := NewStatsWindow(lastWindow.End, lastWindow.End.Add(s.Duration))
-			s.Windows = append(s.Windows, newWindow)
+			newWindow := s.newWindow(lastWindow.End, lastWindow.End.Add(s.paneDuration()))
+			s.Windows.Append(newWindow)
 			clog.Debugf("Creating a new window from %s to %s", newWindow.Start, newWindow.End)
 
 		}
 
-		window := s.Windows[windowIndex]
+		window := s.Windows.At(windowIndex)
 
 		// if the log belongs to a previous window
 		if t.Before(window.Start) {
+			// The window it belongs to has been evicted
+			if windowIndex == 0 {
+				return -1, newWindowCreated
+			}
 			windowIndex--
 			continue
 		}
@@ -182,58 +657,342 @@ func (s *StatsType) determineWindow(t time.Time) (int, bool) {
 	return windowIndex, newWindowCreated
 }
 
+// newWindow creates a window that counts values the way this stats type is configured to.
+func (s *StatsType) newWindow(start, end time.Time) StatsWindow {
+	w := NewStatsWindow(start, end)
+	w.Counter = s.Counter
+	w.CounterCapacity = s.CounterCapacity
+	if s.Counter == StatsCounterSpaceSaving {
+		w.Keys = NewHeavyHitters(s.Counter, s.CounterCapacity)
+	}
+	return w
+}
+
+// evictWindows drops the oldest windows from memory, as long as they are over the retention limits, and can no longer
+// be reported. A window is reported once the watermark, which already accounts for the allowed lateness, passes its
+// end, so any log that still comes in for an evicted window would be late anyway.
+func (s *StatsType) evictWindows() {
+	// Always keep the latest window
+	var n int
+	for n < s.Windows.Len()-1 {
+		w := s.Windows.At(n)
+		overCount := s.RetentionWindows > 0 && s.Windows.Len()-n > s.RetentionWindows
+		overAge := s.RetentionAge > 0 && s.LatestTimestamp.Sub(w.End) > s.RetentionAge
+		if !(overCount || overAge) || !s.canEvictWindow(n) {
+			break
+		}
+		n++
+	}
+	if n < 1 {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		// The dummy window for logs from the past is never reported, so there is nothing to archive
+		if s.Archiver == nil || s.Windows.At(i).Start.IsZero() {
+			continue
+		}
+		err := s.Archiver.ArchiveStatsWindow(s.Name, *s.Windows.At(i))
+		if err != nil {
+			clog.Errorf("[%s] Could not archive the stats window from %s to %s: %s", s.Name, s.Windows.At(i).Start, s.Windows.At(i).End, err)
+		}
+	}
+	clog.Debugf("[%s] Evicting %d stats window(s), up to %s", s.Name, n, s.Windows.At(n-1).End)
+
+	s.Windows.DropFront(n)
+	s.EvictedCount += n
+
+	// Indexes now point n windows earlier
+	s.CurrentPointer -= n
+	if s.CurrentPointer < 0 {
+		s.CurrentPointer = 0
+	}
+	for i := range s.QueuedNotifications {
+		s.QueuedNotifications[i] -= n
+	}
+}
+
+// defaultStatsWindowRingCapacity is the number of windows a ring starts with room for, when there is no retention limit.
+const defaultStatsWindowRingCapacity = 16
+
+// StatsWindowRing holds windows in a ring buffer, from the oldest to the latest. Windows are evicted from the front by
+// moving the head, and new windows reuse the room they leave, so neither shifts the windows that are kept. The ring only
+// grows, to twice its capacity, when it's full e.g. without a retention limit, or while the oldest windows still wait
+// to be reported.
+type StatsWindowRing struct {
+	buf  []StatsWindow
+	head int // index in buf of the oldest window
+	n    int // number of windows
+}
+
+// statsWindowRingCapacity returns the room for the windows kept under the retention limit, along with the window that is
+// added before the oldest ones are evicted, and the dummy window for logs from the past.
+func statsWindowRingCapacity(retentionWindows int) int {
+	if retentionWindows < 1 {
+		return defaultStatsWindowRingCapacity
+	}
+	return retentionWindows + 2
+}
+
+// NewStatsWindowRing creates a ring with room for capacity windows.
+func NewStatsWindowRing(capacity int) StatsWindowRing {
+	if capacity < 1 {
+		capacity = defaultStatsWindowRingCapacity
+	}
+	return StatsWindowRing{buf: make([]StatsWindow, capacity)}
+}
+
+// Len returns the number of windows in the ring.
+func (r *StatsWindowRing) Len() int {
+	return r.n
+}
+
+// Cap returns the number of windows the ring has room for before it grows.
+func (r *StatsWindowRing) Cap() int {
+	return len(r.buf)
+}
+
+// At returns the window at index i, counted from the oldest one. The pointer is only valid until the next Append.
+func (r *StatsWindowRing) At(i int) *StatsWindow {
+	if i < 0 || i >= r.n {
+		panic(fmt.Sprintf("stats window index %d out of range [0:%d]", i, r.n))
+	}
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+// Last returns the latest window. The pointer is only valid until the next Append.
+func (r *StatsWindowRing) Last() *StatsWindow {
+	return r.At(r.n - 1)
+}
+
+// Append adds a window after the latest one, growing the ring if it's full.
+func (r *StatsWindowRing) Append(w StatsWindow) {
+	if r.n == len(r.buf) {
+		capacity := 2 * len(r.buf)
+		if capacity < 1 {
+			capacity = defaultStatsWindowRingCapacity
+		}
+		buf := make([]StatsWindow, capacity)
+		for i := 0; i < r.n; i++ {
+			buf[i] = *r.At(i)
+		}
+		r.buf, r.head = buf, 0
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = w
+	r.n++
+}
+
+// DropFront drops the n oldest windows, which are cleared so their counts can be garbage collected.
+func (r *StatsWindowRing) DropFront(n int) {
+	if n < 1 {
+		return
+	}
+	if n > r.n {
+		n = r.n
+	}
+	for i := 0; i < n; i++ {
+		*r.At(i) = StatsWindow{}
+	}
+	r.head = (r.head + n) % len(r.buf)
+	r.n -= n
+}
+
+// canEvictWindow tells if the window at windowIndex is no longer needed for any report: it's not queued, and it and
+// the windows after it that it's reported with are done.
+func (s *StatsType) canEvictWindow(windowIndex int) bool {
+	if s.isNotificationQueued(windowIndex) {
+		return false
+	}
+	watermark := s.getWatermark()
+	for i := windowIndex; i < windowIndex+s.panesPerWindow(); i++ {
+		if i >= s.Windows.Len() || s.isNotificationQueued(i) {
+			return false
+		}
+		w := s.Windows.At(i)
+		// The dummy window for logs from the past is never reported, and neither are tumbling windows without logs
+		done := w.Reported || w.Start.IsZero() || (len(w.StatsMap) == 0 && w.LateCount == 0 && watermark.After(w.End))
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
+// newMergedWindow creates a window that other windows are merged into, e.g. for hopping windows or rollups.
+func (s *StatsType) newMergedWindow(start, end time.Time) StatsWindow {
+	w := s.newWindow(start, end)
+	w.Keys = nil // the merged windows have already bounded their values, and merge bounds the rest
+	return w
+}
+
+// paneDuration returns the size of the windows in which logs are counted.
+func (s *StatsType) paneDuration() time.Duration {
+	if s.Advance <= 0 {
+		return s.Duration
+	}
+	return s.Advance
+}
+
+// panesPerWindow returns the number of panes that make up a reported window.
+func (s *StatsType) panesPerWindow() int {
+	if s.Advance <= 0 {
+		return 1
+	}
+	return int(s.Duration / s.Advance)
+}
+
+// getReportWindow returns the window that is reported when the pane at windowIndex is complete. For tumbling windows,
+// that's the pane itself. For hopping and sliding windows, it's the panes of the last Duration merged together.
+func (s *StatsType) getReportWindow(windowIndex int) (StatsWindow, error) {
+	n := s.panesPerWindow()
+	if n <= 1 {
+		return *s.Windows.At(windowIndex), nil
+	}
+
+	// The dummy window for logs from the past is not part of any report
+	first := windowIndex - n + 1
+	if first < 0 {
+		first = 0
+	}
+	if s.Windows.At(first).Start.IsZero() {
+		first++
+	}
+	if windowIndex < first {
+		return *s.Windows.At(windowIndex), nil
+	}
+
+	w := s.newMergedWindow(s.Windows.At(first).Start, s.Windows.At(windowIndex).End)
+	for i := first; i <= windowIndex; i++ {
+		err := w.merge(*s.Windows.At(i))
+		if err != nil {
+			return w, err
+		}
+	}
+	// Late logs are only counted in the pane that was the latest when they arrived
+	w.Reported = s.Windows.At(windowIndex).Reported
+	w.LateCount = s.Windows.At(windowIndex).LateCount
+	return w, nil
+}
+
+// getBreakdownTopN returns the number of values shown in a report for the breakdown key.
+func (s *StatsType) getBreakdownTopN(key string) int {
+	if n, exists := s.BreakdownTopN[key]; exists {
+		return n
+	}
+	return s.TopN
+}
+
 func (st StatsType) getCurrentWindow() StatsWindow {
-	return st.Windows[st.CurrentPointer]
+	return *st.Windows.At(st.CurrentPointer)
+}
+
+// getWatermark returns the event time up to which we consider the data to be complete: the earliest of the latest event
+// times seen from each source, minus the allowed lateness. Taking the earliest source means that one source running
+// ahead of the others cannot make us report windows that the others are still sending logs for.
+//
+// With the processing clock, a source that has gone quiet is assumed to have moved on as much as the wall clock has
+// since its latest log, so it does not hold the watermark back.
+func (s *StatsType) getWatermark() time.Time {
+	var watermark time.Time
+	for src, t := range s.SourceLatestTimes {
+		if arrival, ok := s.SourceLatestArrival[src]; ok && s.Clock == StatsClockProcessing && s.ProcessingTime.After(arrival) {
+			t = t.Add(s.ProcessingTime.Sub(arrival))
+		}
+		if watermark.IsZero() || t.Before(watermark) {
+			watermark = t
+		}
+	}
+	if watermark.IsZero() {
+		return watermark
+	}
+	return watermark.Add(-s.AllowedLateness)
+}
+
+// queueNotificationsBefore queues the notifications of the windows from the current one up to windowIndex, including
+// the windows that had no logs, so quiet periods show up as empty reports.
+func (s *StatsType) queueNotificationsBefore(windowIndex int) {
+	for i := s.CurrentPointer; i < windowIndex; i++ {
+		if s.Windows.At(i).Start.IsZero() || s.Windows.At(i).Reported || s.isNotificationQueued(i) {
+			continue
+		}
+		s.QueuedNotifications = append(s.QueuedNotifications, i)
+	}
+}
+
+func (s *StatsType) isNotificationQueued(windowIndex int) bool {
+	for _, i := range s.QueuedNotifications {
+		if i == windowIndex {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *StatsType) releaseNotifications() error {
-	var doneIndexes []int
-	for i := 0; i < len(s.QueuedNotifications); i++ {
-		windowIndex := s.QueuedNotifications[i]
-		statsWindow := s.Windows[windowIndex]
-		if s.LatestTimestamp.Sub(statsWindow.End) > 2*time.Second {
+	watermark := s.getWatermark()
+	var remaining []int
+	for _, windowIndex := range s.QueuedNotifications {
+		statsWindow := s.Windows.At(windowIndex)
+		if watermark.After(statsWindow.End) {
 			s.notify(windowIndex)
-			doneIndexes = append(doneIndexes, i)
+			continue
 		}
+		remaining = append(remaining, windowIndex)
 	}
-	for _, i := range doneIndexes {
-		s.QueuedNotifications = append(s.QueuedNotifications[:i], s.QueuedNotifications[i+1:]...)
-	}
+	s.QueuedNotifications = remaining
 	return nil
 }
 
-func (s StatsType) notify(windowIndex int) {
-	statsWindow := s.Windows[windowIndex]
+func (s *StatsType) notify(windowIndex int) {
+	statsWindow, err := s.getReportWindow(windowIndex)
+	if err != nil {
+		clog.Errorf("[%s] Could not merge the stats windows: %s", s.Name, err)
+		return
+	}
+	firstReport := !s.Windows.At(windowIndex).Reported
+	s.Windows.At(windowIndex).Reported = true
 
-	// Print the stats in order, so get the order first
-	var kCountMap = make(map[string]int)
-	for k, stats := range statsWindow.StatsMap {
-		kCountMap[k] = stats.Count
+	var title = "Stats Report"
+	if statsWindow.Reported {
+		title = "Corrected Stats Report"
 	}
-	var orderedKeys = sortMapKeysByValue(kCountMap)
-	clog.Noticef("kCountMap: %+v", kCountMap)
-	clog.Noticef("OrderedKeys: %+v", orderedKeys)
+	clog.Notice(s.formatReport(title, statsWindow, s.getComparisons(statsWindow)))
+	clog.Debugf("Window: %+v", statsWindow)
 
-	msg := fmt.Sprintf("[%s] Stats Report:\n\tTime Start: %s\n\tTime End  : %s\n", s.Name, statsWindow.Start, statsWindow.End)
-	cnt := 0
-	for _, k1 := range orderedKeys {
-		// and only print top 5
-		cnt++
-		if cnt >= 5 {
-			break
+	// The pane is complete, so it can be rolled up into the coarser windows
+	if firstReport && len(s.Rollups) > 0 && !s.Windows.At(windowIndex).Start.IsZero() {
+		err = s.Rollups[0].feed(s, *s.Windows.At(windowIndex))
+		if err != nil {
+			clog.Errorf("[%s] Could not roll up the stats window: %s", s.Name, err)
 		}
-		stats := statsWindow.StatsMap[k1]
-		msg = msg + fmt.Sprintf("\t\t%s\t:\t%d\n", k1, stats.Count)
-		for k2, v2 := range stats.OtherCounts {
-			msg = msg + fmt.Sprintf("\t\t\tBreakdown by %s\n", k2)
-			for k3, v3 := range v2 {
-				msg = msg + fmt.Sprintf("\t\t\t\t%s\t:\t%d\n", k3, v3)
-			}
+	}
+}
+
+// formatReport shows the stats of the window, with the most frequent values first, and how they changed against the
+// earlier windows.
+func (s *StatsType) formatReport(title string, statsWindow StatsWindow, comparisons []statsComparison) string {
+	msg := fmt.Sprintf("[%s] %s:\n\tTime Start: %s\n\tTime End  : %s\n", s.Name, title, statsWindow.Start, statsWindow.End)
+	// Print the most frequent values first
+	switch {
+	case len(statsWindow.StatsMap) < 1:
+		msg = msg + "\t\tNo logs\n"
+	case len(s.GroupBy) > 0 && s.ReportFormat == StatsReportTree:
+		msg = msg + s.formatGroupTree(statsWindow, comparisons)
+	case len(s.GroupBy) > 0:
+		msg = msg + s.formatGroupTable(statsWindow, comparisons)
+	default:
+		for _, k1 := range statsWindow.topKeys(s.TopN) {
+			stats := statsWindow.StatsMap[k1]
+			msg = msg + s.formatStats(k1, stats, statsWindow.End.Sub(statsWindow.Start), "\t\t", formatChanges(k1, stats.Count, comparisons))
 		}
 	}
+	msg = msg + s.formatGoneKeys(statsWindow, comparisons, "\t\t")
 
-	clog.Notice(msg)
-	clog.Debugf("Window: %+v", statsWindow)
+	if statsWindow.LateCount > 0 {
+		msg = msg + fmt.Sprintf("\t\tLate logs (from earlier windows)\t:\t%d\n", statsWindow.LateCount)
+	}
+
+	return msg
 }
 
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
@@ -241,14 +1000,33 @@ func (s StatsType) notify(windowIndex int) {
 * * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
 
 type StatsWindow struct {
-	StatsMap map[string]Stats // map[value]counts
-	Start    time.Time
-	End      time.Time
+	StatsMap  map[string]Stats // map[value]counts
+	Start     time.Time
+	End       time.Time
+	Reported  bool // whether the window has been reported at least once
+	LateCount int  // logs that belonged to earlier, already reported, windows (see StatsLatePolicyCount)
+
+	Counter         StatsCounterMode // how the values and the breakdown values are counted
+	CounterCapacity int              // number of values kept per counter, for StatsCounterSpaceSaving
+	Keys            HeavyHitters     // decides which values are kept in StatsMap, only set for StatsCounterSpaceSaving
+	MissingCount    int              // values that are not in StatsMap may have been seen up to this many times
 }
 
 type Stats struct {
-	Count       int
-	OtherCounts map[string]map[string]int // map[key][value]count e.g. [host] -> [100.0.0.1] -> 25
+	Count          int
+	CountError     int                      // the count may be overestimated by up to this much (see SpaceSavingCounter)
+	OtherCounts    map[string]HeavyHitters  // map[key]counts of its values e.g. [host] -> [100.0.0.1] -> 25
+	FieldSummaries map[string]*FieldSummary // map[field]summary of the numeric fields used in aggregations
+	Distincts      map[string]*HyperLogLog  // map[field]sketch of the fields used in distinct aggregations
+}
+
+// StatsLogValues holds everything that a StatsWindow needs from a single log.
+type StatsLogValues struct {
+	Value          string             // value of the stats key, after mutation
+	OtherKV        map[string]string  // values of the other keys, for the breakdowns
+	NumericValues  map[string]float64 // values of the numeric fields used in aggregations
+	SketchFields   map[string]bool    // numeric fields that need a quantile sketch
+	DistinctValues map[string]string  // values of the fields used in distinct aggregations
 }
 
 func NewStatsWindow(start, end time.Time) StatsWindow {
@@ -259,26 +1037,212 @@ func NewStatsWindow(start, end time.Time) StatsWindow {
 	}
 }
 
-func (w *StatsWindow) add(value string, kv map[string]string) {
+func (w *StatsWindow) add(lv StatsLogValues) {
+
+	// With a bounded counter, a new value may take over the slot (and the count) of the least frequent one
+	if w.Keys != nil {
+		if evicted := w.Keys.Add(lv.Value); evicted != nil {
+			delete(w.StatsMap, evicted.Value)
+			w.StatsMap[lv.Value] = Stats{Count: evicted.Count, CountError: evicted.Count}
+		}
+	}
 
 	// Find stats for right value
-	stats := w.StatsMap[value]
+	stats := w.StatsMap[lv.Value]
 
 	// Increment the counter
 	stats.Count++
 	// Increment counters for other keys
 	if stats.OtherCounts == nil {
-		stats.OtherCounts = make(map[string]map[string]int)
+		stats.OtherCounts = make(map[string]HeavyHitters)
 	}
-	for k, v := range kv {
+	for k, v := range lv.OtherKV {
 		if stats.OtherCounts[k] == nil {
-			stats.OtherCounts[k] = make(map[string]int)
+			stats.OtherCounts[k] = NewHeavyHitters(w.Counter, w.CounterCapacity)
+		}
+		stats.OtherCounts[k].Add(v)
+	}
+	// Update the summaries of numeric fields
+	if len(lv.NumericValues) > 0 && stats.FieldSummaries == nil {
+		stats.FieldSummaries = make(map[string]*FieldSummary)
+	}
+	for f, v := range lv.NumericValues {
+		if stats.FieldSummaries[f] == nil {
+			stats.FieldSummaries[f] = NewFieldSummary(lv.SketchFields[f])
+		}
+		stats.FieldSummaries[f].Add(v)
+	}
+	// Update the distinct count sketches
+	if len(lv.DistinctValues) > 0 && stats.Distincts == nil {
+		stats.Distincts = make(map[string]*HyperLogLog)
+	}
+	for f, v := range lv.DistinctValues {
+		if stats.Distincts[f] == nil {
+			stats.Distincts[f] = NewHyperLogLog(DefaultHyperLogLogPrecision)
+		}
+		stats.Distincts[f].Add(v)
+	}
+
+	w.StatsMap[lv.Value] = stats
+
+}
+
+// merge adds all the stats of the other window to this one, without changing the other window.
+//
+// With Space-Saving counters, a value that is missing from one of the windows may still have been seen up to that
+// window's missing count, which is added to its count and error. Only the CounterCapacity most frequent values are kept.
+func (w *StatsWindow) merge(other StatsWindow) error {
+	myMissing, otherMissing := w.getMissingCount(), other.getMissingCount()
+	for k, otherStats := range other.StatsMap {
+		stats, exists := w.StatsMap[k]
+		if !exists {
+			stats.Count += myMissing
+			stats.CountError += myMissing
+		}
+		err := stats.merge(otherStats, w.Counter, w.CounterCapacity)
+		if err != nil {
+			return err
+		}
+		w.StatsMap[k] = stats
+	}
+	if otherMissing > 0 {
+		for k, stats := range w.StatsMap {
+			if _, exists := other.StatsMap[k]; !exists {
+				stats.Count += otherMissing
+				stats.CountError += otherMissing
+				w.StatsMap[k] = stats
+			}
+		}
+	}
+	w.MissingCount = myMissing + otherMissing
+	w.LateCount += other.LateCount
+
+	// Keep the number of values bounded
+	if w.Counter == StatsCounterSpaceSaving && len(w.StatsMap) > w.CounterCapacity {
+		keys := w.topKeys(-1)
+		if dropped := w.StatsMap[keys[w.CounterCapacity]].Count; dropped > w.MissingCount {
+			w.MissingCount = dropped
+		}
+		for _, k := range keys[w.CounterCapacity:] {
+			delete(w.StatsMap, k)
+		}
+	}
+	return nil
+}
+
+// getMissingCount returns how many times a value that is not in StatsMap may have been seen.
+func (w StatsWindow) getMissingCount() int {
+	if ss, ok := w.Keys.(*SpaceSavingCounter); ok {
+		return ss.minDroppableCount()
+	}
+	return w.MissingCount
+}
+
+// merge adds the other stats to these ones. Counters, summaries and sketches are copied rather than shared, so the other
+// stats are not changed by later merges.
+func (s *Stats) merge(other Stats, counter StatsCounterMode, counterCapacity int) error {
+	s.Count += other.Count
+	s.CountError += other.CountError
+
+	for k, otherCounts := range other.OtherCounts {
+		if s.OtherCounts == nil {
+			s.OtherCounts = make(map[string]HeavyHitters)
+		}
+		if s.OtherCounts[k] == nil {
+			s.OtherCounts[k] = NewHeavyHitters(counter, counterCapacity)
+		}
+		err := s.OtherCounts[k].Merge(otherCounts)
+		if err != nil {
+			return err
+		}
+	}
+	for f, otherSummary := range other.FieldSummaries {
+		if s.FieldSummaries == nil {
+			s.FieldSummaries = make(map[string]*FieldSummary)
+		}
+		if s.FieldSummaries[f] == nil {
+			s.FieldSummaries[f] = NewFieldSummary(false)
+		}
+		err := s.FieldSummaries[f].Merge(otherSummary)
+		if err != nil {
+			return err
+		}
+	}
+	for f, otherHLL := range other.Distincts {
+		if s.Distincts == nil {
+			s.Distincts = make(map[string]*HyperLogLog)
+		}
+		if s.Distincts[f] == nil {
+			s.Distincts[f] = NewHyperLogLog(otherHLL.Precision)
 		}
-		stats.OtherCounts[k][v]++
+		err := s.Distincts[f].Merge(otherHLL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topKeys returns the n most frequent values of the window, most frequent first. If n < 1, all values are returned.
+func (w StatsWindow) topKeys(n int) []string {
+	var hs = make([]HeavyHitter, 0, len(w.StatsMap))
+	for k, stats := range w.StatsMap {
+		hs = append(hs, HeavyHitter{Value: k, Count: stats.Count})
+	}
+	var keys []string
+	for _, h := range topHeavyHitters(hs, n) {
+		keys = append(keys, h.Value)
+	}
+	return keys
+}
+
+// alignTime returns the start of the interval of length d that t falls in, with intervals counted from the epoch in the
+// given timezone e.g. with d = 1m, 21:18:03 becomes 21:18:00.
+func alignTime(t time.Time, d time.Duration, loc *time.Location) time.Time {
+	_, offsetSeconds := t.In(loc).Zone()
+	offset := time.Duration(offsetSeconds) * time.Second
+	local := t.Add(offset).UnixNano()
+	rem := local % int64(d)
+	if rem < 0 {
+		rem += int64(d)
 	}
+	return time.Unix(0, local-rem).Add(-offset).In(t.Location())
+}
 
-	w.StatsMap[value] = stats
+// formatStats shows the count of a value, and below it, its aggregations and breakdowns.
+func (s *StatsType) formatStats(value string, stats Stats, duration time.Duration, indent string, changes string) string {
+	count := formatHeavyHitterCount(stats.Count, stats.CountError)
+	if changes != "" {
+		count = count + "\t(" + changes + ")"
+	}
+	msg := fmt.Sprintf("%s%s\t:\t%s\n", indent, value, count)
+	for _, agg := range s.Aggregations {
+		v, ok := agg.Compute(stats, duration)
+		if !ok {
+			continue
+		}
+		msg = msg + fmt.Sprintf("%s\t%s\t:\t%s\n", indent, agg.Name, agg.Format(v))
+	}
+	var breakdownKeys []string
+	for k := range stats.OtherCounts {
+		breakdownKeys = append(breakdownKeys, k)
+	}
+	sort.Strings(breakdownKeys)
+	for _, k := range breakdownKeys {
+		msg = msg + fmt.Sprintf("%s\tBreakdown by %s\n", indent, k)
+		for _, h := range stats.OtherCounts[k].Top(s.getBreakdownTopN(k)) {
+			msg = msg + fmt.Sprintf("%s\t\t%s\t:\t%s\n", indent, h.Value, formatHeavyHitterCount(h.Count, h.Error))
+		}
+	}
+	return msg
+}
 
+// formatHeavyHitterCount shows the count, along with how much it may be overestimated by, if at all.
+func formatHeavyHitterCount(count, errCount int) string {
+	if errCount > 0 {
+		return fmt.Sprintf("%d (±%d)", count, errCount)
+	}
+	return fmt.Sprintf("%d", count)
 }
 
 /* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
@@ -289,13 +1253,20 @@ type StatsTypeSourceSettings struct {
 	Key             string                         // what key in the log and we keeping a count by?
 	ValueMutateFunc func(v string) (string, error) // do we need to do any processing on the key's value before we use it for count?
 	OtherKeys       []string                       // KeysForSubCounts
+	Filter          *FilterExpr                    // if set, only logs that match this expression are counted
 }
 
-func NewStatsTypeSourceSettings(key string, valueMutateFuncName string, otherKeys []string) (StatsTypeSourceSettings, error) {
+func NewStatsTypeSourceSettings(key string, valueMutateFuncName string, otherKeys []string, filter string) (StatsTypeSourceSettings, error) {
 	var s StatsTypeSourceSettings
 	s.Key = key
 	s.OtherKeys = otherKeys
 
+	var err error
+	s.Filter, err = CompileFilter(filter)
+	if err != nil {
+		return s, err
+	}
+
 	// Populate right Mutator Func Field
 	switch valueMutateFuncName {
 	case "":
@@ -335,5 +1306,5 @@ func (s StatsTypeSourceSettings) GetCleanedKV(msg LogMessageStructured) (map[str
 }
 
 func (s StatsTypeSourceSettings) IsMatch(msg LogMessageStructured) (bool, error) {
-	return true, nil
+	return s.Filter.Match(msg.KV)
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S T A T S  -  A G G R E G A T I O N S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// StatsAggregation is an aggregation over a field of the log, e.g. `sum(bytes)`, that is computed for each key value in
+// each stats window, and shows up in the report next to the counts. All aggregations are over numeric fields, except for
+// distinct, which counts the (approximate) number of distinct values of any field.
+type StatsAggregation struct {
+	Name     string  // the aggregation as written in the config e.g. "avg(bytes)"
+	Func     string  // sum, avg, min, max, rate, distinct, or a percentile like p99
+	Field    string  // the field of the log that is aggregated. It can be empty for rate, which then gives logs per second
+	Quantile float64 // for percentiles, the quantile between 0 and 1 e.g. 0.99 for p99
+}
+
+var statsAggregationRegex = regexp.MustCompile(`^\s*([a-zA-Z][a-zA-Z0-9.]*)\s*\(\s*([^()\s]*)\s*\)\s*$`)
+
+var statsPercentileRegex = regexp.MustCompile(`^p(\d{1,2}(\.\d+)?)$`)
+
+// ParseStatsAggregation parses an aggregation like `sum(bytes)`.
+func ParseStatsAggregation(str string) (StatsAggregation, error) {
+	var a StatsAggregation
+
+	parts := statsAggregationRegex.FindStringSubmatch(str)
+	if parts == nil {
+		return a, fmt.Errorf("aggregation '%s' should be in the format func(field)", str)
+	}
+	a.Name = strings.TrimSpace(str)
+	a.Func = parts[1]
+	a.Field = parts[2]
+
+	switch a.Func {
+	case "sum", "avg", "min", "max", "distinct":
+		if a.Field == "" {
+			return a, fmt.Errorf("aggregation '%s' needs a field", str)
+		}
+	case "rate":
+	default:
+		// Percentiles, e.g. p50, p99, p99.9
+		pParts := statsPercentileRegex.FindStringSubmatch(a.Func)
+		if pParts == nil {
+			return a, fmt.Errorf("aggregation function '%s' not recognized", a.Func)
+		}
+		p, err := strconv.ParseFloat(pParts[1], 64)
+		if err != nil || p <= 0 {
+			return a, fmt.Errorf("invalid percentile in aggregation '%s'", str)
+		}
+		if a.Field == "" {
+			return a, fmt.Errorf("aggregation '%s' needs a field", str)
+		}
+		a.Quantile = p / 100
+	}
+
+	return a, nil
+}
+
+// IsPercentile tells if the aggregation needs a quantile sketch.
+func (a StatsAggregation) IsPercentile() bool {
+	return a.Quantile > 0
+}
+
+// ParseStatsAggregations parses all the aggregations, and makes sure there are no duplicates.
+func ParseStatsAggregations(strs []string) ([]StatsAggregation, error) {
+	var aggs []StatsAggregation
+	var seen = make(map[string]bool)
+	for _, str := range strs {
+		a, err := ParseStatsAggregation(str)
+		if err != nil {
+			return nil, err
+		}
+		if seen[a.Name] {
+			return nil, fmt.Errorf("aggregation '%s' is provided more than once", a.Name)
+		}
+		seen[a.Name] = true
+		aggs = append(aggs, a)
+	}
+	return aggs, nil
+}
+
+// IsDistinct tells if the aggregation needs a distinct count sketch.
+func (a StatsAggregation) IsDistinct() bool {
+	return a.Func == "distinct"
+}
+
+// GetNumericFields returns the numeric fields that need to be read from the logs for the given aggregations.
+func GetNumericFields(aggs []StatsAggregation) []string {
+	var fields []string
+	var seen = make(map[string]bool)
+	for _, a := range aggs {
+		if a.Field == "" || a.IsDistinct() || seen[a.Field] {
+			continue
+		}
+		seen[a.Field] = true
+		fields = append(fields, a.Field)
+	}
+	return fields
+}
+
+// GetSketchFields returns the fields that need a quantile sketch for the given aggregations.
+func GetSketchFields(aggs []StatsAggregation) map[string]bool {
+	var fields = make(map[string]bool)
+	for _, a := range aggs {
+		if a.IsPercentile() {
+			fields[a.Field] = true
+		}
+	}
+	return fields
+}
+
+// GetDistinctFields returns the fields whose distinct values need to be counted for the given aggregations.
+func GetDistinctFields(aggs []StatsAggregation) []string {
+	var fields []string
+	var seen = make(map[string]bool)
+	for _, a := range aggs {
+		if !a.IsDistinct() || seen[a.Field] {
+			continue
+		}
+		seen[a.Field] = true
+		fields = append(fields, a.Field)
+	}
+	return fields
+}
+
+// GetNumericValues reads the given fields from the key-values as numbers. Fields that are missing, or are not numbers,
+// are left out.
+func GetNumericValues(kv map[string]string, fields []string) map[string]float64 {
+	if len(fields) < 1 {
+		return nil
+	}
+	var values = make(map[string]float64)
+	for _, f := range fields {
+		str, exists := kv[f]
+		if !exists {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(removeQuotes(str)), 64)
+		if err != nil {
+			continue
+		}
+		values[f] = v
+	}
+	return values
+}
+
+// GetDistinctValues reads the given fields from the key-values, without any surrounding quotes. Missing fields are left
+// out, so that they are not counted as a distinct (empty) value.
+func GetDistinctValues(kv map[string]string, fields []string) map[string]string {
+	if len(fields) < 1 {
+		return nil
+	}
+	var values = make(map[string]string)
+	for _, f := range fields {
+		str, exists := kv[f]
+		if !exists {
+			continue
+		}
+		values[f] = removeQuotes(str)
+	}
+	return values
+}
+
+// Compute returns the result of the aggregation, given the stats of a key value over the given duration. The bool is
+// false if there is no data to compute the aggregation on.
+func (a StatsAggregation) Compute(stats Stats, duration time.Duration) (float64, bool) {
+	if a.Func == "rate" && a.Field == "" {
+		if duration <= 0 {
+			return 0, false
+		}
+		return float64(stats.Count) / duration.Seconds(), true
+	}
+
+	if a.IsDistinct() {
+		hll := stats.Distincts[a.Field]
+		if hll == nil {
+			return 0, false
+		}
+		return float64(hll.Estimate()), true
+	}
+
+	summary := stats.FieldSummaries[a.Field]
+	if summary == nil || summary.Count < 1 {
+		return 0, false
+	}
+
+	if a.IsPercentile() {
+		if summary.Sketch == nil {
+			return 0, false
+		}
+		return summary.Sketch.Quantile(a.Quantile)
+	}
+
+	switch a.Func {
+	case "sum":
+		return summary.Sum, true
+	case "avg":
+		return summary.Sum / float64(summary.Count), true
+	case "min":
+		return summary.Min, true
+	case "max":
+		return summary.Max, true
+	case "rate":
+		if duration <= 0 {
+			return 0, false
+		}
+		return summary.Sum / duration.Seconds(), true
+	}
+
+	return 0, false
+}
+
+// Format returns the result of the aggregation as a string for the reports.
+func (a StatsAggregation) Format(v float64) string {
+	switch {
+	case a.Func == "avg" || a.IsPercentile():
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	case a.Func == "rate":
+		return strconv.FormatFloat(v, 'f', 2, 64) + "/s"
+	case a.IsDistinct():
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S T A T S  -  F I E L D  S U M M A R Y
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// FieldSummary keeps the running summary of a numeric field, from which all the aggregations can be computed. Summaries
+// can be merged, which lets us combine windows.
+type FieldSummary struct {
+	Count  int
+	Sum    float64
+	Min    float64
+	Max    float64
+	Sketch *DDSketch // only kept if a percentile of the field is needed
+}
+
+func NewFieldSummary(withSketch bool) *FieldSummary {
+	s := FieldSummary{Min: math.Inf(1), Max: math.Inf(-1)}
+	if withSketch {
+		s.Sketch = NewDDSketch(DefaultSketchRelativeAccuracy, DefaultSketchMaxBuckets)
+	}
+	return &s
+}
+
+func (s *FieldSummary) Add(v float64) {
+	s.Count++
+	s.Sum += v
+	s.Min = math.Min(s.Min, v)
+	s.Max = math.Max(s.Max, v)
+	if s.Sketch != nil {
+		s.Sketch.Add(v)
+	}
+}
+
+func (s *FieldSummary) Merge(other *FieldSummary) error {
+	if other == nil {
+		return nil
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.Min = math.Min(s.Min, other.Min)
+	s.Max = math.Max(s.Max, other.Max)
+	if other.Sketch != nil {
+		if s.Sketch == nil {
+			s.Sketch = NewDDSketch(other.Sketch.RelativeAccuracy, other.Sketch.MaxBuckets)
+		}
+		return s.Sketch.Merge(other.Sketch)
+	}
+	return nil
+}
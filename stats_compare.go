@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S T A T S  -  C H A N G E S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// statsComparison is an earlier window that a report is compared against, e.g. the previous window, or the same window
+// a day earlier.
+type statsComparison struct {
+	Name   string // shown in the report e.g. "prev" or "1d"
+	Window StatsWindow
+}
+
+// getComparisons returns the earlier windows that the report window is compared against. Windows that have already
+// been evicted cannot be compared against, so they are left out.
+func (s *StatsType) getComparisons(w StatsWindow) []statsComparison {
+	var comparisons []statsComparison
+	for _, offset := range s.getCompareOffsets(s.Duration, s.paneDuration()) {
+		i := findWindowEnding(&s.Windows, w.End.Add(-offset))
+		if i < 0 {
+			continue
+		}
+		ref, err := s.getReportWindow(i)
+		// Some of the panes of the window may have been evicted already
+		if err != nil || !ref.Start.Equal(w.Start.Add(-offset)) {
+			continue
+		}
+		comparisons = append(comparisons, statsComparison{Name: s.getComparisonName(offset, s.Duration), Window: ref})
+	}
+	return comparisons
+}
+
+// getComparisons returns the earlier rollup windows that the rollup window is compared against.
+func (r *StatsRollup) getComparisons(s *StatsType, w StatsWindow) []statsComparison {
+	var comparisons []statsComparison
+	for _, offset := range s.getCompareOffsets(r.Duration, r.Duration) {
+		i := findWindowEnding(&r.Windows, w.End.Add(-offset))
+		if i < 0 {
+			continue
+		}
+		comparisons = append(comparisons, statsComparison{Name: s.getComparisonName(offset, r.Duration), Window: *r.Windows.At(i)})
+	}
+	return comparisons
+}
+
+// getCompareOffsets returns how long before each window of the given duration the windows it's compared against are.
+// Windows end every step, so offsets that are not a multiple of it do not line up with any window, and are left out.
+func (s *StatsType) getCompareOffsets(duration, step time.Duration) []time.Duration {
+	var offsets []time.Duration
+	if s.ComparePrevious {
+		offsets = append(offsets, duration)
+	}
+	for _, offset := range s.CompareOffsets {
+		if offset%step != 0 || (s.ComparePrevious && offset == duration) {
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+func (s *StatsType) getComparisonName(offset, duration time.Duration) string {
+	if s.ComparePrevious && offset == duration {
+		return "prev"
+	}
+	return formatWholeDuration(offset)
+}
+
+// findWindowEnding returns the index of the window that ends at the given time, or -1 if there is none.
+func findWindowEnding(windows *StatsWindowRing, end time.Time) int {
+	for i := windows.Len() - 1; i >= 0; i-- {
+		w := windows.At(i)
+		if w.End.Equal(end) && !w.Start.IsZero() {
+			return i
+		}
+		if w.End.Before(end) {
+			break
+		}
+	}
+	return -1
+}
+
+// formatChanges shows how the count of the key changed against each of the earlier windows e.g. "prev: +12 (+3.4%)",
+// or "new" if the key was not there.
+func formatChanges(key string, count int, comparisons []statsComparison) string {
+	var changes []string
+	for _, c := range comparisons {
+		change := formatChange(key, count, c.Window)
+		if change == "" {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s", c.Name, change))
+	}
+	return strings.Join(changes, ", ")
+}
+
+func formatChange(key string, count int, ref StatsWindow) string {
+	refStats, exists := ref.StatsMap[key]
+	if !exists {
+		// With a bounded counter, the key may have been there, but not kept
+		if ref.getMissingCount() > 0 {
+			return ""
+		}
+		return "new"
+	}
+	delta := count - refStats.Count
+	return fmt.Sprintf("%+d (%+.1f%%)", delta, float64(delta)*100/float64(refStats.Count))
+}
+
+// formatGoneKeys lists the most frequent keys of each earlier window that are no longer there.
+func (s *StatsType) formatGoneKeys(w StatsWindow, comparisons []statsComparison, indent string) string {
+	// With a bounded counter, the keys may still be there, but not kept
+	if w.getMissingCount() > 0 {
+		return ""
+	}
+	var msg string
+	for _, c := range comparisons {
+		var gone []string
+		for _, k := range c.Window.topKeys(-1) {
+			if _, exists := w.StatsMap[k]; exists {
+				continue
+			}
+			gone = append(gone, fmt.Sprintf("%s (%d)", strings.Join(splitGroupKey(k), ", "), c.Window.StatsMap[k].Count))
+			if s.TopN > 0 && len(gone) >= s.TopN {
+				break
+			}
+		}
+		if len(gone) > 0 {
+			msg = msg + fmt.Sprintf("%sGone since %s\t:\t%s\n", indent, c.Name, strings.Join(gone, ", "))
+		}
+	}
+	return msg
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S T A T S  -  G R O U P  B Y
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// StatsReportFormat determines how the groups of a stats type with a group by are shown in the report.
+type StatsReportFormat string
+
+const (
+	// StatsReportTable shows one row per group, with a column per group by expression, the count and each aggregation.
+	StatsReportTable StatsReportFormat = "table"
+	// StatsReportTree nests the groups by each group by expression in turn, with the counts of each level.
+	StatsReportTree StatsReportFormat = "tree"
+)
+
+// statsGroupSeparator joins the values of a group into the key of the group in StatsWindow.StatsMap. It's a control
+// character, so it's not expected in the values themselves.
+const statsGroupSeparator = "\x1f"
+
+// ParseStatsGroupBy compiles the group by expressions of a stats type.
+func ParseStatsGroupBy(strs []string) ([]*ValueExpr, error) {
+	var exprs []*ValueExpr
+	for _, str := range strs {
+		e, err := CompileValueExpr(str)
+		if err != nil {
+			return nil, fmt.Errorf("group by: %w", err)
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, nil
+}
+
+// ParseStatsReportFormat parses the report format from the config. Empty means table.
+func ParseStatsReportFormat(str string) (StatsReportFormat, error) {
+	switch StatsReportFormat(str) {
+	case "", StatsReportTable:
+		return StatsReportTable, nil
+	case StatsReportTree:
+		return StatsReportTree, nil
+	}
+	return "", fmt.Errorf("report format '%s' not recognized", str)
+}
+
+// getGroupKey evaluates the group by expressions against the log, and returns the key of its group.
+func (s *StatsType) getGroupKey(msg LogMessageStructured) (string, error) {
+	values, err := getGroupValues(s.GroupBy, msg)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(values, statsGroupSeparator), nil
+}
+
+// getGroupValues evaluates the group by expressions against the log.
+func getGroupValues(exprs []*ValueExpr, msg LogMessageStructured) ([]string, error) {
+	var values = make([]string, len(exprs))
+	for i, e := range exprs {
+		v, err := e.Eval(msg.KV)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// splitGroupKey returns the values that make up the key of a group.
+func splitGroupKey(key string) []string {
+	return strings.Split(key, statsGroupSeparator)
+}
+
+// formatGroupTable shows the top groups of the window as a table, with a row per group.
+func (s *StatsType) formatGroupTable(w StatsWindow, comparisons []statsComparison) string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+	var header []string
+	for _, e := range s.GroupBy {
+		header = append(header, e.String())
+	}
+	header = append(header, "count")
+	for _, agg := range s.Aggregations {
+		header = append(header, agg.Name)
+	}
+	for _, c := range comparisons {
+		header = append(header, "vs "+c.Name)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, k := range w.topKeys(s.TopN) {
+		stats := w.StatsMap[k]
+		row := append(splitGroupKey(k), formatHeavyHitterCount(stats.Count, stats.CountError))
+		for _, agg := range s.Aggregations {
+			v, ok := agg.Compute(stats, w.End.Sub(w.Start))
+			if !ok {
+				row = append(row, "-")
+				continue
+			}
+			row = append(row, agg.Format(v))
+		}
+		for _, c := range comparisons {
+			change := formatChange(k, stats.Count, c.Window)
+			if change == "" {
+				change = "-"
+			}
+			row = append(row, change)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+
+	var msg string
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		msg = msg + "\t\t" + line + "\n"
+	}
+	return msg
+}
+
+// statsGroupNode is a level of the group tree e.g. the '/api' section, under which are its statuses.
+type statsGroupNode struct {
+	Value      string
+	Count      int
+	CountError int
+	Key        string // the key of the group, for the last level
+	Children   []*statsGroupNode
+}
+
+func (n *statsGroupNode) child(value string) *statsGroupNode {
+	for _, c := range n.Children {
+		if c.Value == value {
+			return c
+		}
+	}
+	c := &statsGroupNode{Value: value}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// sortStatsGroupNodes orders the levels of the tree the same way as the groups: most frequent first.
+func sortStatsGroupNodes(nodes []*statsGroupNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Count != nodes[j].Count {
+			return nodes[i].Count > nodes[j].Count
+		}
+		return nodes[i].Value < nodes[j].Value
+	})
+	for _, n := range nodes {
+		sortStatsGroupNodes(n.Children)
+	}
+}
+
+// formatGroupTree shows the top groups of the window as a tree, nested by each group by expression in turn. The counts
+// of the upper levels are the sums of the top groups under them.
+func (s *StatsType) formatGroupTree(w StatsWindow, comparisons []statsComparison) string {
+	var root statsGroupNode
+	for _, k := range w.topKeys(s.TopN) {
+		stats := w.StatsMap[k]
+		node := &root
+		for _, v := range splitGroupKey(k) {
+			node = node.child(v)
+			node.Count += stats.Count
+			node.CountError += stats.CountError
+		}
+		node.Key = k
+	}
+	sortStatsGroupNodes(root.Children)
+
+	var names []string
+	for _, e := range s.GroupBy {
+		names = append(names, e.String())
+	}
+	msg := fmt.Sprintf("\t\tGrouped by %s\n", strings.Join(names, " > "))
+	return msg + s.formatGroupTreeNodes(w, root.Children, "\t\t", comparisons)
+}
+
+func (s *StatsType) formatGroupTreeNodes(w StatsWindow, nodes []*statsGroupNode, indent string, comparisons []statsComparison) string {
+	var msg string
+	for _, n := range nodes {
+		if len(n.Children) == 0 {
+			stats := w.StatsMap[n.Key]
+			msg = msg + s.formatStats(n.Value, stats, w.End.Sub(w.Start), indent, formatChanges(n.Key, stats.Count, comparisons))
+			continue
+		}
+		msg = msg + fmt.Sprintf("%s%s\t:\t%s\n", indent, n.Value, formatHeavyHitterCount(n.Count, n.CountError))
+		msg = msg + s.formatGroupTreeNodes(w, n.Children, indent+"\t", comparisons)
+	}
+	return msg
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/teejays/logdoc/config"
+
+	"github.com/teejays/clog"
+)
+
+/* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * *
+*  S T A T S  -  R O L L U P S
+* * * * * * * * *  * * * * * * * * * * * * * * * * * * * * * * * */
+
+// StatsRollup is a coarser resolution of a stats type e.g. 1h windows made of its 10s windows. Rollups are chained from
+// the finest to the coarsest: the first one is fed the complete panes of the stats type, and each one after is fed the
+// complete windows of the one before, which it merges into its own windows. So a log is only processed once, however
+// many resolutions are reported. A rollup window is complete, and reported, once the windows fed to it move past its end.
+// With a ReportInterval shorter than its duration, the rollup window in progress is also reported every ReportInterval.
+type StatsRollup struct {
+	Duration         time.Duration
+	ReportInterval   time.Duration // how often the window in progress is reported, the rollup duration to only report it when it ends
+	RetentionWindows int           // number of windows kept in memory, 0 or less for no limit
+	RetentionAge     time.Duration // how long windows are kept in memory after they end, 0 for no limit
+	Windows          StatsWindowRing
+	EvictedCount     int // number of windows evicted from memory
+
+	next *StatsRollup
+}
+
+func NewStatsRollupsFromConfig(cfgs []config.ConfigStatsRollup, paneDuration time.Duration) ([]*StatsRollup, error) {
+	var rollups []*StatsRollup
+	prev := paneDuration
+	for _, cfg := range cfgs {
+		r := StatsRollup{
+			Duration:         time.Duration(cfg.DurationSeconds * int64(time.Second)),
+			RetentionWindows: DefaultStatsRetentionWindows,
+			RetentionAge:     time.Duration(cfg.RetentionSeconds * int64(time.Second)),
+			ReportInterval:   time.Duration(cfg.ReportSeconds * int64(time.Second)),
+		}
+		if r.ReportInterval == 0 {
+			r.ReportInterval = r.Duration
+		}
+		if cfg.RetentionWindows != 0 {
+			r.RetentionWindows = cfg.RetentionWindows
+		}
+		r.Windows = NewStatsWindowRing(statsWindowRingCapacity(r.RetentionWindows))
+		if r.RetentionAge < 0 {
+			return nil, fmt.Errorf("rollup of %s: retention seconds cannot be negative", r.Duration)
+		}
+		// Windows are rolled up whole, so each resolution needs to be a multiple of the one before it
+		if prev <= 0 || r.Duration <= prev || r.Duration%prev != 0 {
+			return nil, fmt.Errorf("rollup of %s should be a multiple of %s, the resolution before it", r.Duration, prev)
+		}
+		// The window in progress can only be reported once a whole window of the resolution before it is merged
+		if r.ReportInterval < 0 || r.ReportInterval%prev != 0 || r.Duration%r.ReportInterval != 0 {
+			return nil, fmt.Errorf("rollup of %s: report seconds should be a multiple of %s, and divide %s", r.Duration, prev, r.Duration)
+		}
+		prev = r.Duration
+
+		if len(rollups) > 0 {
+			rollups[len(rollups)-1].next = &r
+		}
+		rollups = append(rollups, &r)
+	}
+	return rollups, nil
+}
+
+// feed merges a complete window of the resolution before into the rollup window it falls in. The rollup windows that
+// end before it are complete, so they are reported and fed to the next rollup.
+func (r *StatsRollup) feed(s *StatsType, w StatsWindow) error {
+	if r.Windows.Len() < 1 {
+		start := w.Start
+		if s.Align {
+			start = alignTime(w.Start, r.Duration, s.Location)
+		}
+		r.Windows.Append(s.newMergedWindow(start, start.Add(r.Duration)))
+	}
+
+	for !w.Start.Before(r.Windows.Last().End) {
+		err := r.complete(s, r.Windows.Len()-1)
+		if err != nil {
+			return err
+		}
+		last := r.Windows.Last()
+		r.Windows.Append(s.newMergedWindow(last.End, last.End.Add(r.Duration)))
+	}
+
+	i := r.findWindow(w.Start)
+	if i < 0 {
+		clog.Debugf("[%s] Window from %s is older than the %s rollup windows, skipping it", s.Name, w.Start, formatWholeDuration(r.Duration))
+		return nil
+	}
+	err := r.Windows.At(i).merge(w)
+	if err != nil {
+		return err
+	}
+	r.reportInProgress(s, i, w.End)
+
+	r.evictWindows(s)
+	return nil
+}
+
+// addLate adds a late log, whose window has already been fed to this rollup, to the first rollup window that has not
+// been reported yet.
+func (r *StatsRollup) addLate(t time.Time, lv StatsLogValues) {
+	for ; r != nil; r = r.next {
+		i := r.findWindow(t)
+		if i < 0 || r.Windows.At(i).Reported {
+			continue
+		}
+		r.Windows.At(i).add(lv)
+		return
+	}
+}
+
+// complete reports the rollup window, and feeds it to the next rollup.
+func (r *StatsRollup) complete(s *StatsType, windowIndex int) error {
+	w := *r.Windows.At(windowIndex)
+	if w.Reported {
+		return nil
+	}
+	r.Windows.At(windowIndex).Reported = true
+
+	title := fmt.Sprintf("%s Rollup Report", formatWholeDuration(r.Duration))
+	clog.Notice(s.formatReport(title, w, r.getComparisons(s, w)))
+
+	if r.next == nil {
+		return nil
+	}
+	return r.next.feed(s, w)
+}
+
+// reportInProgress reports the rollup window so far, if it is still in progress at end and a ReportInterval has passed
+// since it started. It is not compared to the earlier windows, as they are whole.
+func (r *StatsRollup) reportInProgress(s *StatsType, windowIndex int, end time.Time) {
+	w := *r.Windows.At(windowIndex)
+	if r.ReportInterval >= r.Duration || w.Reported || !end.Before(w.End) || end.Sub(w.Start)%r.ReportInterval != 0 {
+		return
+	}
+	w.End = end
+
+	title := fmt.Sprintf("%s Rollup Report (so far)", formatWholeDuration(r.Duration))
+	clog.Notice(s.formatReport(title, w, nil))
+}
+
+// flush reports all the windows that have not been reported yet, in this rollup and the ones after it.
+func (r *StatsRollup) flush(s *StatsType) error {
+	for i := 0; i < r.Windows.Len(); i++ {
+		err := r.complete(s, i)
+		if err != nil {
+			return err
+		}
+	}
+	if r.next == nil {
+		return nil
+	}
+	return r.next.flush(s)
+}
+
+// findWindow returns the index of the window that t falls in, or -1 if there is none.
+func (r *StatsRollup) findWindow(t time.Time) int {
+	if r.Windows.Len() < 1 || t.Before(r.Windows.At(0).Start) {
+		return -1
+	}
+	i := int(t.Sub(r.Windows.At(0).Start) / r.Duration)
+	if i >= r.Windows.Len() {
+		return -1
+	}
+	return i
+}
+
+// evictWindows drops the oldest reported windows from memory, as long as they are over the retention limits.
+func (r *StatsRollup) evictWindows(s *StatsType) {
+	// Always keep the latest window
+	var n int
+	for n < r.Windows.Len()-1 {
+		w := r.Windows.At(n)
+		overCount := r.RetentionWindows > 0 && r.Windows.Len()-n > r.RetentionWindows
+		overAge := r.RetentionAge > 0 && s.LatestTimestamp.Sub(w.End) > r.RetentionAge
+		if !(overCount || overAge) || !w.Reported {
+			break
+		}
+		n++
+	}
+	if n < 1 {
+		return
+	}
+
+	if s.Archiver != nil {
+		name := fmt.Sprintf("%s (%s rollup)", s.Name, formatWholeDuration(r.Duration))
+		for i := 0; i < n; i++ {
+			err := s.Archiver.ArchiveStatsWindow(name, *r.Windows.At(i))
+			if err != nil {
+				clog.Errorf("[%s] Could not archive the stats window from %s to %s: %s", name, r.Windows.At(i).Start, r.Windows.At(i).End, err)
+			}
+		}
+	}
+
+	r.Windows.DropFront(n)
+	r.EvictedCount += n
+}
+
+// formatWholeDuration shows the duration in its largest whole unit e.g. 1h rather than 1h0m0s.
+func formatWholeDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
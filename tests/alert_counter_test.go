@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+// linkedListCounter is the rolling count as alert types used to keep it, before RollingCounter: an ordered list with a
+// node for every log within the duration. Add is a port of the addToChain and dropOldLogMessages methods of AlertType,
+// kept as they were, to check that RollingCounter counts the same, and to benchmark against.
+//
+// The list has a known bug, kept here: a log that goes before the oldest node is not linked to it, so the rest of the
+// list can no longer be reached from the oldest node, and is never dropped. From then on, the count no longer goes
+// down for those logs, and differs from RollingCounter. LostTail tells when that happened.
+type linkedListCounter struct {
+	Duration       time.Duration
+	Count          int
+	NumeratorCount int
+	LostTail       bool
+	latest         *linkedListNode
+	oldest         *linkedListNode
+}
+
+type linkedListNode struct {
+	T           time.Time
+	InNumerator bool
+	Previous    *linkedListNode
+	Next        *linkedListNode
+}
+
+func (l *linkedListCounter) Add(t time.Time, inNumerator bool) {
+	l.addToChain(t, inNumerator)
+	numRemoved := l.dropOldLogMessages()
+	l.Count = l.Count + 1 - numRemoved // + 1 for the new node which was added
+}
+
+func (l *linkedListCounter) addToChain(t time.Time, inNumerator bool) {
+
+	// Inject the  new log into the chain
+	var currentNode = l.latest
+
+	// Loop and find the log node before which we should place this log.
+	for {
+		if currentNode != nil && t.Before(currentNode.T) {
+			currentNode = currentNode.Previous
+			continue
+		}
+
+		var newLogNode linkedListNode
+		newLogNode.T = t
+		newLogNode.InNumerator = inNumerator
+		if inNumerator {
+			l.NumeratorCount++
+		}
+		newLogNode.Previous = currentNode
+
+		if currentNode != nil {
+			newLogNode.Next = currentNode.Next
+			currentNode.Next = &newLogNode
+		}
+
+		// if we're adding as last node
+		if newLogNode.Next == nil {
+			l.latest = &newLogNode
+		}
+
+		// if we're placing it at first node
+		if newLogNode.Previous == nil {
+			if l.oldest != nil {
+				l.LostTail = true
+			}
+			l.oldest = &newLogNode
+		}
+
+		break
+	}
+}
+
+func (l *linkedListCounter) dropOldLogMessages() int {
+
+	// Tree shake the cache to: start loop from the very bottom and reach a point at which we can cut off the tail
+	latestTimestamp := l.latest.T
+	currentNode := l.oldest
+	var numNodesRemoved int
+
+	for {
+		if latestTimestamp.Sub(currentNode.T) > l.Duration {
+			if currentNode.InNumerator {
+				l.NumeratorCount--
+			}
+			currentNode = currentNode.Next
+			numNodesRemoved++
+			continue
+		}
+		if currentNode == nil { // means we should shake off everything
+			l.oldest = nil
+			l.latest = nil
+			break
+		}
+
+		// If we reach a point where the current node is within 2 mins of latest node, cut of everything below it
+		if currentNode.Previous != nil { // remove the next reference from the previous node
+			currentNode.Previous.Next = nil
+		}
+
+		currentNode.Previous = nil // remove the previous reference from the current node
+
+		// this should break the chain
+		l.oldest = currentNode
+		break
+	}
+
+	return numNodesRemoved
+}
+
+// readSampleLogs reads the logs of the sample file in example/. Tests run from either the root of the repo or tests/.
+func readSampleLogs(t testing.TB) []LogMessageStructured {
+	path := filepath.Join("example", "sample_csv.txt")
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join("..", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open the sample file: %s", err)
+	}
+	defer f.Close()
+
+	settings, err := NewLogSourceSettingsFromConfig(config.ConfigLogSourceSettings{
+		Format:          "csv",
+		TimestampKey:    "date",
+		TimestampFormat: "unix",
+		Headers:         []string{"remotehost", "rfc931", "authuser", "date", "request", "status", "bytes"},
+	})
+	if err != nil {
+		t.Fatalf("could not set up log source settings: %s", err)
+	}
+
+	var msgs []LogMessageStructured
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // the header
+	for scanner.Scan() {
+		msg, err := NewLogMessageStructured(LogMessage{Id: int64(len(msgs)), SourceName: "sample_csv", Message: scanner.Text()}, settings)
+		if err != nil {
+			t.Fatalf("could not parse a sample log: %s", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// TestRollingCounter_SampleFile checks the rolling count after every log of the sample file, which are a little out of
+// order, against counting the logs so far that are at most the duration before the latest one, and against the linked
+// list that alert types used before. The linked list loses its tail on the first log that is older than all the others
+// (see linkedListCounter), which the sample file has early on, so it counts the same only once the logs are in order.
+// With the logs as they are, its count is only allowed to differ once it lost its tail.
+func TestRollingCounter_SampleFile(t *testing.T) {
+	logs := readSampleLogs(t)
+	numerator, err := CompileFilter("status >= 500")
+	assert.Nil(t, err)
+	var inNumerator = make(map[int64]bool, len(logs))
+	for _, msg := range logs {
+		inNumerator[msg.Id], err = numerator.Match(msg.KV)
+		assert.Nil(t, err)
+	}
+	sorted := append([]LogMessageStructured(nil), logs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].T.Before(sorted[j].T) })
+
+	for _, seconds := range []int64{1, 10, 120} {
+		duration := time.Duration(seconds) * time.Second
+
+		// In order, the linked list counts the same
+		r, err := NewRollingCounter(duration, time.Second)
+		assert.Nil(t, err)
+		l := linkedListCounter{Duration: duration}
+		for i, msg := range sorted {
+			r.Add(msg.T, inNumerator[msg.Id])
+			l.Add(msg.T, inNumerator[msg.Id])
+			if r.Count != l.Count || r.NumeratorCount != l.NumeratorCount {
+				t.Errorf("duration %s, sorted log %d: rolling count is %d (%d in the numerator), linked list count is %d (%d)", duration, i, r.Count, r.NumeratorCount, l.Count, l.NumeratorCount)
+				return
+			}
+		}
+		assert.False(t, l.LostTail)
+
+		// Out of order, the linked list differs once it lost its tail, but the rolling count still counts the logs
+		// within the duration
+		r, err = NewRollingCounter(duration, time.Second)
+		assert.Nil(t, err)
+		l = linkedListCounter{Duration: duration}
+		var latest time.Time
+		var differs bool
+		for i, msg := range logs {
+			r.Add(msg.T, inNumerator[msg.Id])
+			l.Add(msg.T, inNumerator[msg.Id])
+			if r.Count != l.Count || r.NumeratorCount != l.NumeratorCount {
+				differs = true
+				if !l.LostTail {
+					t.Errorf("duration %s, log %d: rolling count is %d (%d in the numerator), linked list count is %d (%d)", duration, i, r.Count, r.NumeratorCount, l.Count, l.NumeratorCount)
+					return
+				}
+			}
+
+			if msg.T.After(latest) {
+				latest = msg.T
+			}
+			var count, numeratorCount int
+			for _, prev := range logs[:i+1] {
+				if latest.Sub(prev.T) > duration {
+					continue
+				}
+				count++
+				if inNumerator[prev.Id] {
+					numeratorCount++
+				}
+			}
+			if r.Count != count || r.NumeratorCount != numeratorCount {
+				t.Errorf("duration %s, log %d: rolling count is %d (%d in the numerator), want %d (%d)", duration, i, r.Count, r.NumeratorCount, count, numeratorCount)
+				return
+			}
+		}
+		assert.True(t, differs, "duration %s: the linked list should have lost its tail", duration)
+	}
+}
+
+func TestRollingCounter(t *testing.T) {
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name          string
+		duration      time.Duration
+		resolution    time.Duration
+		offsets       []time.Duration
+		wantCount     int
+		wantLatestOff time.Duration
+	}{
+		{name: "within the duration", duration: 10 * time.Second, resolution: time.Second, offsets: []time.Duration{0, 5 * time.Second, 10 * time.Second}, wantCount: 3, wantLatestOff: 10 * time.Second},
+		{name: "drops logs out of the duration", duration: 10 * time.Second, resolution: time.Second, offsets: []time.Duration{0, 5 * time.Second, 11 * time.Second}, wantCount: 2, wantLatestOff: 11 * time.Second},
+		{name: "counts logs out of order", duration: 10 * time.Second, resolution: time.Second, offsets: []time.Duration{5 * time.Second, 0, 3 * time.Second}, wantCount: 3, wantLatestOff: 5 * time.Second},
+		{name: "does not count logs that are too old", duration: 10 * time.Second, resolution: time.Second, offsets: []time.Duration{20 * time.Second, 0, 9 * time.Second}, wantCount: 1, wantLatestOff: 20 * time.Second},
+		{name: "empties the ring after a gap", duration: 10 * time.Second, resolution: time.Second, offsets: []time.Duration{0, 0, time.Hour}, wantCount: 1, wantLatestOff: time.Hour},
+		{name: "rounds down to the resolution", duration: 60 * time.Second, resolution: 10 * time.Second, offsets: []time.Duration{5 * time.Second, 68 * time.Second}, wantCount: 2, wantLatestOff: 68 * time.Second},
+		{name: "drops whole buckets", duration: 60 * time.Second, resolution: 10 * time.Second, offsets: []time.Duration{5 * time.Second, 71 * time.Second}, wantCount: 1, wantLatestOff: 71 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRollingCounter(tt.duration, tt.resolution)
+			if err != nil {
+				t.Errorf("could not create the rolling counter: %s", err)
+				return
+			}
+			for _, o := range tt.offsets {
+				r.Add(now.Add(o), false)
+			}
+			assert.Equal(t, tt.wantCount, r.Count)
+			assert.Equal(t, now.Add(tt.wantLatestOff), r.Latest)
+		})
+	}
+
+	_, err := NewRollingCounter(15*time.Second, 10*time.Second)
+	assert.NotNil(t, err)
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{DurationSeconds: 15, ResolutionSeconds: 10, Threshold: 5})
+	assert.NotNil(t, err)
+}
+
+// benchmarkRollingCount adds logs at 50k a second to a 120s rolling count, with every 100th log 10ms late.
+func benchmarkRollingCount(b *testing.B, add func(t time.Time, inNumerator bool)) {
+	start := time.Unix(1549573860, 0)
+	for i := 0; i < b.N; i++ {
+		t := start.Add(time.Duration(i) * time.Second / 50000)
+		if i%100 == 0 {
+			t = t.Add(-10 * time.Millisecond)
+		}
+		add(t, i%20 == 0)
+	}
+}
+
+func BenchmarkRollingCount(b *testing.B) {
+	b.Run("linked list", func(b *testing.B) {
+		b.ReportAllocs()
+		l := linkedListCounter{Duration: 120 * time.Second}
+		benchmarkRollingCount(b, l.Add)
+	})
+	b.Run("buckets", func(b *testing.B) {
+		b.ReportAllocs()
+		r, err := NewRollingCounter(120*time.Second, time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkRollingCount(b, r.Add)
+	})
+}
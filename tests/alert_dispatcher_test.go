@@ -0,0 +1,221 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+type memoryNotifier struct {
+	Notifications []Notification
+	lock          sync.Mutex
+}
+
+func (n *memoryNotifier) Notify(notification Notification) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.Notifications = append(n.Notifications, notification)
+	return nil
+}
+
+func (n *memoryNotifier) Close() error {
+	return nil
+}
+
+// Sent returns what was sent, as the names and states of the alerts of each notification.
+func (n *memoryNotifier) Sent() [][]string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var sent [][]string
+	for _, notification := range n.Notifications {
+		var alerts []string
+		for _, e := range notification.Events {
+			alerts = append(alerts, e.Alert.Name+" "+e.Alert.Labels["source"]+" "+string(e.Alert.State))
+		}
+		sent = append(sent, alerts)
+	}
+	return sent
+}
+
+// WaitFor waits until count notifications were sent, or a second.
+func (n *memoryNotifier) WaitFor(count int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		n.lock.Lock()
+		got := len(n.Notifications)
+		n.lock.Unlock()
+		if got >= count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestDispatcher(t *testing.T, req config.ConfigAlertRouting) (*AlertDispatcher, *memoryNotifier, AlertEventHandler) {
+	d, err := NewAlertDispatcherFromConfig(req)
+	if err != nil {
+		t.Fatalf("could not create dispatcher: %s", err)
+	}
+	q, err := NewNotifierQueueFromConfig(config.ConfigNotifier{Name: "test_memory", Type: "exec", Command: []string{"true"}})
+	if err != nil {
+		t.Fatalf("could not create notifier: %s", err)
+	}
+	var n memoryNotifier
+	q.Notifier = &n
+	q.Start()
+
+	h := d.Handler(q)
+	// Like an alert type, which has the dispatcher track its events before routing them
+	return d, &n, func(e AlertEvent) {
+		d.Track(e)
+		h(e)
+	}
+}
+
+func dispatchedEvent(name, source string, state, previous AlertState) AlertEvent {
+	e := testAlertEvent(state, previous)
+	e.Alert.ID = name + "/" + source
+	e.Alert.Name = name
+	e.Alert.Labels = map[string]string{"alertname": name, "source": source}
+	return e
+}
+
+func TestAlertDispatcher_Grouping(t *testing.T) {
+	d, n, handle := newTestDispatcher(t, config.ConfigAlertRouting{GroupBy: []string{"source"}})
+	d.GroupWait = 100 * time.Millisecond
+	d.GroupInterval = 100 * time.Millisecond
+
+	// Alerts that fire together, for the same source, are sent together once the group wait is over
+	handle(dispatchedEvent("High error rate", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateFiring)) // a repeat
+	assert.Equal(t, 0, len(n.Sent()))
+
+	n.WaitFor(2)
+	sent := n.Sent()
+	sort.Slice(sent, func(i, j int) bool { return len(sent[i]) > len(sent[j]) })
+	assert.Equal(t, [][]string{{"High error rate api firing", "Traffic low api firing"}, {"Traffic low web firing"}}, sent)
+
+	// The alerts that changed are sent after the group interval, and nothing is sent for groups that did not change
+	handle(dispatchedEvent("Traffic low", "api", AlertStateResolved, AlertStateFiring))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateFiring, AlertStateFiring))
+	n.WaitFor(3)
+	time.Sleep(150 * time.Millisecond)
+	sent = n.Sent()
+	if assert.Equal(t, 3, len(sent)) {
+		assert.Equal(t, []string{"Traffic low api resolved"}, sent[2])
+		assert.Equal(t, `{source="api"}`, n.Notifications[2].GroupKey)
+		assert.Equal(t, map[string]string{"source": "api"}, n.Notifications[2].GroupLabels)
+	}
+	d.Close()
+}
+
+func TestAlertDispatcher_Dedupe(t *testing.T) {
+	d, n, handle := newTestDispatcher(t, config.ConfigAlertRouting{})
+
+	// Without group by or waits, each alert is sent on its own, right away, but only when it changes
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateFiring)) // e.g. after flapping
+	handle(dispatchedEvent("Traffic low", "web", AlertStatePending, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateResolved, AlertStatePending)) // never sent
+	handle(dispatchedEvent("Traffic low", "api", AlertStateResolved, AlertStateFiring))
+	handle(dispatchedEvent("Traffic low", "api", AlertStateResolved, AlertStateFiring))
+	d.Close()
+	n.WaitFor(2)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, [][]string{{"Traffic low api firing"}, {"Traffic low api resolved"}}, n.Sent())
+}
+
+func TestAlertDispatcher_Repeat(t *testing.T) {
+	d, n, handle := newTestDispatcher(t, config.ConfigAlertRouting{GroupBy: []string{"source"}})
+	d.RepeatInterval = 50 * time.Millisecond
+
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateInactive))
+	n.WaitFor(3)
+	handle(dispatchedEvent("Traffic low", "api", AlertStateResolved, AlertStateFiring))
+	n.WaitFor(4)
+	sent := n.Sent()
+	if assert.True(t, len(sent) >= 4) {
+		for _, alerts := range sent[:len(sent)-1] {
+			assert.Equal(t, []string{"Traffic low api firing"}, alerts)
+		}
+		assert.Equal(t, []string{"Traffic low api resolved"}, sent[len(sent)-1])
+	}
+
+	// Nothing is repeated once it's resolved
+	count := len(sent)
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, count, len(n.Sent()))
+	d.Close()
+}
+
+func TestAlertDispatcher_Inhibition(t *testing.T) {
+	d, n, handle := newTestDispatcher(t, config.ConfigAlertRouting{
+		InhibitRules: []config.ConfigInhibitRule{{
+			SourceMatch: map[string]string{"alertname": "Source silent"},
+			TargetMatch: map[string]string{"alertname": "Traffic low"},
+			Equal:       []string{"source"},
+		}},
+	})
+
+	// The silent source mutes the low traffic of the same source only
+	handle(dispatchedEvent("Source silent", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "db", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "db", AlertStateResolved, AlertStateFiring))
+	n.WaitFor(4)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, [][]string{{"Source silent api firing"}, {"Traffic low web firing"}, {"Traffic low db firing"}, {"Traffic low db resolved"}}, n.Sent())
+
+	// Once the source is back, what it muted and is still firing is sent
+	handle(dispatchedEvent("Source silent", "api", AlertStateResolved, AlertStateFiring))
+	n.WaitFor(6)
+	d.Close()
+	time.Sleep(20 * time.Millisecond)
+	sent := n.Sent()
+	if assert.Equal(t, 6, len(sent)) {
+		assert.ElementsMatch(t, [][]string{{"Source silent api resolved"}, {"Traffic low api firing"}}, sent[4:])
+	}
+
+	// A muted alert that resolves was never sent, so its resolution is not sent either
+	d, n, handle = newTestDispatcher(t, config.ConfigAlertRouting{
+		InhibitRules: []config.ConfigInhibitRule{{SourceMatch: map[string]string{"alertname": "Source silent"}, TargetMatch: map[string]string{"alertname": "Traffic low"}}},
+	})
+	handle(dispatchedEvent("Source silent", "api", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateFiring, AlertStateInactive))
+	handle(dispatchedEvent("Traffic low", "web", AlertStateResolved, AlertStateFiring))
+	d.Close()
+	n.WaitFor(1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, [][]string{{"Source silent api firing"}}, n.Sent())
+}
+
+func TestAlertDispatcher_Close(t *testing.T) {
+	d, n, handle := newTestDispatcher(t, config.ConfigAlertRouting{GroupBy: []string{"source"}, GroupWaitSeconds: 3600})
+
+	// Closing sends what's waiting for its group, and nothing after that
+	handle(dispatchedEvent("Traffic low", "api", AlertStateFiring, AlertStateInactive))
+	assert.Equal(t, 0, len(n.Sent()))
+	d.Close()
+	handle(dispatchedEvent("Traffic low", "api", AlertStateResolved, AlertStateFiring))
+	n.WaitFor(1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, [][]string{{"Traffic low api firing"}}, n.Sent())
+
+	invalid := []config.ConfigAlertRouting{
+		{GroupWaitSeconds: -1},
+		{RepeatIntervalSeconds: -1},
+		{InhibitRules: []config.ConfigInhibitRule{{SourceMatch: map[string]string{"alertname": "Source silent"}}}},
+		{InhibitRules: []config.ConfigInhibitRule{{TargetMatch: map[string]string{"alertname": "Traffic low"}}}},
+	}
+	for _, req := range invalid {
+		_, err := NewAlertDispatcherFromConfig(req)
+		assert.NotNil(t, err, "config: %+v", req)
+	}
+}
@@ -40,7 +40,6 @@ func TestAlertType_ConsumeLog(t *testing.T) {
 		durationSeconds      int64
 		threshold            int
 		priorLogMessages     []LogMessageStructured
-		priorOldestNodeIndex int
 		priorLatestNodeIndex int
 		priorAssertions      func(*testing.T, *AlertType)
 		newLogMessage        LogMessageStructured
@@ -80,7 +79,6 @@ func TestAlertType_ConsumeLog(t *testing.T) {
 					},
 				},
 			},
-			priorOldestNodeIndex: 0, // 1st element from pastLogMessages will be the oldest
 			priorLatestNodeIndex: 2,
 			priorAssertions: func(t *testing.T, c *AlertType) {
 				assert.Equal(t, false, c.AlertOngoing)
@@ -147,8 +145,7 @@ func TestAlertType_ConsumeLog(t *testing.T) {
 					},
 				},
 			},
-			priorOldestNodeIndex: 0, // 2nd element from pastLogMessages will be the oldest
-			priorLatestNodeIndex: 5, // 2nd element from pastLogMessages will be the oldest
+			priorLatestNodeIndex: 5,
 			priorAssertions: func(t *testing.T, c *AlertType) {
 				assert.Equal(t, true, c.AlertOngoing)
 				assert.Equal(t, 6, c.CurrentMovingCount)
@@ -188,8 +185,7 @@ func TestAlertType_ConsumeLog(t *testing.T) {
 			}
 
 			// Prior Assertions
-			assert.Equal(t, tt.priorLogMessages[tt.priorLatestNodeIndex].LogMessage, c.LatestLogNode.LogMessage)
-			assert.Equal(t, tt.priorLogMessages[tt.priorOldestNodeIndex].LogMessage, c.OldestLogNode.LogMessage)
+			assert.Equal(t, tt.priorLogMessages[tt.priorLatestNodeIndex].T, c.Counter.Latest)
 
 			if tt.priorAssertions != nil {
 				tt.priorAssertions(t, c)
@@ -214,3 +210,564 @@ func TestAlertType_ConsumeLog(t *testing.T) {
 		})
 	}
 }
+
+func TestAlertType_Anomaly(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	// A log every second for the first 100s, then either a spike of 50 logs, or a log every 5s
+	steady := func(n int) []time.Time {
+		var ts []time.Time
+		for i := 0; i < n; i++ {
+			ts = append(ts, now.Add(time.Duration(i)*time.Second))
+		}
+		return ts
+	}
+	spikeAt := func(seconds int) []time.Time {
+		ts := steady(seconds)
+		for i := 0; i < 50; i++ {
+			ts = append(ts, now.Add(time.Duration(seconds)*time.Second))
+		}
+		return ts
+	}
+	drop := func() []time.Time {
+		ts := steady(100)
+		for i := 0; i < 4; i++ {
+			ts = append(ts, now.Add(time.Duration(100+5*i)*time.Second))
+		}
+		return ts
+	}
+
+	tests := []struct {
+		name      string
+		cfg       config.ConfigAlertType
+		logs      []time.Time
+		wantAlert bool
+	}{
+		{name: "steady traffic", cfg: config.ConfigAlertType{}, logs: steady(200), wantAlert: false},
+		{name: "spike", cfg: config.ConfigAlertType{}, logs: spikeAt(100), wantAlert: true},
+		{name: "spike during the warm up", cfg: config.ConfigAlertType{}, logs: spikeAt(30), wantAlert: false},
+		{name: "spike below the minimum count", cfg: config.ConfigAlertType{MinCount: 100}, logs: spikeAt(100), wantAlert: false},
+		{name: "spike, only looking for drops", cfg: config.ConfigAlertType{Direction: "down"}, logs: spikeAt(100), wantAlert: false},
+		{name: "spike with a median baseline", cfg: config.ConfigAlertType{Baseline: "mad"}, logs: spikeAt(100), wantAlert: true},
+		{name: "drop", cfg: config.ConfigAlertType{}, logs: drop(), wantAlert: true},
+		{name: "drop, only looking for spikes", cfg: config.ConfigAlertType{Direction: "up"}, logs: drop(), wantAlert: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "Test Anomaly Alert"
+			tt.cfg.Kind = "anomaly"
+			tt.cfg.DurationSeconds = 10
+			tt.cfg.BaselineWindows = 10
+			tt.cfg.WarmupWindows = 5
+			tt.cfg.SourceSettings = []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}}
+			c, err := NewAlertTypeFromConfig(tt.cfg)
+			if err != nil {
+				t.Errorf("could not generate AlertType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, ts := range tt.logs {
+				err := c.ConsumeLog(LogMessageStructured{T: ts, LogMessage: LogMessage{SourceName: "test_source"}})
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.wantAlert, len(c.Alerts) > 0)
+		})
+	}
+
+	_, err := NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "anomaly", DurationSeconds: 10, Baseline: "mean"})
+	assert.NotNil(t, err)
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "unknown"})
+	assert.NotNil(t, err)
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "anomaly", DurationSeconds: 10, Clock: "wall"})
+	assert.NotNil(t, err)
+}
+
+func TestAlertType_Anomaly_StreamStops(t *testing.T) {
+	clog.LogLevel = 1
+	start := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name      string
+		clock     string
+		direction string
+		flushes   []time.Duration // after the latest log
+		wantAlert bool
+	}{
+		{name: "just after the latest log", clock: "processing", flushes: []time.Duration{2 * time.Second}, wantAlert: false},
+		{name: "once the rolling count is empty", clock: "processing", flushes: []time.Duration{2 * time.Second, 12 * time.Second}, wantAlert: true},
+		{name: "only looking for spikes", clock: "processing", direction: "up", flushes: []time.Duration{2 * time.Second, 12 * time.Second}, wantAlert: false},
+		{name: "event clock, e.g. replaying a file", clock: "event", flushes: []time.Duration{2 * time.Second, 12 * time.Second}, wantAlert: false},
+		{name: "auto clock without a live source", flushes: []time.Duration{2 * time.Second, 12 * time.Second}, wantAlert: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+				Name:            "Test Anomaly Alert",
+				Kind:            "anomaly",
+				DurationSeconds: 10,
+				BaselineWindows: 10,
+				WarmupWindows:   5,
+				Direction:       tt.direction,
+				Clock:           tt.clock,
+				SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate AlertType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(start)
+
+			// A log every second for 100s, and then none at all
+			var latest time.Time
+			for i := 0; i < 100; i++ {
+				latest = start.Add(time.Duration(i) * time.Second)
+				err := c.ConsumeLog(LogMessageStructured{T: latest, LogMessage: LogMessage{SourceName: "test_source", ReceivedAt: latest}})
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, 0, len(c.Alerts))
+
+			for _, d := range tt.flushes {
+				assert.Nil(t, c.Flush(latest.Add(d)))
+			}
+			assert.Equal(t, tt.wantAlert, c.AlertOngoing)
+			if tt.wantAlert {
+				assert.Equal(t, 0, c.CurrentMovingCount)
+				assert.Equal(t, latest.Add(12*time.Second), c.Alerts[0].Start)
+			}
+		})
+	}
+}
+
+func TestAlertType_Ratio(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	// n logs at the given offset, the last errors of which have a 500 status
+	logs := func(offsetSeconds, n, errors int) []LogMessageStructured {
+		var msgs []LogMessageStructured
+		for i := 0; i < n; i++ {
+			status := "200"
+			if i >= n-errors {
+				status = "500"
+			}
+			msgs = append(msgs, LogMessageStructured{
+				KV:         map[string]string{"status": status},
+				T:          now.Add(time.Duration(offsetSeconds) * time.Second),
+				LogMessage: LogMessage{SourceName: "test_source"},
+			})
+		}
+		return msgs
+	}
+
+	tests := []struct {
+		name           string
+		logs           []LogMessageStructured
+		wantAlerts     int
+		wantOngoing    bool
+		wantNumerators int
+	}{
+		{name: "below the minimum denominator", logs: logs(0, 19, 5), wantAlerts: 0, wantNumerators: 5},
+		{name: "below the ratio", logs: logs(0, 40, 1), wantAlerts: 0, wantNumerators: 1},
+		{name: "at the ratio", logs: logs(0, 40, 2), wantAlerts: 1, wantOngoing: true, wantNumerators: 2},
+		{name: "errors that are no longer in the rolling count", logs: append(logs(0, 40, 4), logs(20, 40, 0)...), wantAlerts: 1, wantOngoing: false, wantNumerators: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+				Name:            "Test Ratio Alert",
+				Kind:            "ratio",
+				DurationSeconds: 10,
+				Numerator:       "status >= 500",
+				RatioThreshold:  0.05,
+				MinCount:        20,
+				SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate AlertType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, msg := range tt.logs {
+				assert.Nil(t, c.ConsumeLog(msg))
+			}
+			assert.Equal(t, tt.wantAlerts, len(c.Alerts))
+			assert.Equal(t, tt.wantOngoing, c.AlertOngoing)
+			assert.Equal(t, tt.wantNumerators, c.Ratio.NumeratorCount)
+		})
+	}
+
+	_, err := NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "ratio", RatioThreshold: 0.05})
+	assert.NotNil(t, err)
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "ratio", Numerator: "status >= 500", RatioThreshold: 5})
+	assert.NotNil(t, err)
+}
+
+func TestAlertType_Absence(t *testing.T) {
+	clog.LogLevel = 1
+	start := time.Unix(1760000000, 0)
+
+	c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+		Name:            "Test Absence Alert",
+		Kind:            "absence",
+		DurationSeconds: 10,
+		SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate AlertType: %s", err)
+		return
+	}
+
+	steps := []struct {
+		name        string
+		offset      time.Duration
+		log         bool // whether a log comes in at the offset, rather than a flush
+		wantOngoing bool
+		wantAlerts  int
+	}{
+		{name: "waiting for the first log", offset: 0},
+		{name: "still waiting", offset: 9 * time.Second},
+		{name: "first log never came", offset: 10 * time.Second, wantOngoing: true, wantAlerts: 1},
+		{name: "log resolves the alert", offset: 12 * time.Second, log: true, wantAlerts: 1},
+		{name: "recent log", offset: 21 * time.Second, wantAlerts: 1},
+		{name: "silent again", offset: 23 * time.Second, wantOngoing: true, wantAlerts: 2},
+		{name: "still silent", offset: 30 * time.Second, wantOngoing: true, wantAlerts: 2},
+	}
+	for _, step := range steps {
+		now := start.Add(step.offset)
+		if step.log {
+			err := c.ConsumeLog(LogMessageStructured{T: now, LogMessage: LogMessage{SourceName: "test_source", ReceivedAt: now}})
+			assert.Nil(t, err, step.name)
+		} else {
+			assert.Nil(t, c.Flush(now), step.name)
+		}
+		assert.Equal(t, step.wantOngoing, c.AlertOngoing, step.name)
+		assert.Equal(t, step.wantAlerts, len(c.Alerts), step.name)
+	}
+	assert.Equal(t, start.Add(10*time.Second), c.Alerts[0].Start)
+	assert.Equal(t, start.Add(12*time.Second), c.Alerts[0].End)
+
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Kind: "absence"})
+	assert.NotNil(t, err)
+}
+
+func TestListenForLogMessageOnConsumer_NoLogs(t *testing.T) {
+	clog.LogLevel = 1
+	start := time.Unix(1760000000, 0)
+
+	// An absence alert that fires on a flush, before any log came in, is resolved when the consumer is cancelled
+	c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+		Name:            "Test Absence Alert",
+		Kind:            "absence",
+		DurationSeconds: 10,
+		SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate AlertType: %s", err)
+		return
+	}
+	assert.Nil(t, c.Flush(start))
+	assert.Nil(t, c.Flush(start.Add(10*time.Second)))
+	assert.True(t, c.AlertOngoing)
+
+	c.GetChannel() <- LogMessageStructured{LogMessage: LogMessage{IsCancelSignal: true}}
+	assert.Nil(t, ListenForLogMessageOnConsumer(c))
+	assert.False(t, c.AlertOngoing)
+	if assert.Equal(t, 1, len(c.Alerts)) {
+		assert.Equal(t, AlertStateResolved, c.Alerts[0].State)
+		assert.False(t, c.Alerts[0].End.IsZero())
+	}
+
+	// Stats types have nothing to report, but finish all the same
+	s, err := VanillaStatsType(10)
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	s.GetChannel() <- LogMessageStructured{LogMessage: LogMessage{IsCancelSignal: true}}
+	assert.Nil(t, ListenForLogMessageOnConsumer(s))
+	assert.Equal(t, 0, s.Windows.Len())
+}
+
+func TestAlertType_Hysteresis(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	// logs at the given offsets, in seconds
+	logs := func(offsets ...int) []LogMessageStructured {
+		var msgs []LogMessageStructured
+		for _, o := range offsets {
+			msgs = append(msgs, LogMessageStructured{
+				T:          now.Add(time.Duration(o) * time.Second),
+				LogMessage: LogMessage{SourceName: "test_source"},
+			})
+		}
+		return msgs
+	}
+	// a cycle of five logs, which fires, and a log past the duration, which recovers
+	cycles := func(offsets ...int) []int {
+		var all []int
+		for _, o := range offsets {
+			all = append(all, o, o, o, o, o, o+11)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name         string
+		cfg          config.ConfigAlertType
+		offsets      []int
+		wantAlerts   int
+		wantState    AlertState
+		wantFlapping bool
+	}{
+		{name: "recovers below the threshold by default", offsets: []int{0, 0, 0, 0, 0, 11}, wantAlerts: 1, wantState: AlertStateInactive},
+		{name: "keeps firing above the recovery threshold", cfg: config.ConfigAlertType{RecoveryThreshold: 3}, offsets: []int{0, 0, 0, 0, 0, 6, 6, 6, 12}, wantAlerts: 1, wantState: AlertStateFiring},
+		{name: "recovers below the recovery threshold", cfg: config.ConfigAlertType{RecoveryThreshold: 3}, offsets: []int{0, 0, 0, 0, 0, 6, 6, 6, 12, 17}, wantAlerts: 1, wantState: AlertStateInactive},
+		{name: "pending until the condition held for long enough", cfg: config.ConfigAlertType{ForSeconds: 5}, offsets: []int{0, 0, 0, 0, 0, 3}, wantAlerts: 0, wantState: AlertStatePending},
+		{name: "fires once the condition held for long enough", cfg: config.ConfigAlertType{ForSeconds: 5}, offsets: []int{0, 0, 0, 0, 0, 3, 5}, wantAlerts: 1, wantState: AlertStateFiring},
+		{name: "pending starts over if the condition stops holding", cfg: config.ConfigAlertType{ForSeconds: 5}, offsets: []int{0, 0, 0, 0, 0, 11, 12, 12, 12, 12, 14}, wantAlerts: 0, wantState: AlertStatePending},
+		{name: "keeps firing for the minimum duration", cfg: config.ConfigAlertType{MinFiringSeconds: 30}, offsets: []int{0, 0, 0, 0, 0, 11}, wantAlerts: 1, wantState: AlertStateFiring},
+		{name: "recovers after the minimum duration", cfg: config.ConfigAlertType{MinFiringSeconds: 30}, offsets: []int{0, 0, 0, 0, 0, 11, 31}, wantAlerts: 1, wantState: AlertStateInactive},
+		{name: "not flapping below the flap threshold", cfg: config.ConfigAlertType{FlapWindowSeconds: 60, FlapThreshold: 4}, offsets: cycles(0), wantAlerts: 1, wantState: AlertStateInactive},
+		{name: "flapping", cfg: config.ConfigAlertType{FlapWindowSeconds: 60, FlapThreshold: 4}, offsets: cycles(0, 20, 40), wantAlerts: 3, wantState: AlertStateInactive, wantFlapping: true},
+		{name: "stops flapping once quiet", cfg: config.ConfigAlertType{FlapWindowSeconds: 60, FlapThreshold: 4}, offsets: append(cycles(0, 20, 40), 200), wantAlerts: 3, wantState: AlertStateInactive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "Test Hysteresis Alert"
+			tt.cfg.DurationSeconds = 10
+			tt.cfg.Threshold = 5
+			tt.cfg.SourceSettings = []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}}
+			c, err := NewAlertTypeFromConfig(tt.cfg)
+			if err != nil {
+				t.Errorf("could not generate AlertType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, msg := range logs(tt.offsets...) {
+				assert.Nil(t, c.ConsumeLog(msg))
+			}
+			assert.Equal(t, tt.wantAlerts, len(c.Alerts))
+			assert.Equal(t, tt.wantState, c.State)
+			assert.Equal(t, tt.wantState == AlertStateFiring, c.AlertOngoing)
+			assert.Equal(t, tt.wantFlapping, c.Flap != nil && c.Flap.Flapping)
+		})
+	}
+
+	// Notifiers skip the transitions while flapping, and are sent the latest alert again once it stops
+	c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+		Name:              "Test Flapping Alert",
+		DurationSeconds:   10,
+		Threshold:         5,
+		FlapWindowSeconds: 60,
+		FlapThreshold:     4,
+		SourceSettings:    []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate AlertType: %s", err)
+		return
+	}
+	q := NotifierQueue{SendResolved: true}
+	var notified []AlertState
+	c.AddEventHandler(func(e AlertEvent) {
+		if q.ShouldNotify(e) {
+			notified = append(notified, e.Alert.State)
+		}
+	})
+	_ = c.PrepareForConsumption(now)
+	for _, msg := range logs(append(cycles(0, 20, 40), 200)...) {
+		assert.Nil(t, c.ConsumeLog(msg))
+	}
+	assert.Equal(t, []AlertState{AlertStateFiring, AlertStateResolved, AlertStateFiring, AlertStateResolved}, notified)
+
+	r := AlertRatio{Threshold: 0.1, RecoveryThreshold: 0.05, NumeratorCount: 7}
+	assert.False(t, r.IsAlert(100))
+	assert.False(t, r.IsRecovered(100))
+	assert.True(t, r.IsRecovered(200))
+
+	invalid := []config.ConfigAlertType{
+		{Threshold: 5, RecoveryThreshold: 6},
+		{Kind: "ratio", Numerator: "status >= 500", RatioThreshold: 0.05, RecoveryThreshold: 3},
+		{Kind: "ratio", Numerator: "status >= 500", RatioThreshold: 0.05, RecoveryRatio: 0.1},
+		{Kind: "anomaly", DurationSeconds: 10, Sensitivity: 3.0, RecoverySensitivity: 4.0},
+		{Threshold: 5, ForSeconds: -1},
+		{Threshold: 5, FlapThreshold: 4},
+		{Threshold: 5, FlapWindowSeconds: 60, FlapThreshold: 1},
+	}
+	for _, cfg := range invalid {
+		_, err := NewAlertTypeFromConfig(cfg)
+		assert.NotNil(t, err, "%+v", cfg)
+	}
+}
+
+func TestAlertType_GroupBy(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	// a log from each of the hosts, in order, at the given offset in seconds
+	logs := func(offset int, hosts ...string) []LogMessageStructured {
+		var msgs []LogMessageStructured
+		for _, h := range hosts {
+			msgs = append(msgs, LogMessageStructured{
+				KV:         map[string]string{"remotehost": h},
+				T:          now.Add(time.Duration(offset) * time.Second),
+				LogMessage: LogMessage{SourceName: "test_source"},
+			})
+		}
+		return msgs
+	}
+
+	tests := []struct {
+		name        string
+		cfg         config.ConfigAlertType
+		logs        []LogMessageStructured
+		flushAt     int // if set, the alert type is flushed at this offset after the logs
+		wantGroups  []string
+		wantFiring  []string
+		wantEvicted int
+	}{
+		{name: "counts each group", logs: logs(0, "a", "b", "a", "b", "a"), wantGroups: []string{"a", "b"}, wantFiring: []string{"a"}},
+		{name: "evicts the least recent inactive group", cfg: config.ConfigAlertType{MaxGroups: 2}, logs: logs(0, "a", "a", "a", "b", "c"), wantGroups: []string{"a", "c"}, wantFiring: []string{"a"}, wantEvicted: 1},
+		{name: "no room while all groups are active", cfg: config.ConfigAlertType{MaxGroups: 1}, logs: logs(0, "a", "a", "a", "b"), wantGroups: []string{"a"}, wantFiring: []string{"a"}},
+		{name: "evicts idle groups", cfg: config.ConfigAlertType{GroupIdleSeconds: 30}, logs: append(logs(0, "a", "a", "a"), logs(40, "b")...), flushAt: 41, wantGroups: []string{"b"}, wantEvicted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "Test Group Alert"
+			tt.cfg.DurationSeconds = 10
+			tt.cfg.Threshold = 3
+			tt.cfg.GroupBy = []string{"remotehost"}
+			tt.cfg.SourceSettings = []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}}
+			c, err := NewAlertTypeFromConfig(tt.cfg)
+			if err != nil {
+				t.Errorf("could not generate AlertType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, msg := range tt.logs {
+				assert.Nil(t, c.ConsumeLog(msg))
+			}
+			if tt.flushAt > 0 {
+				assert.Nil(t, c.Flush(now.Add(time.Duration(tt.flushAt)*time.Second)))
+			}
+
+			var groups, firing []string
+			for _, g := range c.groups() {
+				groups = append(groups, g.Key)
+				if g.AlertOngoing {
+					firing = append(firing, g.Key)
+				}
+			}
+			assert.Equal(t, tt.wantGroups, groups)
+			assert.Equal(t, tt.wantFiring, firing)
+			assert.Equal(t, tt.wantEvicted, c.EvictedGroups)
+			assert.Equal(t, 0, len(c.Alerts), "the alert type's own group is not used")
+		})
+	}
+
+	c, err := NewAlertTypeFromConfig(config.ConfigAlertType{Name: "Test Group Alert", DurationSeconds: 10, Threshold: 3, GroupBy: []string{"remotehost", "section(request)"}})
+	assert.Nil(t, err)
+	g, err := c.newGroup([]string{"10.0.0.1", "/api"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Test Group Alert (remotehost=10.0.0.1, section(request)=/api)", c.groupName(g))
+	assert.Equal(t, "Test Group Alert", c.groupName(&c.AlertGroup))
+
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Threshold: 3, MaxGroups: 10})
+	assert.NotNil(t, err)
+	_, err = NewAlertTypeFromConfig(config.ConfigAlertType{Threshold: 3, GroupBy: []string{"section("}})
+	assert.NotNil(t, err)
+}
+
+func TestAlertType_Events(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	c, err := NewAlertTypeFromConfig(config.ConfigAlertType{
+		Name:            "Test Event Alert",
+		DurationSeconds: 10,
+		Threshold:       3,
+		ForSeconds:      2,
+		GroupBy:         []string{"remotehost"},
+		Severity:        "critical",
+		Labels:          map[string]string{"team": "web"},
+		Annotations:     map[string]string{"summary": "{{.Labels.remotehost}} sent {{.Value}} requests"},
+		SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate AlertType: %s", err)
+		return
+	}
+	var events = make(map[string][]AlertEvent)
+	c.AddEventHandler(func(e AlertEvent) {
+		host := e.Alert.Labels["remotehost"]
+		events[host] = append(events[host], e)
+	})
+	_ = c.PrepareForConsumption(now)
+
+	logs := []struct {
+		host   string
+		offset int
+	}{
+		{"a", 0}, {"a", 0}, {"a", 0}, // pending
+		{"b", 0}, {"b", 0}, {"b", 0}, // pending
+		{"a", 1},
+		{"a", 2},           // fires, after 2 seconds
+		{"a", 3}, {"a", 3}, // peaks
+		{"b", 11}, // no longer pending, without having fired
+		{"a", 14}, // recovers
+	}
+	for _, l := range logs {
+		err := c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"remotehost": l.host},
+			T:          now.Add(time.Duration(l.offset) * time.Second),
+			LogMessage: LogMessage{SourceName: "test_source"},
+		})
+		assert.Nil(t, err)
+	}
+
+	type transition struct{ From, To AlertState }
+	var transitions []transition
+	for _, e := range events["a"] {
+		transitions = append(transitions, transition{e.Previous, e.Alert.State})
+		assert.Equal(t, events["a"][0].Alert.ID, e.Alert.ID)
+		assert.Equal(t, map[string]string{"alertname": "Test Event Alert", "team": "web", "remotehost": "a"}, e.Alert.Labels)
+		assert.Equal(t, AlertSeverityCritical, e.Alert.Severity)
+	}
+	assert.Equal(t, []transition{{AlertStateInactive, AlertStatePending}, {AlertStatePending, AlertStateFiring}, {AlertStateFiring, AlertStateResolved}}, transitions)
+	if len(events["a"]) == 3 {
+		assert.Equal(t, "a sent 3 requests", events["a"][0].Alert.Annotations["summary"])
+		assert.Equal(t, "a sent 5 requests", events["a"][1].Alert.Annotations["summary"])
+		assert.Equal(t, 5.0, events["a"][1].Alert.TriggerValue)
+		resolved := events["a"][2].Alert
+		assert.Equal(t, 1.0, resolved.Value)
+		assert.Equal(t, 7.0, resolved.PeakValue)
+		assert.Equal(t, 5.0, resolved.TriggerValue)
+		assert.Equal(t, now, resolved.ActiveAt)
+		assert.Equal(t, now.Add(2*time.Second), resolved.Start)
+		assert.Equal(t, now.Add(14*time.Second), resolved.End)
+	}
+
+	transitions = nil
+	for _, e := range events["b"] {
+		transitions = append(transitions, transition{e.Previous, e.Alert.State})
+		assert.NotEqual(t, events["a"][0].Alert.ID, e.Alert.ID)
+	}
+	assert.Equal(t, []transition{{AlertStateInactive, AlertStatePending}, {AlertStatePending, AlertStateResolved}}, transitions)
+	assert.Equal(t, 0, len(c.Groups["b"].Alerts), "alerts that never fired are not kept")
+
+	invalid := []config.ConfigAlertType{
+		{Threshold: 3, Severity: "urgent"},
+		{Threshold: 3, Labels: map[string]string{"alertname": "other"}},
+		{Threshold: 3, Labels: map[string]string{"remotehost": "10.0.0.1"}, GroupBy: []string{"remotehost"}},
+		{Threshold: 3, Annotations: map[string]string{"summary": "{{.Value"}},
+	}
+	for _, cfg := range invalid {
+		_, err := NewAlertTypeFromConfig(cfg)
+		assert.NotNil(t, err, "%+v", cfg)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBaseline(t *testing.T) {
+	tests := []struct {
+		name          string
+		kind          BaselineKind
+		n             int
+		values        []float64
+		wantCenter    float64
+		wantDeviation float64
+	}{
+		{name: "ewma of a constant", kind: BaselineEWMA, n: 10, values: []float64{10, 10, 10, 10}, wantCenter: 10, wantDeviation: 0},
+		{name: "ewma follows the latest values", kind: BaselineEWMA, n: 3, values: []float64{0, 0, 0, 0, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10}, wantCenter: 10, wantDeviation: 0.2},
+		{name: "mad ignores an outlier", kind: BaselineMAD, n: 5, values: []float64{1, 2, 3, 4, 100}, wantCenter: 3, wantDeviation: 1.4826},
+		{name: "mad only keeps the latest values", kind: BaselineMAD, n: 3, values: []float64{100, 100, 100, 1, 2, 3}, wantCenter: 2, wantDeviation: 1.4826},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBaseline(tt.kind, tt.n)
+			for _, v := range tt.values {
+				b.Add(v)
+			}
+			assert.Equal(t, len(tt.values), b.Count())
+			assert.InDelta(t, tt.wantCenter, b.Center(), 0.1)
+			assert.InDelta(t, tt.wantDeviation, b.Deviation(), 0.1)
+		})
+	}
+}
+
+func TestEWMABaseline_Deviation(t *testing.T) {
+	b := NewBaseline(BaselineEWMA, 20)
+	for i := 0; i < 200; i++ {
+		b.Add(float64(8 + 4*(i%2)))
+	}
+	assert.InDelta(t, 10, b.Center(), 0.5)
+	assert.InDelta(t, 2, b.Deviation(), 0.2)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+// readTestConfig writes the alert types to a config file with a source, and reads it.
+func readTestConfig(t *testing.T, alertTypes string) (config.Config, error) {
+	dir, err := ioutil.TempDir("", "logdog-config")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(path, []byte(`
+queue_buffer_size = 8
+debug_level_not = 1
+
+[[log_sources]]
+name = "config_source"
+type = "stdin"
+
+[alert]
+`+alertTypes), 0644)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+	return config.ReadConfigTOML(path)
+}
+
+func TestReadConfigTOML_Numbers(t *testing.T) {
+	tests := []struct {
+		name       string
+		alertTypes string
+		want       config.ConfigAlertType
+		wantErr    bool
+	}{
+		{
+			name: "integer sensitivity",
+			alertTypes: `
+    [[alert.types]]
+    kind = "anomaly"
+    sensitivity = 3
+    recovery_sensitivity = 2
+`,
+			want: config.ConfigAlertType{Kind: "anomaly", Sensitivity: 3, RecoverySensitivity: 2},
+		},
+		{
+			name: "float sensitivity",
+			alertTypes: `
+    [[alert.types]]
+    kind = "anomaly"
+    sensitivity = 2.5
+`,
+			want: config.ConfigAlertType{Kind: "anomaly", Sensitivity: 2.5},
+		},
+		{
+			name: "integer ratios",
+			alertTypes: `
+    [[alert.types]]
+    kind = "ratio"
+    ratio_threshold = 1
+    recovery_ratio = 0
+`,
+			want: config.ConfigAlertType{Kind: "ratio", RatioThreshold: 1},
+		},
+		{
+			name: "float ratios",
+			alertTypes: `
+    [[alert.types]]
+    kind = "ratio"
+    ratio_threshold = 0.05
+    recovery_ratio = 0.03
+`,
+			want: config.ConfigAlertType{Kind: "ratio", RatioThreshold: 0.05, RecoveryRatio: 0.03},
+		},
+		{
+			name: "sensitivity that is not a number",
+			alertTypes: `
+    [[alert.types]]
+    kind = "anomaly"
+    sensitivity = "3"
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := readTestConfig(t, tt.alertTypes)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if !assert.Nil(t, err) || !assert.Equal(t, 1, len(cfg.Alert.Types)) {
+				return
+			}
+			assert.Equal(t, tt.want, cfg.Alert.Types[0])
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+func TestFileDeadLetterSink_Rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-dlq")
+	if err != nil {
+		t.Errorf("could not create temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dlq.ndjson")
+
+	// Each dead letter is ~100 bytes, so every file should only hold one of them
+	sink, err := NewFileDeadLetterSink(path, 150, 2)
+	if err != nil {
+		t.Errorf("could not create sink: %s", err)
+		return
+	}
+
+	for i := 1; i <= 4; i++ {
+		err = sink.Write(DeadLetter{SourceName: "test_source", Id: int64(i), Message: "bad line", Reason: "some reason"})
+		if err != nil {
+			t.Errorf("could not write dead letter: %s", err)
+			return
+		}
+	}
+	err = sink.Close()
+	assert.Nil(t, err)
+
+	// Latest dead letter in the main file, older ones in backups, oldest one dropped
+	for suffix, wantId := range map[string]int64{"": 4, ".1": 3, ".2": 2} {
+		dls, err := ReadDeadLetterFile(path + suffix)
+		if err != nil {
+			t.Errorf("could not read dead letter file: %s", err)
+			return
+		}
+		if assert.Equal(t, 1, len(dls)) {
+			assert.Equal(t, wantId, dls[0].Id)
+			assert.Equal(t, "test_source", dls[0].SourceName)
+			assert.Equal(t, "bad line", dls[0].Message)
+			assert.Equal(t, "some reason", dls[0].Reason)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+type memoryDeadLetterSink struct {
+	DeadLetters []DeadLetter
+	Closed      bool
+}
+
+func (s *memoryDeadLetterSink) Write(dl DeadLetter) error {
+	s.DeadLetters = append(s.DeadLetters, dl)
+	return nil
+}
+
+func (s *memoryDeadLetterSink) Close() error {
+	s.Closed = true
+	return nil
+}
+
+func TestListenToLogSources_DeadLetters(t *testing.T) {
+	src, err := NewLogSourceFromConfig(config.ConfigLogSource{
+		Name: "dlq_source",
+		Type: "stdin",
+		Settings: config.ConfigLogSourceSettings{
+			Format:          "csv",
+			Headers:         []string{"date", "request"},
+			TimestampKey:    "date",
+			TimestampFormat: "unix",
+		},
+	})
+	if err != nil {
+		t.Errorf("could not create source: %s", err)
+		return
+	}
+	err = RegisterSourceInStore(src)
+	if err != nil {
+		t.Errorf("could not register source: %s", err)
+		return
+	}
+
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:            "DLQ Stats",
+		DurationSeconds: 10,
+		SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "dlq_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not create consumer: %s", err)
+		return
+	}
+	err = RegisterConsumerInStore(c)
+	if err != nil {
+		t.Errorf("could not register consumer: %s", err)
+		return
+	}
+
+	var sink memoryDeadLetterSink
+	var queue = CreateQueue(8)
+	var done = make(chan error)
+	go func() {
+		done <- ListenToLogSources(queue, nil, &sink)
+	}()
+
+	queue <- LogMessage{SourceName: "dlq_source", Id: 1, Message: "   "}
+	queue <- LogMessage{SourceName: "unknown_source", Id: 2, Message: "1549573860,GET /api HTTP/1.0"}
+	queue <- LogMessage{SourceName: "dlq_source", Id: 3, Message: "not a timestamp,GET /api HTTP/1.0"}
+	queue <- LogMessage{SourceName: "dlq_source", Id: 4, Message: "1549573860,GET /api HTTP/1.0"}
+
+	// The good message should still get through after the bad ones
+	select {
+	case msg := <-c.GetChannel():
+		assert.Equal(t, int64(4), msg.Id)
+	case <-time.After(time.Second):
+		t.Errorf("good message was not delivered to the consumer")
+	}
+
+	queue <- LogMessage{IsCancelSignal: true}
+	assert.Nil(t, <-done)
+
+	var gotIds []int64
+	for _, dl := range sink.DeadLetters {
+		gotIds = append(gotIds, dl.Id)
+		assert.NotEmpty(t, dl.Reason)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, gotIds)
+
+	counts := GetSourceErrorCountsFromStore()
+	assert.Equal(t, 2, counts["dlq_source"])
+	assert.Equal(t, 1, counts["unknown_source"])
+}
+
+func TestListenToLogSources_DeadLetterHeaders(t *testing.T) {
+	src, err := NewLogSourceFromConfig(config.ConfigLogSource{
+		Name: "dlq_header_source",
+		Type: "stdin",
+		Settings: config.ConfigLogSourceSettings{
+			Format:               "csv",
+			UseFirstlineAsHeader: true,
+			TimestampKey:         "date",
+			TimestampFormat:      "unix",
+		},
+	})
+	if err != nil {
+		t.Errorf("could not create source: %s", err)
+		return
+	}
+	err = RegisterSourceInStore(src)
+	if err != nil {
+		t.Errorf("could not register source: %s", err)
+		return
+	}
+
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:            "DLQ Header Stats",
+		DurationSeconds: 10,
+		SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "dlq_header_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not create consumer: %s", err)
+		return
+	}
+	err = RegisterConsumerInStore(c)
+	if err != nil {
+		t.Errorf("could not register consumer: %s", err)
+		return
+	}
+
+	// Dead letters recorded under different headers are replayed with their own
+	dls := []DeadLetter{
+		{SourceName: "dlq_header_source", Id: 1, Message: "1549573860,GET /api HTTP/1.0", Headers: []string{"date", "request"}},
+		{SourceName: "dlq_header_source", Id: 2, Message: "GET /web HTTP/1.0,1549573861", Headers: []string{"request", "date"}},
+		{SourceName: "dlq_header_source", Id: 3, Message: "GET /web HTTP/1.0,not a timestamp", Headers: []string{"request", "date"}},
+	}
+	var sink memoryDeadLetterSink
+	var queue = CreateQueue(8)
+	var done = make(chan error)
+	go func() {
+		done <- ListenToLogSources(queue, nil, &sink)
+	}()
+	for _, dl := range dls {
+		queue <- LogMessage{SourceName: dl.SourceName, Message: dl.Message, Id: dl.Id, Headers: getReplayHeaders(dl)}
+	}
+
+	for _, want := range []string{`GET /api HTTP/1.0`, `GET /web HTTP/1.0`} {
+		select {
+		case msg := <-c.GetChannel():
+			assert.Equal(t, want, msg.KV["request"])
+		case <-time.After(time.Second):
+			t.Errorf("message was not delivered to the consumer")
+		}
+	}
+	queue <- LogMessage{IsCancelSignal: true}
+	assert.Nil(t, <-done)
+
+	// A dead letter that fails again keeps its headers, for the next replay
+	if assert.Equal(t, 1, len(sink.DeadLetters)) {
+		assert.Equal(t, []string{"request", "date"}, sink.DeadLetters[0].Headers)
+	}
+
+	// Headers are only replayed for sources that still learn them from the first line
+	assert.Nil(t, getReplayHeaders(DeadLetter{SourceName: "dlq_source", Headers: []string{"request", "date"}}))
+	assert.Nil(t, getReplayHeaders(DeadLetter{SourceName: "unknown_source", Headers: []string{"request", "date"}}))
+}
+
+func TestRunReplayDeadLetters_ConfigError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-replay")
+	if err != nil {
+		t.Errorf("could not create temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dlq.ndjson")
+
+	// A dead letter file with two rotated backups
+	sink, err := NewFileDeadLetterSink(path, 150, 2)
+	if err != nil {
+		t.Errorf("could not create sink: %s", err)
+		return
+	}
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, sink.Write(DeadLetter{SourceName: "replay_source", Id: int64(i), Message: "bad line", Reason: "some reason"}))
+	}
+	assert.Nil(t, sink.Close())
+	assert.Equal(t, []string{path + ".2", path + ".1", path}, getDeadLetterFiles(path))
+
+	// The notifier type is a typo, so the processor cannot be set up
+	cfgPath := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(cfgPath, []byte(`
+queue_buffer_size = 8
+
+[dead_letter]
+path = "`+path+`"
+
+[[log_sources]]
+name = "replay_source"
+type = "stdin"
+[log_sources.settings]
+format = "csv"
+headers = ["date", "request"]
+timestamp_key = "date"
+timestamp_format = "unix"
+
+[[notifiers]]
+name = "replay_notifier"
+type = "webhok"
+`), 0644)
+	if err != nil {
+		t.Errorf("could not write config: %s", err)
+		return
+	}
+
+	err = runReplayDeadLetters([]string{"--config-file", cfgPath})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "notifier type 'webhok' not recognized")
+	}
+
+	// Nothing was replayed, so the files are still there to be replayed once the config is fixed
+	for _, file := range getDeadLetterFiles(path) {
+		dls, err := ReadDeadLetterFile(file)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(dls), file)
+		_, err = os.Stat(file + ".replayed")
+		assert.True(t, os.IsNotExist(err), file)
+	}
+}
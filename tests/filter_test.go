@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExpr_Match(t *testing.T) {
+
+	kv := map[string]string{
+		"remotehost": `"10.0.0.1"`,
+		"authuser":   `"apache"`,
+		"request":    `"GET /api/user HTTP/1.0"`,
+		"status":     "503",
+		"bytes":      "1234",
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		want bool
+	}{
+		{name: "empty filter matches everything", expr: "", want: true},
+		{name: "numeric comparison", expr: "status >= 500", want: true},
+		{name: "numeric comparison is not lexical", expr: "bytes > 999", want: true},
+		{name: "string equality strips quotes", expr: "authuser == 'apache'", want: true},
+		{name: "not equal", expr: "authuser != 'apache'", want: false},
+		{name: "and", expr: "status >= 500 && section(request) == '/api'", want: true},
+		{name: "and short circuits", expr: "status < 500 && section(request) == '/api'", want: false},
+		{name: "or", expr: "status < 500 || authuser == 'apache'", want: true},
+		{name: "not with parentheses", expr: "!(status >= 500 || bytes < 10)", want: false},
+		{name: "in list", expr: "status in [500, 502, 503]", want: true},
+		{name: "not in list", expr: "remotehost not in ['10.0.0.1', '10.0.0.2']", want: false},
+		{name: "regex match", expr: `request =~ '^GET /api/'`, want: true},
+		{name: "regex no match", expr: `request !~ 'POST'`, want: true},
+		{name: "startsWith", expr: "startsWith(request, 'GET')", want: true},
+		{name: "endsWith", expr: "endsWith(request, 'HTTP/2.0')", want: false},
+		{name: "contains", expr: "contains(lower(request), 'user')", want: true},
+		{name: "field exists", expr: "exists(authuser)", want: true},
+		{name: "field does not exist", expr: "exists(referer)", want: false},
+		{name: "missing field compares as empty", expr: "referer == ''", want: true},
+		{name: "boolean literal", expr: "true && !false", want: true},
+		{name: "derived section", expr: "status >= 500 && section == '/api'", want: true},
+		{name: "derived field exists", expr: "exists(section)", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := CompileFilter(tt.expr)
+			if err != nil {
+				t.Errorf("could not compile filter: %s", err)
+				return
+			}
+			got, err := f.Match(kv)
+			if err != nil {
+				t.Errorf("could not evaluate filter: %s", err)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCompileFilter_Errors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{name: "not a boolean", expr: "status"},
+		{name: "dangling operator", expr: "status >="},
+		{name: "unbalanced parentheses", expr: "(status >= 500"},
+		{name: "unterminated string", expr: "authuser == 'apache"},
+		{name: "unknown function", expr: "foo(status)"},
+		{name: "wrong number of arguments", expr: "startsWith(request)"},
+		{name: "exists needs a field", expr: "exists('status')"},
+		{name: "invalid regex", expr: "request =~ '(['"},
+		{name: "regex must be a literal", expr: "request =~ status"},
+		{name: "logical operands must be boolean", expr: "status && bytes"},
+		{name: "comparing booleans", expr: "(status > 1) == true"},
+		{name: "unexpected character", expr: "status # 5"},
+		{name: "trailing tokens", expr: "status == 5 5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileFilter(tt.expr)
+			assert.NotNil(t, err, "expected an error for '%s'", tt.expr)
+		})
+	}
+}
+
+func TestFilterExpr_EvaluationError(t *testing.T) {
+	f, err := CompileFilter("section(request) == '/api'")
+	if err != nil {
+		t.Errorf("could not compile filter: %s", err)
+		return
+	}
+	_, err = f.Match(map[string]string{"request": "not a request line"})
+	assert.NotNil(t, err)
+}
+
+func TestFilterExpr_DerivedFields(t *testing.T) {
+
+	tests := []struct {
+		name string
+		expr string
+		kv   map[string]string
+		want bool
+	}{
+		{name: "section of the request", expr: "section == '/api'", kv: map[string]string{"request": `"GET /api/user HTTP/1.0"`}, want: true},
+		{name: "section of another section", expr: "section == '/api'", kv: map[string]string{"request": `"GET /report HTTP/1.0"`}, want: false},
+		{name: "section without a request line", expr: "section == ''", kv: map[string]string{"app": "worker"}, want: true},
+		{name: "section of a malformed request", expr: "exists(section)", kv: map[string]string{"request": "not a request line"}, want: false},
+		{name: "a field of the log comes first", expr: "section == 'billing'", kv: map[string]string{"section": "billing", "request": `"GET /api HTTP/1.0"`}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := CompileFilter(tt.expr)
+			if err != nil {
+				t.Errorf("could not compile filter: %s", err)
+				return
+			}
+			got, err := f.Match(tt.kv)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValueExpr_Eval(t *testing.T) {
+
+	kv := map[string]string{
+		"request": `"GET /api/user HTTP/1.0"`,
+		"status":  "503",
+		"user":    `"Apache"`,
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "field", expr: "status", want: "503"},
+		{name: "field without quotes", expr: "user", want: "Apache"},
+		{name: "missing field", expr: "referer", want: ""},
+		{name: "function", expr: "section(request)", want: "/api"},
+		{name: "derived field", expr: "section", want: "/api"},
+		{name: "nested functions", expr: "lower(user)", want: "apache"},
+		{name: "status class", expr: "statusClass(status)", want: "5xx"},
+		{name: "boolean", expr: "status >= 500", want: "true"},
+		{name: "status class of a non status", expr: "statusClass(user)", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := CompileValueExpr(tt.expr)
+			if err != nil {
+				t.Errorf("could not compile expression: %s", err)
+				return
+			}
+			got, err := e.Eval(kv)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, expr := range []string{"", "section(", "unknown(status)"} {
+		_, err := CompileValueExpr(expr)
+		assert.NotNil(t, err, "expected an error for '%s'", expr)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeavyHitters_Top(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		n      int
+		want   []HeavyHitter
+	}{
+		{
+			name:   "most frequent first, ties by value",
+			values: []string{"b", "a", "c", "a", "b", "a", "d"},
+			n:      3,
+			want:   []HeavyHitter{{Value: "a", Count: 3}, {Value: "b", Count: 2}, {Value: "c", Count: 1}},
+		},
+		{
+			name:   "fewer values than n",
+			values: []string{"a", "b", "a"},
+			n:      5,
+			want:   []HeavyHitter{{Value: "a", Count: 2}, {Value: "b", Count: 1}},
+		},
+		{
+			name:   "all values",
+			values: []string{"a", "b", "a", "c"},
+			n:      -1,
+			want:   []HeavyHitter{{Value: "a", Count: 2}, {Value: "b", Count: 1}, {Value: "c", Count: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, mode := range []StatsCounterMode{StatsCounterExact, StatsCounterSpaceSaving} {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, mode), func(t *testing.T) {
+				c := NewHeavyHitters(mode, 10)
+				for _, v := range tt.values {
+					assert.Nil(t, c.Add(v))
+				}
+				assert.Equal(t, tt.want, c.Top(tt.n))
+			})
+		}
+	}
+}
+
+func TestSpaceSavingCounter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(rnd, 1.2, 1, 100000)
+
+	exact := ExactCounter{}
+	c := NewSpaceSavingCounter(100)
+	for i := 0; i < 200000; i++ {
+		v := fmt.Sprintf("/api/users/%d", zipf.Uint64())
+		exact.Add(v)
+		c.Add(v)
+	}
+
+	// Memory is bounded
+	assert.Equal(t, 100, c.Len())
+
+	// The top values are the same, and their counts are never underestimated, and overestimated by at most Error
+	want := exact.Top(10)
+	got := c.Top(10)
+	for i := range want {
+		assert.Equal(t, want[i].Value, got[i].Value)
+		assert.True(t, got[i].Count >= want[i].Count)
+		assert.True(t, got[i].Count-got[i].Error <= want[i].Count)
+	}
+
+	// A new value takes over the least frequent one
+	small := NewSpaceSavingCounter(2)
+	small.Add("a")
+	small.Add("a")
+	small.Add("b")
+	evicted := small.Add("c")
+	assert.Equal(t, &HeavyHitter{Value: "b", Count: 1}, evicted)
+	assert.Equal(t, []HeavyHitter{{Value: "a", Count: 2}, {Value: "c", Count: 2, Error: 1}}, small.Top(-1))
+}
+
+func TestHeavyHitters_Merge(t *testing.T) {
+	exact := ExactCounter{"a": 3, "b": 1}
+	err := exact.Merge(ExactCounter{"a": 1, "c": 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []HeavyHitter{{Value: "a", Count: 4}, {Value: "c", Count: 2}, {Value: "b", Count: 1}}, exact.Top(-1))
+
+	// Neither counter is full, so the merge is exact
+	a := NewSpaceSavingCounter(3)
+	b := NewSpaceSavingCounter(3)
+	for _, v := range []string{"a", "a", "b"} {
+		a.Add(v)
+	}
+	for _, v := range []string{"a", "c"} {
+		b.Add(v)
+	}
+	err = a.Merge(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []HeavyHitter{{Value: "a", Count: 3}, {Value: "b", Count: 1}, {Value: "c", Count: 1}}, a.Top(-1))
+
+	// A value missing from a full counter may have been seen up to its minimum count
+	full := NewSpaceSavingCounter(2)
+	for _, v := range []string{"x", "x", "x", "y", "y", "z"} {
+		full.Add(v)
+	}
+	err = a.Merge(full)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, a.Len())
+	top := a.Top(-1)
+	assert.Equal(t, HeavyHitter{Value: "a", Count: 6, Error: 3}, top[0])
+	assert.Equal(t, HeavyHitter{Value: "b", Count: 4, Error: 3}, top[1])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog_Estimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		distinct int
+		repeat   int
+		maxError float64 // relative
+	}{
+		{name: "empty", distinct: 0, repeat: 1, maxError: 0},
+		{name: "single value", distinct: 1, repeat: 100, maxError: 0},
+		{name: "small", distinct: 100, repeat: 3, maxError: 0.01},
+		{name: "medium", distinct: 5000, repeat: 2, maxError: 0.03},
+		{name: "large", distinct: 200000, repeat: 1, maxError: 0.03},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHyperLogLog(DefaultHyperLogLogPrecision)
+			for r := 0; r < tt.repeat; r++ {
+				for i := 0; i < tt.distinct; i++ {
+					h.Add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+				}
+			}
+			got := float64(h.Estimate())
+			assert.InDelta(t, float64(tt.distinct), got, math.Ceil(float64(tt.distinct)*tt.maxError))
+		})
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	b := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	all := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	for i := 0; i < 50000; i++ {
+		v := fmt.Sprintf("user-%d", i)
+		// Half of the values are seen by both
+		if i%4 != 0 {
+			a.Add(v)
+		}
+		if i%4 != 1 {
+			b.Add(v)
+		}
+		all.Add(v)
+	}
+
+	err := a.Merge(b)
+	assert.Nil(t, err)
+	assert.Equal(t, all.Estimate(), a.Estimate())
+
+	// A sparse sketch can be merged into a dense one, and the other way around
+	small := NewHyperLogLog(DefaultHyperLogLogPrecision)
+	small.Add("someone new")
+	err = small.Merge(all)
+	assert.Nil(t, err)
+	err = all.Merge(small)
+	assert.Nil(t, err)
+	assert.Equal(t, all.Estimate(), small.Estimate())
+
+	err = a.Merge(NewHyperLogLog(10))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+// smtpStandIn is an SMTP server that accepts every email, and records them. With a TLS config, it offers STARTTLS and
+// PLAIN auth.
+type smtpStandIn struct {
+	TLS      *tls.Config
+	Listener net.Listener
+
+	lock     sync.Mutex
+	messages []smtpStandInMessage
+	received chan struct{}
+}
+
+type smtpStandInMessage struct {
+	From string
+	To   []string
+	Auth string // the decoded PLAIN auth, if any
+	TLS  bool
+	Data string
+}
+
+func newSMTPStandIn(t *testing.T, tlsConfig *tls.Config) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	s := smtpStandIn{TLS: tlsConfig, Listener: l, received: make(chan struct{}, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return &s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	var msg smtpStandInMessage
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost stand-in")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			if s.TLS != nil && !msg.TLS {
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 STARTTLS")
+			} else if s.TLS != nil {
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			} else {
+				text.PrintfLine("250 localhost")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.TLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			msg.TLS = true
+		case "AUTH":
+			parts := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			msg.Auth = string(decoded)
+			text.PrintfLine("235 ok")
+		case "MAIL":
+			msg.From = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			msg.To = append(msg.To, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.lock.Lock()
+			s.messages = append(s.messages, msg)
+			s.lock.Unlock()
+			s.received <- struct{}{}
+			text.PrintfLine("250 ok")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *smtpStandIn) Messages() []smtpStandInMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]smtpStandInMessage(nil), s.messages...)
+}
+
+// readEmail parses the email, and returns its subject, and its text and HTML parts.
+func readEmail(t *testing.T, data string) (string, string, string) {
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Errorf("could not parse email: %s", err)
+		return "", "", ""
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Errorf("could not parse content type: %s", err)
+		return subject, "", ""
+	}
+	var parts = make(map[string]string)
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		parts[strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0]] = string(b)
+	}
+	return subject, parts["text/plain"], parts["text/html"]
+}
+
+func TestEmailNotifier_Batching(t *testing.T) {
+	server := newSMTPStandIn(t, nil)
+	defer server.Listener.Close()
+
+	n, err := NewEmailNotifierFromConfig(config.ConfigNotifier{
+		Name:        "test_email",
+		Type:        "email",
+		SMTPAddress: server.Listener.Addr().String(),
+		From:        "LogDog <logdog@example.com>",
+		To:          []string{"web@example.com", "Ops <ops@example.com>"},
+	})
+	if err != nil {
+		t.Errorf("could not create notifier: %s", err)
+		return
+	}
+	n.BatchInterval = 50 * time.Millisecond
+
+	// Alerts within the batch interval are sent together
+	firing := testAlertEvent(AlertStateFiring, AlertStatePending)
+	other := testAlertEvent(AlertStateFiring, AlertStatePending)
+	other.Alert.Name = "Other <Alert>"
+	assert.Nil(t, n.Notify(testNotification(firing)))
+	assert.Nil(t, n.Notify(testNotification(other)))
+	select {
+	case <-server.received:
+	case <-time.After(2 * time.Second):
+		t.Errorf("batch was not sent")
+		return
+	}
+	messages := server.Messages()
+	if !assert.Equal(t, 1, len(messages)) {
+		return
+	}
+	assert.Equal(t, "logdog@example.com", messages[0].From)
+	assert.Equal(t, []string{"web@example.com", "ops@example.com"}, messages[0].To)
+	subject, text, html := readEmail(t, messages[0].Data)
+	assert.Equal(t, "2 firing, 0 resolved alerts", subject)
+	assert.Contains(t, text, "[firing] Test Notifier Alert (critical)")
+	assert.Contains(t, text, "[firing] Other <Alert> (critical)")
+	assert.Contains(t, text, "  remote.host = 10.0.0.1\n")
+	assert.Contains(t, text, "  summary: 10.0.0.1 sent 7 requests\n")
+	assert.Contains(t, html, "Other &lt;Alert&gt;")
+
+	// Closing sends what's left of the batch, without waiting
+	n.BatchInterval = time.Hour
+	assert.Nil(t, n.Notify(testNotification(testAlertEvent(AlertStateResolved, AlertStateFiring))))
+	assert.Nil(t, n.Close())
+	messages = server.Messages()
+	if assert.Equal(t, 2, len(messages)) {
+		subject, text, _ := readEmail(t, messages[1].Data)
+		assert.Equal(t, "[resolved] Test Notifier Alert", subject)
+		assert.Contains(t, text, "resolved at 2019-02-07")
+	}
+}
+
+func TestEmailNotifier_StartTLS(t *testing.T) {
+	// Borrow the certificate of a TLS test server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := ts.TLS.Certificates[0]
+	ts.Close()
+
+	tests := []struct {
+		name      string
+		tlsConfig *tls.Config
+		req       config.ConfigNotifier
+		wantTLS   bool
+		wantAuth  string
+		wantErr   bool
+	}{
+		{"plain text", nil, config.ConfigNotifier{}, false, "", false},
+		{"plain text, but tls is required", nil, config.ConfigNotifier{RequireTLS: true}, false, "", true},
+		{"starttls", &tls.Config{Certificates: []tls.Certificate{cert}}, config.ConfigNotifier{TLSInsecureSkipVerify: true, RequireTLS: true}, true, "", false},
+		{"starttls with auth", &tls.Config{Certificates: []tls.Certificate{cert}}, config.ConfigNotifier{TLSInsecureSkipVerify: true, Username: "logdog", Password: "secret"}, true, "\x00logdog\x00secret", false},
+		{"starttls with an unknown certificate", &tls.Config{Certificates: []tls.Certificate{cert}}, config.ConfigNotifier{}, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSMTPStandIn(t, tt.tlsConfig)
+			defer server.Listener.Close()
+
+			req := tt.req
+			req.Name, req.Type = "test_email", "email"
+			req.SMTPAddress = server.Listener.Addr().String()
+			req.From, req.To = "logdog@example.com", []string{"web@example.com"}
+			req.Subject = "{{len .Alerts}} alert"
+			n, err := NewEmailNotifierFromConfig(req)
+			if err != nil {
+				t.Errorf("could not create notifier: %s", err)
+				return
+			}
+			assert.Nil(t, n.Notify(testNotification(testAlertEvent(AlertStateFiring, AlertStatePending))))
+			err = n.Flush()
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+			if tt.wantErr {
+				return
+			}
+			messages := server.Messages()
+			if assert.Equal(t, 1, len(messages)) {
+				assert.Equal(t, tt.wantTLS, messages[0].TLS)
+				assert.Equal(t, tt.wantAuth, messages[0].Auth)
+				subject, _, _ := readEmail(t, messages[0].Data)
+				assert.Equal(t, "1 alert", subject)
+			}
+		})
+	}
+}
+
+func TestNewEmailNotifierFromConfig_Invalid(t *testing.T) {
+	valid := config.ConfigNotifier{Name: "n", Type: "email", SMTPAddress: "localhost:25", From: "logdog@example.com", To: []string{"web@example.com"}}
+	_, err := NewEmailNotifierFromConfig(valid)
+	assert.Nil(t, err)
+
+	invalid := []func(req *config.ConfigNotifier){
+		func(req *config.ConfigNotifier) { req.SMTPAddress = "" },
+		func(req *config.ConfigNotifier) { req.SMTPAddress = "localhost" },
+		func(req *config.ConfigNotifier) { req.From = "" },
+		func(req *config.ConfigNotifier) { req.To = nil },
+		func(req *config.ConfigNotifier) { req.To = []string{"not an address"} },
+		func(req *config.ConfigNotifier) { req.BatchSeconds = -1 },
+		func(req *config.ConfigNotifier) { req.Subject = "{{.Alerts" },
+		func(req *config.ConfigNotifier) { req.HTML = "{{end}}" },
+	}
+	for i, f := range invalid {
+		req := valid
+		f(&req)
+		_, err := NewEmailNotifierFromConfig(req)
+		assert.NotNil(t, err, "case %d", i)
+	}
+}
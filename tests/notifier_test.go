@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+func testAlertEvent(state, previous AlertState) AlertEvent {
+	now := time.Unix(1549573860, 0)
+	a := Alert{
+		ID:           "0123456789abcdef",
+		Name:         "Test Notifier Alert",
+		State:        state,
+		Severity:     AlertSeverityCritical,
+		Labels:       map[string]string{"alertname": "Test Notifier Alert", "remote.host": "10.0.0.1"},
+		Annotations:  map[string]string{"summary": "10.0.0.1 sent 7 requests"},
+		ActiveAt:     now,
+		Value:        7,
+		PeakValue:    9,
+		TriggerValue: 5,
+	}
+	if state == AlertStateFiring || previous == AlertStateFiring {
+		a.Start = now.Add(2 * time.Second)
+	}
+	if state == AlertStateResolved {
+		a.End = now.Add(14 * time.Second)
+	}
+	return AlertEvent{Alert: a, Previous: previous, Time: now.Add(14 * time.Second)}
+}
+
+func testNotification(events ...AlertEvent) Notification {
+	return Notification{
+		Notifier:    "test_notifier",
+		GroupKey:    `{alertname="Test Notifier Alert"}`,
+		GroupLabels: map[string]string{"alertname": "Test Notifier Alert"},
+		Events:      events,
+	}
+}
+
+// webhookRecorder is a webhook that fails with the given statuses first, and records the bodies it's sent.
+type webhookRecorder struct {
+	Statuses []int
+	Bodies   [][]byte
+	Headers  []http.Header
+	lock     sync.Mutex
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Bodies = append(w.Bodies, body)
+	w.Headers = append(w.Headers, r.Header)
+	if len(w.Statuses) > 0 {
+		status := w.Statuses[0]
+		w.Statuses = w.Statuses[1:]
+		rw.WriteHeader(status)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"succeeds", nil, 1, false},
+		{"retries server errors", []int{500, 503}, 3, false},
+		{"retries too many requests", []int{429}, 2, false},
+		{"gives up after max retries", []int{500, 500, 500}, 3, true},
+		{"does not retry client errors", []int{400}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recorder = webhookRecorder{Statuses: tt.statuses}
+			server := httptest.NewServer(&recorder)
+			defer server.Close()
+
+			maxRetries := 2
+			n, err := NewWebhookNotifierFromConfig(config.ConfigNotifier{
+				Name:       "test_webhook",
+				Type:       "webhook",
+				URL:        server.URL,
+				Headers:    map[string]string{"Authorization": "Bearer secret"},
+				MaxRetries: &maxRetries,
+			})
+			if err != nil {
+				t.Errorf("could not create notifier: %s", err)
+				return
+			}
+			n.RetryBackoff = time.Millisecond
+
+			err = n.Notify(testNotification(testAlertEvent(AlertStateFiring, AlertStatePending)))
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+			if !assert.Equal(t, tt.wantRequests, len(recorder.Bodies)) {
+				return
+			}
+			assert.Equal(t, "Bearer secret", recorder.Headers[0].Get("Authorization"))
+			assert.Equal(t, "application/json", recorder.Headers[0].Get("Content-Type"))
+
+			var payload NotificationPayload
+			err = json.Unmarshal(recorder.Bodies[0], &payload)
+			assert.Nil(t, err)
+			assert.Equal(t, "test_notifier", payload.Notifier)
+			assert.Equal(t, `{alertname="Test Notifier Alert"}`, payload.GroupKey)
+			assert.Equal(t, map[string]string{"alertname": "Test Notifier Alert"}, payload.GroupLabels)
+			if !assert.Equal(t, 1, len(payload.Alerts)) {
+				return
+			}
+			got := payload.Alerts[0]
+			assert.Equal(t, "0123456789abcdef", got.ID)
+			assert.Equal(t, AlertStateFiring, got.State)
+			assert.Equal(t, AlertStatePending, got.PreviousState)
+			assert.Equal(t, AlertSeverityCritical, got.Severity)
+			assert.Equal(t, "10.0.0.1", got.Labels["remote.host"])
+			assert.Equal(t, 5.0, got.TriggerValue)
+			assert.NotNil(t, got.StartsAt)
+			assert.Nil(t, got.EndsAt)
+		})
+	}
+}
+
+func TestWebhookNotifier_Alertmanager(t *testing.T) {
+	var recorder webhookRecorder
+	server := httptest.NewServer(&recorder)
+	defer server.Close()
+
+	n, err := NewWebhookNotifierFromConfig(config.ConfigNotifier{Name: "test_am", Type: "webhook", URL: server.URL, Format: "alertmanager"})
+	if err != nil {
+		t.Errorf("could not create notifier: %s", err)
+		return
+	}
+
+	// Alertmanager has no pending alerts
+	assert.Nil(t, n.Notify(testNotification(testAlertEvent(AlertStatePending, AlertStateInactive), testAlertEvent(AlertStateResolved, AlertStatePending))))
+	assert.Equal(t, 0, len(recorder.Bodies))
+
+	assert.Nil(t, n.Notify(testNotification(testAlertEvent(AlertStatePending, AlertStateInactive), testAlertEvent(AlertStateResolved, AlertStateFiring))))
+	if !assert.Equal(t, 1, len(recorder.Bodies)) {
+		return
+	}
+	var got []struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+		EndsAt      time.Time         `json:"endsAt"`
+	}
+	err = json.Unmarshal(recorder.Bodies[0], &got)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(got)) {
+		assert.Equal(t, map[string]string{"alertname": "Test Notifier Alert", "remote_host": "10.0.0.1", "severity": "critical"}, got[0].Labels)
+		assert.Equal(t, "10.0.0.1 sent 7 requests", got[0].Annotations["summary"])
+		assert.Equal(t, time.Unix(1549573862, 0), got[0].StartsAt.Local())
+		assert.Equal(t, time.Unix(1549573874, 0), got[0].EndsAt.Local())
+	}
+}
+
+func TestExecNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-exec")
+	if err != nil {
+		t.Errorf("could not create temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out")
+
+	script := `echo "$LOGDOG_ALERT_STATE $LOGDOG_ALERT_PREVIOUS_STATE $LOGDOG_ALERT_SEVERITY $LOGDOG_ALERT_TRIGGER_VALUE $LOGDOG_LABEL_REMOTE_HOST $LOGDOG_ANNOTATION_SUMMARY" > "$0"; cat >> "$0"`
+	n, err := NewExecNotifierFromConfig(config.ConfigNotifier{Name: "test_exec", Type: "exec", Command: []string{"sh", "-c", script, path}})
+	if err != nil {
+		t.Errorf("could not create notifier: %s", err)
+		return
+	}
+	err = n.Notify(testNotification(testAlertEvent(AlertStateFiring, AlertStatePending)))
+	if err != nil {
+		t.Errorf("could not notify: %s", err)
+		return
+	}
+
+	out, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.SplitN(string(out), "\n", 2)
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Equal(t, "firing pending critical 5 10.0.0.1 10.0.0.1 sent 7 requests", lines[0])
+		var got AlertNotification
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &got))
+		assert.Equal(t, "0123456789abcdef", got.ID)
+	}
+
+	// A failing command is an error, with its output
+	n, _ = NewExecNotifierFromConfig(config.ConfigNotifier{Name: "test_exec", Type: "exec", Command: []string{"sh", "-c", "echo oops; exit 3"}})
+	err = n.Notify(testNotification(testAlertEvent(AlertStateFiring, AlertStatePending)))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "oops")
+	}
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-notifications")
+	if err != nil {
+		t.Errorf("could not create temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.ndjson")
+
+	q, err := NewNotifierQueueFromConfig(config.ConfigNotifier{Name: "test_file", Type: "file", Path: path})
+	if err != nil {
+		t.Errorf("could not create notifier: %s", err)
+		return
+	}
+	q.Start()
+	q.Handle(testNotification(testAlertEvent(AlertStateFiring, AlertStatePending)))
+	q.Handle(testNotification(testAlertEvent(AlertStateResolved, AlertStateFiring), testAlertEvent(AlertStateFiring, AlertStatePending)))
+	assert.Nil(t, q.Close())
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Errorf("could not open notification file: %s", err)
+		return
+	}
+	defer file.Close()
+	var states []AlertState
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var got AlertNotification
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &got))
+		states = append(states, got.State)
+	}
+	assert.Equal(t, []AlertState{AlertStateFiring, AlertStateResolved, AlertStateFiring}, states)
+}
+
+func TestNotifierQueue_ShouldNotify(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name         string
+		sendPending  bool
+		sendResolved *bool
+		state        AlertState
+		previous     AlertState
+		flapping     bool
+		want         bool
+	}{
+		{"firing", false, nil, AlertStateFiring, AlertStatePending, false, true},
+		{"firing while flapping", false, nil, AlertStateFiring, AlertStatePending, true, false},
+		{"resolved", false, nil, AlertStateResolved, AlertStateFiring, false, true},
+		{"resolved, not sending resolved", false, &no, AlertStateResolved, AlertStateFiring, false, false},
+		{"resolved, sending resolved", false, &yes, AlertStateResolved, AlertStateFiring, false, true},
+		{"pending", false, nil, AlertStatePending, AlertStateInactive, false, false},
+		{"pending, sending pending", true, nil, AlertStatePending, AlertStateInactive, false, true},
+		{"no longer pending", false, nil, AlertStateResolved, AlertStatePending, false, false},
+		{"no longer pending, sending pending", true, nil, AlertStateResolved, AlertStatePending, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewNotifierQueueFromConfig(config.ConfigNotifier{
+				Name:         "test_queue",
+				Type:         "exec",
+				Command:      []string{"true"},
+				SendPending:  tt.sendPending,
+				SendResolved: tt.sendResolved,
+			})
+			if err != nil {
+				t.Errorf("could not create notifier: %s", err)
+				return
+			}
+			e := testAlertEvent(tt.state, tt.previous)
+			e.Alert.Flapping = tt.flapping
+			assert.Equal(t, tt.want, q.ShouldNotify(e))
+		})
+	}
+}
+
+func TestNewNotifierQueueFromConfig_Invalid(t *testing.T) {
+	invalid := []config.ConfigNotifier{
+		{Type: "file", Path: "alerts.ndjson"},
+		{Name: "n", Type: "pager"},
+		{Name: "n", Type: "webhook"},
+		{Name: "n", Type: "webhook", URL: "http://localhost", Format: "xml"},
+		{Name: "n", Type: "webhook", URL: "http://localhost", RetryBackoffSeconds: -1},
+		{Name: "n", Type: "exec"},
+		{Name: "n", Type: "exec", Command: []string{"true"}, TimeoutSeconds: -1},
+		{Name: "n", Type: "file"},
+	}
+	for _, req := range invalid {
+		_, err := NewNotifierQueueFromConfig(req)
+		assert.NotNil(t, err, "config: %+v", req)
+	}
+}
+
+func TestNewLogProcessorFromConfig_Notifiers(t *testing.T) {
+	alertType := config.ConfigAlertType{
+		Name:            "Notified Alert",
+		DurationSeconds: 10,
+		Threshold:       3,
+		SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "test_source"}},
+	}
+	tests := []struct {
+		name      string
+		notifiers []config.ConfigNotifier
+		names     []string
+		wantErr   bool
+	}{
+		{"unknown notifier", nil, []string{"missing"}, true},
+		{"duplicate notifier", []config.ConfigNotifier{{Name: "n", Type: "exec", Command: []string{"true"}}, {Name: "n", Type: "exec", Command: []string{"true"}}}, nil, true},
+		{"disabled notifier", []config.ConfigNotifier{{Name: "n", Type: "exec", Disabled: true}}, []string{"n"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := alertType
+			at.Notifiers = tt.names
+			var cfg config.Config
+			cfg.Alert.Types = []config.ConfigAlertType{at}
+			cfg.Notifiers = tt.notifiers
+			_, err := NewLogProcessorFromConfig(cfg)
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+func TestLogProcessor_Drain(t *testing.T) {
+	src, err := NewLogSourceFromConfig(config.ConfigLogSource{
+		Name: "drain_source",
+		Type: "stdin",
+		Settings: config.ConfigLogSourceSettings{
+			Format:          "csv",
+			Headers:         []string{"date", "request"},
+			TimestampKey:    "date",
+			TimestampFormat: "unix",
+		},
+	})
+	if err != nil {
+		t.Errorf("could not create source: %s", err)
+		return
+	}
+	err = RegisterSourceInStore(src)
+	if err != nil {
+		t.Errorf("could not register source: %s", err)
+		return
+	}
+
+	var cfg config.Config
+	cfg.InQueueBufferSize = 2 // smaller than the number of messages, so some of them are still in flight when draining
+	cfg.Stats.Types = []config.ConfigStatsType{
+		{
+			Name:            "Drain Stats",
+			DurationSeconds: 10,
+			SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "drain_source", Key: "request", ValueMutateFuncName: "HTTPStatusLineToSection"}},
+		},
+	}
+	cfg.Alert.Types = []config.ConfigAlertType{
+		{
+			Name:            "Drain Alert",
+			DurationSeconds: 10,
+			Threshold:       5,
+			SourceSettings:  []config.ConfigAlertTypeSourceSetting{{Name: "drain_source"}},
+		},
+	}
+
+	p, err := NewLogProcessorFromConfig(cfg)
+	if err != nil {
+		t.Errorf("could not create processor: %s", err)
+		return
+	}
+	p.Start()
+
+	start := int64(1549573860)
+	for i := int64(0); i < 20; i++ {
+		p.Queue <- LogMessage{SourceName: "drain_source", Id: i + 1, Message: fmt.Sprintf("%d,GET /api/user HTTP/1.0", start+i)}
+	}
+
+	err = p.Drain(time.Now().Add(5 * time.Second))
+	assert.Nil(t, err)
+
+	// Every message should have been consumed, all windows reported and the alert resolved
+	st := p.Consumers[0].(*StatsType)
+	var total int
+	for i := 0; i < st.Windows.Len(); i++ {
+		total += st.Windows.At(i).StatsMap["/api"].Count
+	}
+	assert.Equal(t, 20, total)
+	assert.Empty(t, st.QueuedNotifications)
+
+	at := p.Consumers[1].(*AlertType)
+	assert.False(t, at.AlertOngoing)
+	if assert.Equal(t, 1, len(at.Alerts)) {
+		assert.Equal(t, time.Unix(start+19, 0), at.Alerts[0].End)
+	}
+}
+
+func TestLogProcessor_Drain_Timeout(t *testing.T) {
+	// Nothing listens on the queue, so draining cannot finish
+	var sink memoryDeadLetterSink
+	p := LogProcessor{Queue: CreateQueue(1), DeadLetters: &sink}
+	p.Queue <- LogMessage{SourceName: "drain_source", Id: 1, Message: "1549573860,GET /api/user HTTP/1.0"}
+
+	err := p.Drain(time.Now().Add(50 * time.Millisecond))
+	assert.NotNil(t, err)
+	assert.True(t, sink.Closed, "dead letters should be closed even when draining times out")
+}
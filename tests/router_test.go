@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+// registerRouterConsumers registers a few consumers, all of which can handle the router_source, unless they already are.
+func registerRouterConsumers(t *testing.T) {
+	var names = []string{"Router API", "Router Errors", "Router Everything"}
+	for _, name := range names {
+		if _, err := GetConsumerByNameFromStore(name); err == nil {
+			continue
+		}
+		c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+			Name:            name,
+			DurationSeconds: 10,
+			SourceSettings: []config.ConfigStatsTypeSourceSetting{
+				{Name: "router_source", Key: "request"},
+			},
+		})
+		if err != nil {
+			t.Errorf("could not create consumer: %s", err)
+			return
+		}
+		if err = RegisterConsumerInStore(c); err != nil {
+			t.Errorf("could not register consumer: %s", err)
+			return
+		}
+	}
+}
+
+func TestLogRouter_GetConsumers(t *testing.T) {
+	registerRouterConsumers(t)
+
+	tests := []struct {
+		name    string
+		routing config.ConfigRouting
+		kv      map[string]string
+		want    []string
+	}{
+		{
+			name:    "no routes routes by source",
+			routing: config.ConfigRouting{},
+			kv:      map[string]string{"app": "api"},
+			want:    []string{"Router API", "Router Errors", "Router Everything"},
+		},
+		{
+			name: "first matching route stops",
+			routing: config.ConfigRouting{
+				Routes: []config.ConfigRoute{
+					{Filter: "app == 'api'", Consumers: []string{"Router API"}},
+					{Filter: "status >= 500", Consumers: []string{"Router Errors"}},
+				},
+			},
+			kv:   map[string]string{"app": "api", "status": "500"},
+			want: []string{"Router API"},
+		},
+		{
+			name: "continue evaluates later routes without duplicates",
+			routing: config.ConfigRouting{
+				Routes: []config.ConfigRoute{
+					{Filter: "app == 'api'", Consumers: []string{"Router API"}, Continue: true},
+					{Filter: "status >= 500", Consumers: []string{"Router Errors", "Router API"}},
+				},
+			},
+			kv:   map[string]string{"app": "api", "status": "500"},
+			want: []string{"Router API", "Router Errors"},
+		},
+		{
+			name: "route limited to other sources does not match",
+			routing: config.ConfigRouting{
+				Routes: []config.ConfigRoute{
+					{Sources: []string{"other_source"}, Consumers: []string{"Router API"}},
+				},
+				DefaultConsumers: []string{"Router Everything"},
+			},
+			kv:   map[string]string{"app": "api"},
+			want: []string{"Router Everything"},
+		},
+		{
+			name: "no match without default routes by source",
+			routing: config.ConfigRouting{
+				Routes: []config.ConfigRoute{
+					{Filter: "app == 'web'", Consumers: []string{"Router API"}},
+				},
+			},
+			kv:   map[string]string{"app": "api"},
+			want: []string{"Router API", "Router Errors", "Router Everything"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewLogRouterFromConfig(tt.routing)
+			if err != nil {
+				t.Errorf("could not create router: %s", err)
+				return
+			}
+			consumers, err := r.GetConsumers(LogMessageStructured{
+				KV:         tt.kv,
+				LogMessage: LogMessage{SourceName: "router_source"},
+			})
+			if err != nil {
+				t.Errorf("could not get consumers: %s", err)
+				return
+			}
+			var got []string
+			for _, c := range consumers {
+				got = append(got, c.GetName())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLogRouter_GetConsumers_MixedStream(t *testing.T) {
+
+	// A single stream of HTTP access logs and logs of other apps, which have no request line. Filters that fail for the
+	// other logs do not match them, so they fall through to the later routes, and to the default route.
+	registerRouterConsumers(t)
+	r, err := NewLogRouterFromConfig(config.ConfigRouting{
+		Routes: []config.ConfigRoute{
+			{Name: "api", Filter: "section(request) == '/api'", Consumers: []string{"Router API"}},
+			{Name: "errors", Filter: "statusClass(status) == '5xx'", Consumers: []string{"Router Errors"}},
+		},
+		DefaultConsumers: []string{"Router Everything"},
+	})
+	if err != nil {
+		t.Errorf("could not create router: %s", err)
+		return
+	}
+
+	stream := []struct {
+		kv   map[string]string
+		want []string
+	}{
+		{map[string]string{"request": `"GET /api/user HTTP/1.0"`, "status": "200"}, []string{"Router API"}},
+		{map[string]string{"app": "worker", "status": "503"}, []string{"Router Errors"}},
+		{map[string]string{"request": `"GET /report HTTP/1.0"`, "status": "500"}, []string{"Router Errors"}},
+		{map[string]string{"app": "worker", "message": "job done"}, []string{"Router Everything"}},
+		{map[string]string{"request": "not a request line", "status": "ok"}, []string{"Router Everything"}},
+	}
+	for i, m := range stream {
+		consumers, err := r.GetConsumers(LogMessageStructured{
+			KV:         m.kv,
+			LogMessage: LogMessage{SourceName: "router_source"},
+		})
+		if !assert.Nil(t, err, "log %d", i) {
+			continue
+		}
+		var got []string
+		for _, c := range consumers {
+			got = append(got, c.GetName())
+		}
+		assert.Equal(t, m.want, got, "log %d", i)
+	}
+}
+
+func TestNewLogRouterFromConfig_Errors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		routing config.ConfigRouting
+	}{
+		{
+			name:    "unknown consumer",
+			routing: config.ConfigRouting{Routes: []config.ConfigRoute{{Consumers: []string{"Does not exist"}}}},
+		},
+		{
+			name:    "no consumers",
+			routing: config.ConfigRouting{Routes: []config.ConfigRoute{{Filter: "app == 'api'"}}},
+		},
+		{
+			name:    "bad filter",
+			routing: config.ConfigRouting{Routes: []config.ConfigRoute{{Filter: "app ==", Consumers: []string{"Router API"}}}},
+		},
+		{
+			name:    "unknown default consumer",
+			routing: config.ConfigRouting{DefaultConsumers: []string{"Does not exist"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLogRouterFromConfig(tt.routing)
+			assert.NotNil(t, err)
+		})
+	}
+}
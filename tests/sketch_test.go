@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestDDSketch_Quantile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+
+	tests := []struct {
+		name   string
+		values func() []float64
+	}{
+		{
+			name: "uniform latencies",
+			values: func() []float64 {
+				var vs []float64
+				for i := 0; i < 10000; i++ {
+					vs = append(vs, 1+rnd.Float64()*999)
+				}
+				return vs
+			},
+		},
+		{
+			name: "long tail",
+			values: func() []float64 {
+				var vs []float64
+				for i := 0; i < 10000; i++ {
+					vs = append(vs, math.Exp(rnd.NormFloat64()*2))
+				}
+				return vs
+			},
+		},
+		{
+			name: "negatives and zeros",
+			values: func() []float64 {
+				var vs []float64
+				for i := 0; i < 1000; i++ {
+					vs = append(vs, float64(i-500))
+				}
+				return vs
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := tt.values()
+			s := NewDDSketch(DefaultSketchRelativeAccuracy, DefaultSketchMaxBuckets)
+			for _, v := range values {
+				s.Add(v)
+			}
+			sort.Float64s(values)
+
+			for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+				want := exactQuantile(values, q)
+				got, ok := s.Quantile(q)
+				assert.True(t, ok)
+				assert.InDelta(t, want, got, math.Abs(want)*DefaultSketchRelativeAccuracy+1e-9, "quantile %v", q)
+			}
+		})
+	}
+}
+
+func TestDDSketch_Merge(t *testing.T) {
+	a := NewDDSketch(DefaultSketchRelativeAccuracy, DefaultSketchMaxBuckets)
+	b := NewDDSketch(DefaultSketchRelativeAccuracy, DefaultSketchMaxBuckets)
+	all := NewDDSketch(DefaultSketchRelativeAccuracy, DefaultSketchMaxBuckets)
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a.Add(float64(i))
+		} else {
+			b.Add(float64(i))
+		}
+		all.Add(float64(i))
+	}
+
+	err := a.Merge(b)
+	assert.Nil(t, err)
+	assert.Equal(t, all.Count, a.Count)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want, _ := all.Quantile(q)
+		got, _ := a.Quantile(q)
+		assert.Equal(t, want, got)
+	}
+
+	err = a.Merge(NewDDSketch(0.05, DefaultSketchMaxBuckets))
+	assert.NotNil(t, err)
+}
+
+func TestDDSketch_BoundedBuckets(t *testing.T) {
+	s := NewDDSketch(DefaultSketchRelativeAccuracy, 64)
+	for i := 0; i < 100000; i++ {
+		s.Add(math.Pow(1.1, float64(i%300)))
+	}
+	assert.True(t, len(s.Positive) <= 64)
+
+	// High quantiles stay accurate, as only the lowest buckets are collapsed
+	got, _ := s.Quantile(0.99)
+	assert.InDelta(t, math.Pow(1.1, 296), got, math.Pow(1.1, 296)*0.05)
+
+	_, ok := NewDDSketch(DefaultSketchRelativeAccuracy, 64).Quantile(0.5)
+	assert.False(t, ok)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -116,3 +118,45 @@ func TestTimestampFormat_Unix_Parse(t *testing.T) {
 		})
 	}
 }
+
+// pipeSource is a LogSource whose logs are written to a pipe by the test.
+type pipeSource struct {
+	reader *io.PipeReader
+	*baseLogSource
+}
+
+func (src pipeSource) NewReader() (io.ReadCloser, error) {
+	return src.reader, nil
+}
+
+func TestStreamLogMessagesFromSource_Stop(t *testing.T) {
+	reader, writer := io.Pipe()
+	src := pipeSource{reader: reader, baseLogSource: &baseLogSource{name: "pipe_source"}}
+	queue := CreateQueue(10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- StreamLogMessagesFromSource(src, queue, stop)
+	}()
+
+	writer.Write([]byte("first line\n"))
+	select {
+	case msg := <-queue:
+		assert.Equal(t, "first line", msg.Message)
+	case <-time.After(time.Second):
+		t.Errorf("first line was not queued")
+		return
+	}
+
+	// The source is blocked reading when it's stopped. The next line is not queued, even though the queue has room.
+	close(stop)
+	go writer.Write([]byte("second line\n"))
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Errorf("source did not stop")
+		return
+	}
+	assert.Equal(t, 0, len(queue))
+}
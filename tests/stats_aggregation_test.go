@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/logdoc/config"
+)
+
+func TestParseStatsAggregation(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    StatsAggregation
+		wantErr bool
+	}{
+		{name: "sum", str: "sum(bytes)", want: StatsAggregation{Name: "sum(bytes)", Func: "sum", Field: "bytes"}},
+		{name: "spaces", str: " max( response_ms ) ", want: StatsAggregation{Name: "max( response_ms )", Func: "max", Field: "response_ms"}},
+		{name: "rate without field", str: "rate()", want: StatsAggregation{Name: "rate()", Func: "rate", Field: ""}},
+		{name: "percentile", str: "p99(response_ms)", want: StatsAggregation{Name: "p99(response_ms)", Func: "p99", Field: "response_ms", Quantile: 0.99}},
+		{name: "fractional percentile", str: "p99.9(response_ms)", want: StatsAggregation{Name: "p99.9(response_ms)", Func: "p99.9", Field: "response_ms", Quantile: 0.999}},
+		{name: "percentile without field", str: "p50()", wantErr: true},
+		{name: "percentile out of range", str: "p100(response_ms)", wantErr: true},
+		{name: "distinct", str: "distinct(remote_host)", want: StatsAggregation{Name: "distinct(remote_host)", Func: "distinct", Field: "remote_host"}},
+		{name: "avg without field", str: "avg()", wantErr: true},
+		{name: "distinct without field", str: "distinct()", wantErr: true},
+		{name: "unknown func", str: "median(bytes)", wantErr: true},
+		{name: "no parentheses", str: "bytes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStatsAggregation(tt.str)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.InDelta(t, tt.want.Quantile, got.Quantile, 1e-9)
+			got.Quantile = tt.want.Quantile
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStatsType_Aggregations(t *testing.T) {
+	now := time.Unix(1549573860, 0)
+
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:            "Test Stats Aggregations",
+		DurationSeconds: 10,
+		Aggregations:    []string{"sum(bytes)", "avg(bytes)", "min(bytes)", "max(bytes)", "rate()", "rate(bytes)", "p50(bytes)", "distinct(remote_host)"},
+		SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	_ = c.PrepareForConsumption(now)
+
+	for i, bytes := range []string{"100", "300", `"200"`, "not a number"} {
+		err = c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"request": "/api", "bytes": bytes, "remote_host": []string{"10.0.0.1", `"10.0.0.2"`, "10.0.0.2", "10.0.0.1"}[i]},
+			T:          now.Add(time.Second),
+			LogMessage: LogMessage{SourceName: "test_source"},
+		})
+		assert.Nil(t, err)
+	}
+
+	window := c.Windows.At(1)
+	stats := window.StatsMap["/api"]
+	assert.Equal(t, 4, stats.Count)
+
+	var want = []float64{600, 200, 100, 300, 0.4, 60, 200, 2}
+	for i, agg := range c.Aggregations {
+		got, ok := agg.Compute(stats, window.End.Sub(window.Start))
+		assert.True(t, ok, agg.Name)
+		assert.InDelta(t, want[i], got, want[i]*DefaultSketchRelativeAccuracy, agg.Name)
+	}
+
+	// No data for the field
+	agg, _ := ParseStatsAggregation("sum(response_ms)")
+	_, ok := agg.Compute(stats, 10*time.Second)
+	assert.False(t, ok)
+
+	_, err = NewStatsTypeFromConfig(config.ConfigStatsType{Aggregations: []string{"sum(bytes)", "sum(bytes)"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teejays/clog"
+	"github.com/teejays/logdoc/config"
+)
+
+func TestStatsType_Compare(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	lateness := int64(0)
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:                   "Test Stats Compare",
+		DurationSeconds:        10,
+		AllowedLatenessSeconds: &lateness,
+		ComparePrevious:        true,
+		CompareSeconds:         []int64{20},
+		SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	_ = c.PrepareForConsumption(now)
+
+	logs := []struct {
+		offsetSeconds int
+		request       string
+	}{
+		{1, "/api"}, {2, "/api"}, {3, "/foo"},
+		{11, "/api"}, {12, "/api"}, {13, "/api"},
+		{21, "/api"}, {22, "/bar"},
+		{31, "/api"},
+	}
+	for _, l := range logs {
+		err := c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"request": l.request},
+			T:          now.Add(time.Duration(l.offsetSeconds) * time.Second),
+			LogMessage: LogMessage{SourceName: "test_source"},
+		})
+		assert.Nil(t, err)
+	}
+
+	// The window from 20s to 30s, compared with the one from 10s and the one from 0s
+	w := *c.Windows.At(3)
+	comparisons := c.getComparisons(w)
+	if assert.Equal(t, 2, len(comparisons)) {
+		assert.Equal(t, "prev", comparisons[0].Name)
+		assert.Equal(t, now.Add(10*time.Second), comparisons[0].Window.Start)
+		assert.Equal(t, "20s", comparisons[1].Name)
+		assert.Equal(t, now, comparisons[1].Window.Start)
+	}
+	assert.Equal(t, "prev: -2 (-66.7%), 20s: -1 (-50.0%)", formatChanges("/api", w.StatsMap["/api"].Count, comparisons))
+	assert.Equal(t, "prev: new, 20s: new", formatChanges("/bar", w.StatsMap["/bar"].Count, comparisons))
+	assert.Equal(t, "\t\tGone since 20s\t:\t/foo (1)\n", c.formatGoneKeys(w, comparisons, "\t\t"))
+
+	// There is nothing to compare the first window against
+	assert.Empty(t, c.getComparisons(*c.Windows.At(1)))
+
+	_, err = NewStatsTypeFromConfig(config.ConfigStatsType{DurationSeconds: 10, CompareSeconds: []int64{15}})
+	assert.NotNil(t, err)
+}
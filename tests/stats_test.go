@@ -1,6 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -76,7 +82,7 @@ func TestStatsType_ConsumeLog(t *testing.T) {
 				},
 			},
 			priorAssertions: func(t *testing.T, c *StatsType) {
-				assert.Equal(t, 2, len(c.Windows))
+				assert.Equal(t, 2, c.Windows.Len())
 				assert.Equal(t, 1, c.CurrentPointer)
 				assert.Equal(t, now.Add(1*time.Second), c.LatestTimestamp)
 				assert.Equal(t, 0, len(c.QueuedNotifications))
@@ -89,7 +95,7 @@ func TestStatsType_ConsumeLog(t *testing.T) {
 				},
 			},
 			postAssertions: func(t *testing.T, c *StatsType) {
-				assert.Equal(t, 3, len(c.Windows))
+				assert.Equal(t, 3, c.Windows.Len())
 				assert.Equal(t, 2, c.CurrentPointer)
 				assert.Equal(t, now.Add(2*time.Second), c.LatestTimestamp)
 				assert.Equal(t, []int{1}, c.QueuedNotifications)
@@ -190,3 +196,957 @@ func TestStatsType_DetermineWindow(t *testing.T) {
 		})
 	}
 }
+
+func TestStatsType_Watermark(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:            "Test Stats Watermark",
+		DurationSeconds: 10,
+		SourceSettings: []config.ConfigStatsTypeSourceSetting{
+			{Name: "source_a", Key: "request"},
+			{Name: "source_b", Key: "request"},
+		},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	_ = c.PrepareForConsumption(now)
+
+	consume := func(src string, offsetSeconds int) {
+		err := c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"request": "/api"},
+			T:          now.Add(time.Duration(offsetSeconds) * time.Second),
+			LogMessage: LogMessage{SourceName: src},
+		})
+		assert.Nil(t, err)
+	}
+
+	// Source A runs ahead, but source B is still in the first window, so it should not be reported
+	consume("source_b", 1)
+	consume("source_a", 25)
+	assert.False(t, c.Windows.At(1).Reported)
+	assert.Equal(t, now.Add(-1*time.Second), c.getWatermark())
+
+	// Source B's late-ish log still counts in the first window
+	consume("source_b", 5)
+	assert.Equal(t, 2, c.Windows.At(1).StatsMap["/api"].Count)
+
+	// Once source B moves past the window end plus lateness, the window is reported
+	consume("source_b", 13)
+	assert.True(t, c.Windows.At(1).Reported)
+}
+
+func TestStatsType_LatePolicy(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name           string
+		latePolicy     string
+		postAssertions func(*testing.T, *StatsType)
+	}{
+		{
+			name:       "drop ignores late logs",
+			latePolicy: "drop",
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 1, c.LateCount)
+				assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+				assert.Equal(t, 0, c.Windows.Last().LateCount)
+				assert.Empty(t, c.QueuedNotifications)
+			},
+		},
+		{
+			name:       "count puts late logs in the late bucket of the latest window",
+			latePolicy: "count",
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 1, c.LateCount)
+				assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+				assert.Equal(t, 1, c.Windows.Last().LateCount)
+			},
+		},
+		{
+			name:       "reemit adds late logs to their window and reports it again",
+			latePolicy: "reemit",
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 1, c.LateCount)
+				assert.Equal(t, 2, c.Windows.At(1).StatsMap["/api"].Count)
+				// Watermark is already past the window, so it's re-reported right away
+				assert.Empty(t, c.QueuedNotifications)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lateness := int64(0)
+			c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+				Name:                   "Test Stats Late",
+				DurationSeconds:        10,
+				AllowedLatenessSeconds: &lateness,
+				LatePolicy:             tt.latePolicy,
+				SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, offset := range []int{1, 15, 11} {
+				err = c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api"},
+					T:          now.Add(time.Duration(offset) * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source"},
+				})
+				assert.Nil(t, err)
+			}
+			assert.True(t, c.Windows.At(1).Reported)
+
+			// This one is late
+			err = c.ConsumeLog(LogMessageStructured{
+				KV:         map[string]string{"request": "/api"},
+				T:          now.Add(2 * time.Second),
+				LogMessage: LogMessage{SourceName: "test_source"},
+			})
+			assert.Nil(t, err)
+
+			tt.postAssertions(t, c)
+		})
+	}
+}
+
+func TestStatsType_TopN(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name           string
+		cfg            config.ConfigStatsType
+		wantErr        bool
+		postAssertions func(*testing.T, *StatsType)
+	}{
+		{
+			name: "default top 5",
+			cfg:  config.ConfigStatsType{},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, []string{"/a", "/b", "/c", "/d", "/e"}, c.Windows.At(1).topKeys(c.TopN))
+				assert.Equal(t, 8, len(c.Windows.At(1).StatsMap))
+			},
+		},
+		{
+			name: "configured top n per type and breakdown",
+			cfg:  config.ConfigStatsType{TopN: 2, BreakdownTopN: map[string]int{"host": 1}},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, []string{"/a", "/b"}, c.Windows.At(1).topKeys(c.TopN))
+				assert.Equal(t, 1, c.getBreakdownTopN("host"))
+				assert.Equal(t, 2, c.getBreakdownTopN("user"))
+				assert.Equal(t, []HeavyHitter{{Value: "host1", Count: 8}}, c.Windows.At(1).StatsMap["/a"].OtherCounts["host"].Top(c.getBreakdownTopN("host")))
+			},
+		},
+		{
+			name: "space saving keeps a bounded number of values",
+			cfg:  config.ConfigStatsType{TopN: 3, Counter: "space_saving", CounterCapacity: 4},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 4, len(c.Windows.At(1).StatsMap))
+				assert.Equal(t, 3, len(c.Windows.At(1).topKeys(c.TopN)))
+				// Counts are never underestimated
+				for k, stats := range c.Windows.At(1).StatsMap {
+					want := 8 - int(k[1]-'a')
+					assert.True(t, stats.Count >= want, k)
+					assert.True(t, stats.Count-stats.CountError <= want, k)
+				}
+			},
+		},
+		{
+			name:    "unknown counter",
+			cfg:     config.ConfigStatsType{Counter: "count_min"},
+			wantErr: true,
+		},
+		{
+			name:    "top n larger than the space saving capacity",
+			cfg:     config.ConfigStatsType{TopN: 10, Counter: "space_saving", CounterCapacity: 4},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "Test Stats TopN"
+			tt.cfg.DurationSeconds = 10
+			tt.cfg.SourceSettings = []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request", OtherKeys: []string{"host"}}}
+			c, err := NewStatsTypeFromConfig(tt.cfg)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			// /a is seen 8 times, /b 7 times ... /h once, interleaved
+			for j := 0; j < 8; j++ {
+				for i, request := range []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g", "/h"} {
+					if j >= 8-i {
+						continue
+					}
+					err = c.ConsumeLog(LogMessageStructured{
+						KV:         map[string]string{"request": request, "host": "host1"},
+						T:          now.Add(time.Second),
+						LogMessage: LogMessage{SourceName: "test_source"},
+					})
+					assert.Nil(t, err)
+				}
+			}
+
+			tt.postAssertions(t, c)
+		})
+	}
+}
+
+func TestAlignTime(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+1800)
+
+	tests := []struct {
+		name string
+		t    time.Time
+		d    time.Duration
+		loc  *time.Location
+		want time.Time
+	}{
+		{name: "seconds", t: time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC), d: 10 * time.Second, loc: time.UTC, want: time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC)},
+		{name: "minute", t: time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC), d: time.Minute, loc: time.UTC, want: time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC)},
+		{name: "already aligned", t: time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC), d: time.Minute, loc: time.UTC, want: time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC)},
+		{name: "hour in a half hour offset timezone", t: time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC), d: time.Hour, loc: ist, want: time.Date(2019, 2, 7, 20, 30, 0, 0, time.UTC)},
+		{name: "day in timezone", t: time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC), d: 24 * time.Hour, loc: ist, want: time.Date(2019, 2, 7, 18, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := alignTime(tt.t, tt.d, tt.loc)
+			assert.True(t, tt.want.Equal(got), "want %s, got %s", tt.want, got)
+		})
+	}
+}
+
+func TestStatsType_Windows(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		cfg            config.ConfigStatsType
+		wantErr        bool
+		postAssertions func(*testing.T, *StatsType)
+	}{
+		{
+			name: "aligned tumbling windows",
+			cfg:  config.ConfigStatsType{DurationSeconds: 10, AlignWindows: true},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC), c.Windows.At(1).Start)
+				assert.Equal(t, time.Date(2019, 2, 7, 21, 18, 10, 0, time.UTC), c.Windows.At(1).End)
+				w, err := c.getReportWindow(2)
+				assert.Nil(t, err)
+				assert.Equal(t, 2, w.StatsMap["/api"].Count)
+			},
+		},
+		{
+			name: "hopping windows merge the panes of the last duration",
+			cfg:  config.ConfigStatsType{DurationSeconds: 30, Window: "hopping", AdvanceSeconds: 10, AlignWindows: true},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 10*time.Second, c.Windows.At(1).End.Sub(c.Windows.At(1).Start))
+				// The first window only has the panes seen so far
+				w, err := c.getReportWindow(1)
+				assert.Nil(t, err)
+				assert.Equal(t, 1, w.StatsMap["/api"].Count)
+				w, err = c.getReportWindow(3)
+				assert.Nil(t, err)
+				assert.Equal(t, time.Date(2019, 2, 7, 21, 18, 0, 0, time.UTC), w.Start)
+				assert.Equal(t, time.Date(2019, 2, 7, 21, 18, 30, 0, time.UTC), w.End)
+				assert.Equal(t, 4, w.StatsMap["/api"].Count)
+				assert.Equal(t, 4, w.StatsMap["/api"].OtherCounts["host"].Top(1)[0].Count)
+				w, err = c.getReportWindow(4)
+				assert.Nil(t, err)
+				assert.Equal(t, 4, w.StatsMap["/api"].Count)
+				// Panes are not changed by the merges
+				assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+				assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].OtherCounts["host"].Top(1)[0].Count)
+			},
+		},
+		{
+			name: "sliding windows move on every second by default",
+			cfg:  config.ConfigStatsType{DurationSeconds: 30, Window: "sliding"},
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, time.Second, c.Advance)
+				assert.Equal(t, 30, c.panesPerWindow())
+			},
+		},
+		{
+			name:    "duration not a multiple of the advance",
+			cfg:     config.ConfigStatsType{DurationSeconds: 30, Window: "hopping", AdvanceSeconds: 7},
+			wantErr: true,
+		},
+		{
+			name:    "hopping without advance",
+			cfg:     config.ConfigStatsType{DurationSeconds: 30, Window: "hopping"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown window",
+			cfg:     config.ConfigStatsType{DurationSeconds: 30, Window: "session"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown timezone",
+			cfg:     config.ConfigStatsType{DurationSeconds: 30, AlignWindows: true, Timezone: "Mars/Olympus_Mons"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "Test Stats Windows"
+			tt.cfg.SourceSettings = []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request", OtherKeys: []string{"host"}}}
+			c, err := NewStatsTypeFromConfig(tt.cfg)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			// One log in the 21:18:00 pane, two in 21:18:10, one in 21:18:20 and 21:18:30, and one far later
+			for _, offset := range []int{1, 10, 15, 25, 35, 100} {
+				err = c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api", "host": "host1"},
+					T:          now.Add(time.Duration(offset) * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source"},
+				})
+				assert.Nil(t, err)
+			}
+
+			tt.postAssertions(t, c)
+		})
+	}
+}
+
+type memoryStatsWindowArchiver struct {
+	windows []StatsWindow
+}
+
+func (a *memoryStatsWindowArchiver) ArchiveStatsWindow(statsTypeName string, w StatsWindow) error {
+	a.windows = append(a.windows, w)
+	return nil
+}
+
+func TestStatsType_Retention(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name           string
+		cfg            config.ConfigStatsType
+		postAssertions func(*testing.T, *StatsType, *memoryStatsWindowArchiver)
+	}{
+		{
+			name: "by count",
+			cfg:  config.ConfigStatsType{RetentionWindows: 3},
+			postAssertions: func(t *testing.T, c *StatsType, a *memoryStatsWindowArchiver) {
+				assert.Equal(t, 3, c.Windows.Len())
+				assert.Equal(t, 9, c.EvictedCount)
+				assert.Equal(t, now.Add(100*time.Second), c.Windows.At(2).Start)
+				// The dummy window is not archived
+				assert.Equal(t, 8, len(a.windows))
+				assert.Equal(t, now, a.windows[0].Start)
+				assert.Equal(t, 1, a.windows[0].StatsMap["/api"].Count)
+			},
+		},
+		{
+			name: "by age",
+			cfg:  config.ConfigStatsType{RetentionWindows: -1, RetentionSeconds: 25},
+			postAssertions: func(t *testing.T, c *StatsType, a *memoryStatsWindowArchiver) {
+				// The latest log is at 101s, so windows that ended before 76s are gone
+				assert.Equal(t, now.Add(70*time.Second), c.Windows.At(0).Start)
+				assert.Equal(t, 4, c.Windows.Len())
+			},
+		},
+		{
+			name: "hopping windows keep the panes of unreported windows",
+			cfg:  config.ConfigStatsType{RetentionWindows: 1, Window: "hopping", AdvanceSeconds: 5},
+			postAssertions: func(t *testing.T, c *StatsType, a *memoryStatsWindowArchiver) {
+				assert.Equal(t, 2, c.Windows.Len())
+				assert.True(t, c.Windows.At(0).Reported)
+				assert.False(t, c.Windows.At(1).Reported)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lateness := int64(0)
+			tt.cfg.Name = "Test Stats Retention"
+			tt.cfg.DurationSeconds = 10
+			tt.cfg.AllowedLatenessSeconds = &lateness
+			tt.cfg.LatePolicy = "count"
+			tt.cfg.SourceSettings = []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}}
+			c, err := NewStatsTypeFromConfig(tt.cfg)
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			archiver := &memoryStatsWindowArchiver{}
+			c.Archiver = archiver
+			_ = c.PrepareForConsumption(now)
+
+			consume := func(offsetSeconds int) {
+				err := c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api"},
+					T:          now.Add(time.Duration(offsetSeconds) * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source"},
+				})
+				assert.Nil(t, err)
+			}
+			for offset := 1; offset <= 101; offset += 10 {
+				consume(offset)
+			}
+
+			// A log for an evicted window is late
+			consume(2)
+			assert.Equal(t, 1, c.LateCount)
+			assert.Equal(t, 1, c.Windows.Last().LateCount)
+
+			tt.postAssertions(t, c, archiver)
+		})
+	}
+}
+
+func TestStatsType_ArchivePath(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	dir, err := ioutil.TempDir("", "logdog-archive")
+	if err != nil {
+		t.Errorf("could not create temp dir: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "windows.ndjson")
+
+	lateness := int64(0)
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:                   "Test Stats Archive",
+		DurationSeconds:        10,
+		AllowedLatenessSeconds: &lateness,
+		RetentionWindows:       3,
+		ArchivePath:            path,
+		SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	_ = c.PrepareForConsumption(now)
+
+	for offset := 1; offset <= 1001; offset += 10 {
+		err := c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"request": "/api"},
+			T:          now.Add(time.Duration(offset) * time.Second),
+			LogMessage: LogMessage{SourceName: "test_source"},
+		})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, c.FinishConsumption())
+
+	// Memory stays bounded however many windows went by, as the ring never had to grow
+	assert.Equal(t, 3, c.Windows.Len())
+	assert.Equal(t, 3+2, c.Windows.Cap())
+
+	// Every evicted window was archived, except the dummy one
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("could not read archive: %s", err)
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, c.EvictedCount-1, len(lines))
+	var first struct {
+		StatsType string    `json:"stats_type"`
+		Start     time.Time `json:"start"`
+		Counts    []struct {
+			Value string `json:"value"`
+			Count int    `json:"count"`
+		} `json:"counts"`
+	}
+	if assert.Nil(t, json.Unmarshal([]byte(lines[0]), &first)) {
+		assert.Equal(t, "Test Stats Archive", first.StatsType)
+		assert.True(t, now.Equal(first.Start))
+		if assert.Equal(t, 1, len(first.Counts)) {
+			assert.Equal(t, "/api", first.Counts[0].Value)
+			assert.Equal(t, 1, first.Counts[0].Count)
+		}
+	}
+
+	_, err = NewStatsTypeFromConfig(config.ConfigStatsType{Name: "Test Stats Archive", DurationSeconds: 10, ArchivePath: filepath.Join(dir, "missing", "windows.ndjson")})
+	assert.NotNil(t, err)
+}
+
+func TestStatsType_GroupBy(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name         string
+		reportFormat string
+		want         string
+	}{
+		{
+			name: "table",
+			want: "" +
+				"\t\tsection(request)  statusClass(status)  count  sum(bytes)\n" +
+				"\t\t/api              2xx                  2      300\n" +
+				"\t\t/api              5xx                  1      50\n" +
+				"\t\t/report           2xx                  1      -\n",
+		},
+		{
+			name:         "tree",
+			reportFormat: "tree",
+			want: "" +
+				"\t\tGrouped by section(request) > statusClass(status)\n" +
+				"\t\t/api\t:\t3\n" +
+				"\t\t\t2xx\t:\t2\n" +
+				"\t\t\t\tsum(bytes)\t:\t300\n" +
+				"\t\t\t5xx\t:\t1\n" +
+				"\t\t\t\tsum(bytes)\t:\t50\n" +
+				"\t\t/report\t:\t1\n" +
+				"\t\t\t2xx\t:\t1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+				Name:            "Test Stats Group By",
+				DurationSeconds: 10,
+				GroupBy:         []string{"section(request)", "statusClass(status)"},
+				ReportFormat:    tt.reportFormat,
+				Aggregations:    []string{"sum(bytes)"},
+				SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "test_source"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			for _, kv := range []map[string]string{
+				{"request": "GET /api/user HTTP/1.0", "status": "200", "bytes": "100"},
+				{"request": "GET /api/team HTTP/1.0", "status": "204", "bytes": "200"},
+				{"request": "POST /api/user HTTP/1.0", "status": "503", "bytes": "50"},
+				{"request": "GET /report HTTP/1.0", "status": "200"},
+			} {
+				err = c.ConsumeLog(LogMessageStructured{KV: kv, T: now.Add(time.Second), LogMessage: LogMessage{SourceName: "test_source"}})
+				assert.Nil(t, err)
+			}
+
+			w := *c.Windows.At(1)
+			assert.Equal(t, 3, len(w.StatsMap))
+			assert.Equal(t, 2, w.StatsMap["/api"+statsGroupSeparator+"2xx"].Count)
+
+			var got string
+			if c.ReportFormat == StatsReportTree {
+				got = c.formatGroupTree(w, nil)
+			} else {
+				got = c.formatGroupTable(w, nil)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := NewStatsTypeFromConfig(config.ConfigStatsType{GroupBy: []string{"section("}})
+	assert.NotNil(t, err)
+	_, err = NewStatsTypeFromConfig(config.ConfigStatsType{GroupBy: []string{"status"}, ReportFormat: "chart"})
+	assert.NotNil(t, err)
+}
+
+func TestStatsType_Rollups(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	tests := []struct {
+		name           string
+		rollups        []config.ConfigStatsRollup
+		wantErr        bool
+		postAssertions func(*testing.T, *StatsType, *memoryStatsWindowArchiver)
+	}{
+		{
+			name:    "rollup that is not a multiple of the windows",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 45}},
+			wantErr: true,
+		},
+		{
+			name:    "rollup that is not coarser than the one before",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60}, {DurationSeconds: 60}},
+			wantErr: true,
+		},
+		{
+			name:    "negative retention",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60, RetentionSeconds: -1}},
+			wantErr: true,
+		},
+		{
+			name:    "report interval that is not a multiple of the resolution before",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60, ReportSeconds: 15}},
+			wantErr: true,
+		},
+		{
+			name:    "report interval that does not divide the rollup",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60, ReportSeconds: 40}},
+			wantErr: true,
+		},
+		{
+			name:    "cascading rollups",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60}, {DurationSeconds: 120}},
+			postAssertions: func(t *testing.T, c *StatsType, a *memoryStatsWindowArchiver) {
+				minute, twoMinutes := c.Rollups[0], c.Rollups[1]
+				assert.Equal(t, 4, minute.Windows.Len())
+				assert.Equal(t, 2, twoMinutes.Windows.Len())
+				for i, want := range []int{6, 6, 6, 3} {
+					assert.Equal(t, now.Add(time.Duration(i)*time.Minute), minute.Windows.At(i).Start)
+					assert.Equal(t, want, minute.Windows.At(i).StatsMap["/api"].Count)
+					assert.True(t, minute.Windows.At(i).Reported)
+				}
+				for i, want := range []int{12, 9} {
+					stats := twoMinutes.Windows.At(i).StatsMap["/api"]
+					assert.Equal(t, want, stats.Count)
+					sum, ok := c.Aggregations[0].Compute(stats, 2*time.Minute)
+					assert.True(t, ok)
+					assert.Equal(t, float64(want*10), sum)
+					assert.True(t, twoMinutes.Windows.At(i).Reported)
+				}
+			},
+		},
+		{
+			name:    "retention",
+			rollups: []config.ConfigStatsRollup{{DurationSeconds: 60, RetentionWindows: 2}},
+			postAssertions: func(t *testing.T, c *StatsType, a *memoryStatsWindowArchiver) {
+				minute := c.Rollups[0]
+				assert.Equal(t, 2, minute.Windows.Len())
+				assert.Equal(t, 2, minute.EvictedCount)
+				assert.Equal(t, now.Add(2*time.Minute), minute.Windows.At(0).Start)
+				assert.Equal(t, 2, len(a.windows))
+				assert.Equal(t, now, a.windows[0].Start)
+				assert.Equal(t, 6, a.windows[0].StatsMap["/api"].Count)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lateness := int64(0)
+			c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+				Name:                   "Test Stats Rollups",
+				DurationSeconds:        10,
+				AllowedLatenessSeconds: &lateness,
+				LatePolicy:             "reemit",
+				Aggregations:           []string{"sum(bytes)"},
+				Rollups:                tt.rollups,
+				SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+			})
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			archiver := &memoryStatsWindowArchiver{}
+			c.Archiver = archiver
+			_ = c.PrepareForConsumption(now)
+
+			consume := func(offsetSeconds int) {
+				err := c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api", "bytes": "10"},
+					T:          now.Add(time.Duration(offsetSeconds) * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source"},
+				})
+				assert.Nil(t, err)
+			}
+			for offset := 1; offset <= 191; offset += 10 {
+				consume(offset)
+			}
+			// A late log for a window that has been rolled up goes to the rollup window, which is still open
+			consume(185)
+			assert.Nil(t, c.FinishConsumption())
+
+			tt.postAssertions(t, c, archiver)
+		})
+	}
+}
+
+func TestStatsType_RollupReportInterval(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	lateness := int64(0)
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:                   "Test Stats Rollup Reports",
+		DurationSeconds:        10,
+		AllowedLatenessSeconds: &lateness,
+		Rollups:                []config.ConfigStatsRollup{{DurationSeconds: 60, ReportSeconds: 20}, {DurationSeconds: 120}},
+		SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	assert.Equal(t, 20*time.Second, c.Rollups[0].ReportInterval)
+	assert.Equal(t, 2*time.Minute, c.Rollups[1].ReportInterval)
+
+	out := captureStdout(t, func() {
+		_ = c.PrepareForConsumption(now)
+		for offset := 1; offset <= 191; offset += 10 {
+			err := c.ConsumeLog(LogMessageStructured{
+				KV:         map[string]string{"request": "/api"},
+				T:          now.Add(time.Duration(offset) * time.Second),
+				LogMessage: LogMessage{SourceName: "test_source"},
+			})
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, c.FinishConsumption())
+	})
+
+	// The 1m windows are reported 20s and 40s in, and when they end, and the 2m ones only when they end
+	assert.Equal(t, 7, strings.Count(out, "1m Rollup Report (so far)"))
+	assert.Equal(t, 4, strings.Count(out, "1m Rollup Report:"))
+	assert.Equal(t, 0, strings.Count(out, "2m Rollup Report (so far)"))
+	assert.Equal(t, 2, strings.Count(out, "2m Rollup Report:"))
+	assert.Contains(t, out, fmt.Sprintf("Time Start: %s\n\tTime End  : %s\n\t\t/api", now, now.Add(20*time.Second)))
+}
+
+// captureStdout returns what f prints to stdout, which is where the reports are logged.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create a pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		done <- string(b)
+	}()
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestStatsType_Flush(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+	received := time.Unix(1760000000, 0)
+
+	tests := []struct {
+		name           string
+		clock          string
+		postAssertions func(*testing.T, *StatsType)
+	}{
+		{
+			name:  "event clock waits for newer logs",
+			clock: "event",
+			postAssertions: func(t *testing.T, c *StatsType) {
+				assert.Equal(t, 2, c.Windows.Len())
+				assert.False(t, c.Windows.At(1).Reported)
+				assert.Empty(t, c.QueuedNotifications)
+			},
+		},
+		{
+			name:  "processing clock reports the quiet windows",
+			clock: "processing",
+			postAssertions: func(t *testing.T, c *StatsType) {
+				// The log at 1s was read 35s ago, so the watermark is at 36s
+				assert.Equal(t, 5, c.Windows.Len())
+				assert.Equal(t, 4, c.CurrentPointer)
+				for i := 1; i <= 3; i++ {
+					assert.True(t, c.Windows.At(i).Reported, i)
+				}
+				assert.False(t, c.Windows.At(4).Reported)
+				assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+				assert.Empty(t, c.Windows.At(2).StatsMap)
+				assert.Empty(t, c.QueuedNotifications)
+
+				// A log that comes in after the flush goes to the window it belongs to
+				err := c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api"},
+					T:          now.Add(37 * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source", ReceivedAt: received.Add(36 * time.Second)},
+				})
+				assert.Nil(t, err)
+				assert.Equal(t, 1, c.Windows.At(4).StatsMap["/api"].Count)
+				assert.Equal(t, 0, c.LateCount)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lateness := int64(0)
+			c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+				Name:                   "Test Stats Flush",
+				DurationSeconds:        10,
+				AllowedLatenessSeconds: &lateness,
+				Clock:                  tt.clock,
+				SourceSettings:         []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			err = c.ConsumeLog(LogMessageStructured{
+				KV:         map[string]string{"request": "/api"},
+				T:          now.Add(time.Second),
+				LogMessage: LogMessage{SourceName: "test_source", ReceivedAt: received},
+			})
+			assert.Nil(t, err)
+
+			assert.Nil(t, c.Flush(received.Add(35*time.Second)))
+			tt.postAssertions(t, c)
+		})
+	}
+
+	_, err := NewStatsTypeFromConfig(config.ConfigStatsType{Clock: "wall"})
+	assert.NotNil(t, err)
+}
+
+func TestStatsType_Watermark_FilteredLogs(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Unix(1549573860, 0)
+
+	c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+		Name:            "Test Stats Watermark Filtered",
+		DurationSeconds: 10,
+		Clock:           "event",
+		SourceSettings: []config.ConfigStatsTypeSourceSetting{
+			{Name: "source_a", Key: "request"},
+			{Name: "source_b", Key: "request", Filter: "status >= 500"},
+		},
+	})
+	if err != nil {
+		t.Errorf("could not generate StatsType: %s", err)
+		return
+	}
+	_ = c.PrepareForConsumption(now)
+
+	consume := func(src string, offsetSeconds int, status string) {
+		err := c.ConsumeLog(LogMessageStructured{
+			KV:         map[string]string{"request": "/api", "status": status},
+			T:          now.Add(time.Duration(offsetSeconds) * time.Second),
+			LogMessage: LogMessage{SourceName: src},
+		})
+		assert.Nil(t, err)
+	}
+
+	// Source B's only counted log is in the first window, and it holds the watermark back
+	consume("source_b", 1, "503")
+	consume("source_a", 25, "200")
+	assert.False(t, c.Windows.At(1).Reported)
+
+	// Source B's later logs are all filtered out, but they still move its time forward, which reports the window
+	consume("source_b", 13, "200")
+	assert.Equal(t, now.Add(13*time.Second), c.SourceLatestTimes["source_b"])
+	assert.True(t, c.Windows.At(1).Reported)
+	assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+	assert.Equal(t, []int{2}, c.QueuedNotifications) // until source B is past it too
+}
+
+func TestStatsType_LogsBeforeFirstWindow(t *testing.T) {
+	clog.LogLevel = 1
+	now := time.Date(2019, 2, 7, 21, 18, 3, 0, time.UTC)
+
+	tests := []struct {
+		policy              string
+		wantWindowLateCount int
+	}{
+		{policy: "drop", wantWindowLateCount: 0},
+		{policy: "count", wantWindowLateCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			c, err := NewStatsTypeFromConfig(config.ConfigStatsType{
+				Name:            "Test Stats Before First Window",
+				DurationSeconds: 10,
+				AlignWindows:    true,
+				LatePolicy:      tt.policy,
+				SourceSettings:  []config.ConfigStatsTypeSourceSetting{{Name: "test_source", Key: "request"}},
+			})
+			if err != nil {
+				t.Errorf("could not generate StatsType: %s", err)
+				return
+			}
+			_ = c.PrepareForConsumption(now)
+
+			// The first window starts at 21:18:00, so the second log is from before it
+			for _, offset := range []int{0, -5} {
+				err = c.ConsumeLog(LogMessageStructured{
+					KV:         map[string]string{"request": "/api"},
+					T:          now.Add(time.Duration(offset) * time.Second),
+					LogMessage: LogMessage{SourceName: "test_source"},
+				})
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, 1, c.LateCount)
+			assert.Equal(t, tt.wantWindowLateCount, c.Windows.Last().LateCount)
+			assert.Equal(t, 1, c.Windows.At(1).StatsMap["/api"].Count)
+			assert.Empty(t, c.Windows.At(0).StatsMap)
+		})
+	}
+}
+
+func TestStatsWindowRing(t *testing.T) {
+	now := time.Unix(1549573860, 0)
+	window := func(i int) StatsWindow {
+		return NewStatsWindow(now.Add(time.Duration(i)*time.Second), now.Add(time.Duration(i+1)*time.Second))
+	}
+	starts := func(r *StatsWindowRing) []int {
+		var got []int
+		for i := 0; i < r.Len(); i++ {
+			got = append(got, int(r.At(i).Start.Sub(now)/time.Second))
+		}
+		return got
+	}
+
+	// Evicting and appending wraps around, without growing
+	r := NewStatsWindowRing(3)
+	for i := 0; i < 3; i++ {
+		r.Append(window(i))
+	}
+	r.DropFront(2)
+	r.Append(window(3))
+	r.Append(window(4))
+	assert.Equal(t, []int{2, 3, 4}, starts(&r))
+	assert.Equal(t, 3, r.Cap())
+	assert.Equal(t, now.Add(4*time.Second), r.Last().Start)
+
+	// A full ring grows, and keeps the order
+	r.Append(window(5))
+	assert.Equal(t, []int{2, 3, 4, 5}, starts(&r))
+	assert.Equal(t, 6, r.Cap())
+
+	// Dropping more than there is empties it
+	r.DropFront(10)
+	assert.Equal(t, 0, r.Len())
+	r.Append(window(6))
+	assert.Equal(t, []int{6}, starts(&r))
+	assert.Panics(t, func() { r.At(1) })
+}
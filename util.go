@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"sort"
 	"strings"
 )
 
@@ -54,26 +53,3 @@ func removeQuotes(str string) string {
 	}
 	return str
 }
-
-func sortMapKeysByValue(kv map[string]int) []string {
-	// Reverse the map
-	var vk = make(map[int][]string)
-	for k, v := range kv {
-		vk[v] = append(vk[v], k)
-	}
-
-	// Get keys
-	var vs []int
-	for v := range vk {
-		vs = append(vs, v)
-	}
-
-	sort.Sort(sort.Reverse(sort.IntSlice(vs)))
-
-	var sortedKs []string
-	for _, v := range vs {
-		sortedKs = append(sortedKs, vk[v]...)
-	}
-	return sortedKs
-
-}